@@ -0,0 +1,228 @@
+package facts
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/ctr2cloud/ctr2cloud/pkg/generic/compute"
+	"github.com/ctr2cloud/ctr2cloud/pkg/provisioners/packages"
+	"github.com/juju/zaputil/zapctx"
+	"go.uber.org/zap"
+)
+
+type InitSystem string
+
+const (
+	InitSystemd  InitSystem = "systemd"
+	InitOpenRC   InitSystem = "openrc"
+	InitSysVinit InitSystem = "sysvinit"
+	InitRunit    InitSystem = "runit"
+	// InitNone is used if pid 1 is not a service manager, e.g. a shell in a container
+	InitNone InitSystem = "none"
+)
+
+// VirtualizationNone is used for bare metal hosts
+const VirtualizationNone = "none"
+
+// containerVirtualizations are the container types reported by systemd-detect-virt and the fallback checks
+var containerVirtualizations = []string{"docker", "podman", "lxc", "lxc-libvirt", "systemd-nspawn", "openvz", "wsl", "rkt", "proot", "pouch"}
+
+type Disk struct {
+	Device         string
+	MountPoint     string
+	SizeBytes      uint64
+	AvailableBytes uint64
+}
+
+type Mount struct {
+	Device     string
+	MountPoint string
+	FSType     string
+	Options    []string
+}
+
+type Interface struct {
+	Name       string
+	MACAddress string
+	Up         bool
+	Addresses  []compute.Address
+}
+
+// Facts describes an instance
+type Facts struct {
+	// OSRelease contains all fields of /etc/os-release
+	OSRelease map[string]string
+	// OS is the ID field of os-release, e.g. debian or alpine
+	OS string
+	// OSVersion is the VERSION_ID field of os-release, e.g. 12
+	OSVersion string
+	Kernel    string
+	// Arch is the machine hardware name as reported by uname, e.g. x86_64 or aarch64
+	Arch        string
+	CPUCount    int
+	MemoryBytes uint64
+	// Disks are the mounted filesystems with their usage
+	Disks      []Disk
+	Mounts     []Mount
+	Interfaces []Interface
+	InitSystem InitSystem
+	// PackageFamily is empty if the distribution is not supported by the packages provisioner
+	PackageFamily packages.Family
+	// PackageManager is the name of the package manager binary, e.g. apt, dnf or apk
+	PackageManager string
+	// Virtualization is the container or hypervisor type, e.g. lxc, docker or kvm, or VirtualizationNone
+	Virtualization string
+}
+
+// IsContainer returns true if the instance runs in a container
+func (f *Facts) IsContainer() bool {
+	for _, virtualization := range containerVirtualizations {
+		if f.Virtualization == virtualization {
+			return true
+		}
+	}
+	return false
+}
+
+// IsVirtualMachine returns true if the instance runs on a hypervisor
+func (f *Facts) IsVirtualMachine() bool {
+	return f.Virtualization != VirtualizationNone && f.Virtualization != "" && !f.IsContainer()
+}
+
+// Addresses returns the addresses of all interfaces
+func (f *Facts) Addresses() []compute.Address {
+	addresses := make([]compute.Address, 0)
+	for _, iface := range f.Interfaces {
+		addresses = append(addresses, iface.Addresses...)
+	}
+	return addresses
+}
+
+var packageManagers = map[packages.Family]string{
+	packages.FamilyDebian: "apt",
+	packages.FamilyRHEL:   "dnf",
+	packages.FamilyAlpine: "apk",
+}
+
+// gatherSections are run in a single command to avoid a round trip per fact.
+// Every command must succeed or be silenced, the output of a section is parsed independently.
+var gatherSections = []struct {
+	name string
+	cmd  string
+}{
+	{"os-release", "cat /etc/os-release"},
+	{"kernel", "uname -r"},
+	{"arch", "uname -m"},
+	{"nproc", "nproc 2>/dev/null || grep -c ^processor /proc/cpuinfo"},
+	{"meminfo", "cat /proc/meminfo"},
+	{"df", "df -P -k 2>/dev/null"},
+	{"mounts", "cat /proc/mounts"},
+	{"ip", "ip addr 2>/dev/null"},
+	{"init", "cat /proc/1/comm 2>/dev/null; [ -d /run/systemd/system ] && echo run-systemd; command -v openrc >/dev/null && echo openrc; [ -d /etc/init.d ] && echo init.d"},
+	{"virt", "echo detect-virt: $(systemd-detect-virt 2>/dev/null); [ -f /.dockerenv ] && echo dockerenv; [ -f /run/.containerenv ] && echo containerenv; tr '\\0' '\\n' < /proc/1/environ 2>/dev/null | grep ^container=; grep -q hypervisor /proc/cpuinfo && echo hypervisor"},
+}
+
+const sectionMarker = "==ctr2cloud-facts:"
+
+var gatherCmd = func() string {
+	parts := make([]string, 0, len(gatherSections)+1)
+	for _, section := range gatherSections {
+		parts = append(parts, fmt.Sprintf("echo '%s%s'; %s", sectionMarker, section.name, section.cmd))
+	}
+	// the exit code of the last check is irrelevant
+	parts = append(parts, "true")
+	return strings.Join(parts, "; ")
+}()
+
+// splitSections splits the output of gatherCmd into the output of the individual sections
+func splitSections(output string) map[string]string {
+	sections := make(map[string]string)
+	current := ""
+	var sb strings.Builder
+	for _, line := range strings.Split(output, "\n") {
+		if name, ok := strings.CutPrefix(line, sectionMarker); ok {
+			if current != "" {
+				sections[current] = sb.String()
+			}
+			current = name
+			sb.Reset()
+			continue
+		}
+		sb.WriteString(line)
+		sb.WriteString("\n")
+	}
+	if current != "" {
+		sections[current] = sb.String()
+	}
+	return sections
+}
+
+// parseFacts builds the facts from the output of gatherCmd
+func parseFacts(output string) (*Facts, error) {
+	sections := splitSections(output)
+	for _, section := range gatherSections {
+		if _, ok := sections[section.name]; !ok {
+			return nil, fmt.Errorf("missing facts section %s", section.name)
+		}
+	}
+	var err error
+	f := &Facts{
+		OSRelease:      parseOSRelease(sections["os-release"]),
+		Kernel:         strings.TrimSpace(sections["kernel"]),
+		Arch:           strings.TrimSpace(sections["arch"]),
+		Interfaces:     parseInterfaces(sections["ip"]),
+		InitSystem:     parseInitSystem(sections["init"]),
+		Virtualization: parseVirtualization(sections["virt"]),
+	}
+	f.OS = f.OSRelease["ID"]
+	f.OSVersion = f.OSRelease["VERSION_ID"]
+	if family, err := packages.FamilyFromOSRelease(f.OSRelease); err == nil {
+		f.PackageFamily = family
+		f.PackageManager = packageManagers[family]
+	}
+	f.CPUCount, err = parseCPUCount(sections["nproc"])
+	if err != nil {
+		return nil, err
+	}
+	f.MemoryBytes, err = parseMemTotal(sections["meminfo"])
+	if err != nil {
+		return nil, err
+	}
+	f.Disks, err = parseDF(sections["df"])
+	if err != nil {
+		return nil, err
+	}
+	f.Mounts = parseMounts(sections["mounts"])
+	return f, nil
+}
+
+// Collect gathers the facts of the instance without using the cache
+func Collect(ctx context.Context, executor *compute.CommandExecutor) (*Facts, error) {
+	logger := zapctx.Logger(ctx)
+	output, err := executor.ExecString(ctx, gatherCmd)
+	if err != nil {
+		logger.Debug("gathering facts failed", zap.String("output", output))
+		return nil, fmt.Errorf("gathering facts: %w", err)
+	}
+	f, err := parseFacts(output)
+	if err != nil {
+		return nil, fmt.Errorf("parsing facts: %w", err)
+	}
+	logger.Debug("gathered facts", zap.String("os", f.OS), zap.String("arch", f.Arch), zap.String("init", string(f.InitSystem)), zap.String("virtualization", f.Virtualization))
+	return f, nil
+}
+
+type factsCacheKey struct{}
+
+// Get returns the facts of the instance, they are gathered once per executor.
+// The returned facts are shared and must not be modified.
+func Get(ctx context.Context, executor *compute.CommandExecutor) (*Facts, error) {
+	f, err := executor.Cached(factsCacheKey{}, func() (any, error) {
+		return Collect(ctx, executor)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return f.(*Facts), nil
+}
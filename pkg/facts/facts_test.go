@@ -0,0 +1,118 @@
+package facts
+
+import (
+	_ "embed"
+	"testing"
+	"time"
+
+	"github.com/ctr2cloud/ctr2cloud/internal/test"
+	"github.com/ctr2cloud/ctr2cloud/pkg/provisioners/packages"
+	"github.com/stretchr/testify/require"
+)
+
+//go:embed testdata/debian-lxc.txt
+var debianLXCOutput string
+
+//go:embed testdata/alpine-docker.txt
+var alpineDockerOutput string
+
+func TestParseFactsDebianLXC(t *testing.T) {
+	f, err := parseFacts(debianLXCOutput)
+	require.NoError(t, err)
+
+	require.Equal(t, "debian", f.OS)
+	require.Equal(t, "12", f.OSVersion)
+	require.Equal(t, "bookworm", f.OSRelease["VERSION_CODENAME"])
+	require.Equal(t, "6.1.0-18-amd64", f.Kernel)
+	require.Equal(t, "x86_64", f.Arch)
+	require.Equal(t, 4, f.CPUCount)
+	require.Equal(t, uint64(8138200*1024), f.MemoryBytes)
+	require.Equal(t, InitSystemd, f.InitSystem)
+	require.Equal(t, packages.FamilyDebian, f.PackageFamily)
+	require.Equal(t, "apt", f.PackageManager)
+	require.Equal(t, "lxc", f.Virtualization)
+	require.True(t, f.IsContainer())
+	require.False(t, f.IsVirtualMachine())
+
+	require.Len(t, f.Disks, 4)
+	require.Equal(t, Disk{Device: "/dev/sda2", MountPoint: "/", SizeBytes: 30832548 * 1024, AvailableBytes: 25000000 * 1024}, f.Disks[0])
+
+	require.Len(t, f.Mounts, 6)
+	require.Equal(t, "ext4", f.Mounts[0].FSType)
+	require.Equal(t, []string{"rw", "relatime"}, f.Mounts[0].Options)
+	require.Equal(t, "/mnt/backup disk", f.Mounts[5].MountPoint)
+
+	require.Len(t, f.Interfaces, 2)
+	require.Equal(t, "lo", f.Interfaces[0].Name)
+	require.Len(t, f.Interfaces[0].Addresses, 2)
+	eth0 := f.Interfaces[1]
+	require.Equal(t, "eth0", eth0.Name)
+	require.True(t, eth0.Up)
+	require.Equal(t, "00:16:3e:5a:2b:1c", eth0.MACAddress)
+	require.Len(t, eth0.Addresses, 3)
+	require.Equal(t, "10.94.132.17", eth0.Addresses[0].Address)
+	require.Equal(t, "24", eth0.Addresses[0].Netmask)
+	require.Len(t, f.Addresses(), 5)
+}
+
+func TestParseFactsAlpineDocker(t *testing.T) {
+	f, err := parseFacts(alpineDockerOutput)
+	require.NoError(t, err)
+
+	require.Equal(t, "alpine", f.OS)
+	require.Equal(t, "3.19.1", f.OSVersion)
+	require.Equal(t, "aarch64", f.Arch)
+	require.Equal(t, 2, f.CPUCount)
+	require.Equal(t, InitNone, f.InitSystem)
+	require.Equal(t, packages.FamilyAlpine, f.PackageFamily)
+	require.Equal(t, "apk", f.PackageManager)
+	require.Equal(t, "docker", f.Virtualization)
+	require.True(t, f.IsContainer())
+
+	require.Len(t, f.Disks, 3)
+	require.Equal(t, "overlay", f.Mounts[0].FSType)
+	require.Len(t, f.Interfaces, 2)
+	require.Equal(t, "02:42:ac:11:00:02", f.Interfaces[1].MACAddress)
+	require.Equal(t, "172.17.0.2", f.Interfaces[1].Addresses[0].Address)
+}
+
+func TestParseFactsMissingSection(t *testing.T) {
+	_, err := parseFacts("==ctr2cloud-facts:kernel\n6.1.0\n")
+	require.Error(t, err)
+}
+
+func TestParseInitSystem(t *testing.T) {
+	require.Equal(t, InitOpenRC, parseInitSystem("init\nopenrc\ninit.d\n"))
+	require.Equal(t, InitSysVinit, parseInitSystem("init\ninit.d\n"))
+	require.Equal(t, InitRunit, parseInitSystem("runit\n"))
+	require.Equal(t, InitNone, parseInitSystem("sh\n"))
+}
+
+func TestParseVirtualization(t *testing.T) {
+	require.Equal(t, "kvm", parseVirtualization("detect-virt: kvm\nhypervisor\n"))
+	require.Equal(t, VirtualizationNone, parseVirtualization("detect-virt: none\n"))
+	require.Equal(t, "lxc", parseVirtualization("detect-virt:\ncontainer=lxc\n"))
+	require.Equal(t, "vm", parseVirtualization("detect-virt:\nhypervisor\n"))
+	require.Equal(t, VirtualizationNone, parseVirtualization("detect-virt:\n"))
+}
+
+const testGetInstanceName = "test-facts-get"
+
+func TestGet(t *testing.T) {
+	executor, err := test.GetLXDExecutorFactory(t, testGetInstanceName)()
+	ctx, r := test.DefaultPreamble(t, time.Minute)
+	r.NoError(err)
+
+	f, err := Get(ctx, executor)
+	r.NoError(err)
+	r.Equal("debian", f.OS)
+	r.Equal(InitSystemd, f.InitSystem)
+	r.True(f.IsContainer())
+	r.Positive(f.CPUCount)
+	r.NotEmpty(f.Addresses())
+
+	// the facts are cached per executor
+	cached, err := Get(ctx, executor)
+	r.NoError(err)
+	r.Same(f, cached)
+}
@@ -0,0 +1,218 @@
+package facts
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	compute_internal "github.com/ctr2cloud/ctr2cloud/internal/generic/compute"
+)
+
+func parseOSRelease(output string) map[string]string {
+	osRelease := make(map[string]string)
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		osRelease[key] = strings.Trim(value, `"'`)
+	}
+	return osRelease
+}
+
+func parseCPUCount(output string) (int, error) {
+	count, err := strconv.Atoi(strings.TrimSpace(output))
+	if err != nil {
+		return 0, fmt.Errorf("parsing cpu count: %w", err)
+	}
+	return count, nil
+}
+
+// parseMemTotal returns the MemTotal of /proc/meminfo in bytes
+func parseMemTotal(output string) (uint64, error) {
+	for _, line := range strings.Split(output, "\n") {
+		// example line:
+		// MemTotal:        8138200 kB
+		fields := strings.Fields(line)
+		if len(fields) != 3 || fields[0] != "MemTotal:" {
+			continue
+		}
+		kb, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("parsing MemTotal: %w", err)
+		}
+		return kb * 1024, nil
+	}
+	return 0, fmt.Errorf("MemTotal missing from meminfo")
+}
+
+// parseDF parses the output of df -P -k
+func parseDF(output string) ([]Disk, error) {
+	disks := make([]Disk, 0)
+	for _, line := range strings.Split(output, "\n") {
+		// example lines:
+		// Filesystem     1024-blocks    Used Available Capacity Mounted on
+		// /dev/sda1         30832548 4259732  25000000      15% /
+		fields := strings.Fields(line)
+		if len(fields) < 6 || fields[0] == "Filesystem" {
+			continue
+		}
+		size, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("parsing size of %s: %w", fields[0], err)
+		}
+		available, err := strconv.ParseUint(fields[3], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("parsing available space of %s: %w", fields[0], err)
+		}
+		disks = append(disks, Disk{
+			Device: fields[0],
+			// mount points may contain spaces
+			MountPoint:     strings.Join(fields[5:], " "),
+			SizeBytes:      size * 1024,
+			AvailableBytes: available * 1024,
+		})
+	}
+	return disks, nil
+}
+
+// unescapeMountField reverses the octal escaping of /proc/mounts, e.g. \040 for a space
+func unescapeMountField(field string) string {
+	if !strings.Contains(field, `\`) {
+		return field
+	}
+	var sb strings.Builder
+	for i := 0; i < len(field); i++ {
+		if field[i] == '\\' && i+3 < len(field) {
+			if value, err := strconv.ParseUint(field[i+1:i+4], 8, 8); err == nil {
+				sb.WriteByte(byte(value))
+				i += 3
+				continue
+			}
+		}
+		sb.WriteByte(field[i])
+	}
+	return sb.String()
+}
+
+// parseMounts parses /proc/mounts
+func parseMounts(output string) []Mount {
+	mounts := make([]Mount, 0)
+	for _, line := range strings.Split(output, "\n") {
+		// example line:
+		// /dev/sda1 / ext4 rw,relatime 0 0
+		fields := strings.Fields(line)
+		if len(fields) < 4 {
+			continue
+		}
+		mounts = append(mounts, Mount{
+			Device:     unescapeMountField(fields[0]),
+			MountPoint: unescapeMountField(fields[1]),
+			FSType:     fields[2],
+			Options:    strings.Split(fields[3], ","),
+		})
+	}
+	return mounts
+}
+
+// interfaceHeaderRegex matches the first line of an interface in the output of ip addr, e.g.
+// 2: eth0@if12: <BROADCAST,MULTICAST,UP,LOWER_UP> mtu 1500 qdisc noqueue state UP group default qlen 1000
+var interfaceHeaderRegex = regexp.MustCompile(`^\d+: ([^:@]+)(?:@[^:]+)?: <([^>]*)>`)
+
+var linkAddressRegex = regexp.MustCompile(`^\s+link/\S+ ([0-9a-f:]+)`)
+
+// parseInterfaces splits the output of ip addr by interface and parses the addresses with ParseIPAddrOutput
+func parseInterfaces(output string) []Interface {
+	interfaces := make([]Interface, 0)
+	var block strings.Builder
+	flush := func() {
+		if len(interfaces) > 0 {
+			interfaces[len(interfaces)-1].Addresses = compute_internal.ParseIPAddrOutput(block.String())
+		}
+		block.Reset()
+	}
+	for _, line := range strings.Split(output, "\n") {
+		if match := interfaceHeaderRegex.FindStringSubmatch(line); match != nil {
+			flush()
+			flags := strings.Split(match[2], ",")
+			up := false
+			for _, flag := range flags {
+				up = up || flag == "UP"
+			}
+			interfaces = append(interfaces, Interface{Name: match[1], Up: up})
+			continue
+		}
+		if match := linkAddressRegex.FindStringSubmatch(line); match != nil && len(interfaces) > 0 {
+			interfaces[len(interfaces)-1].MACAddress = match[1]
+		}
+		block.WriteString(line)
+		block.WriteString("\n")
+	}
+	flush()
+	return interfaces
+}
+
+// parseInitSystem determines the init system from the output of the init section
+func parseInitSystem(output string) InitSystem {
+	lines := strings.Fields(output)
+	has := func(s string) bool {
+		for _, line := range lines {
+			if line == s {
+				return true
+			}
+		}
+		return false
+	}
+	switch {
+	// the canonical check used by sd_booted
+	case has("run-systemd"):
+		return InitSystemd
+	case has("openrc") && (has("init") || has("openrc-init")):
+		return InitOpenRC
+	case has("runit") || has("runit-init"):
+		return InitRunit
+	case has("init") && has("init.d"):
+		return InitSysVinit
+	default:
+		return InitNone
+	}
+}
+
+// parseVirtualization determines the virtualization type from the output of the virt section.
+// systemd-detect-virt is preferred, the marker files are used where it is not available.
+func parseVirtualization(output string) string {
+	markers := make(map[string]bool)
+	container := ""
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if virt, ok := strings.CutPrefix(line, "detect-virt:"); ok {
+			if virt = strings.TrimSpace(virt); virt != "" {
+				return virt
+			}
+			continue
+		}
+		if value, ok := strings.CutPrefix(line, "container="); ok {
+			container = value
+			continue
+		}
+		markers[line] = true
+	}
+	switch {
+	case markers["dockerenv"]:
+		return "docker"
+	case markers["containerenv"]:
+		return "podman"
+	case container != "":
+		return container
+	case markers["hypervisor"]:
+		// the hypervisor type can not be determined without systemd-detect-virt
+		return "vm"
+	default:
+		return VirtualizationNone
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"strconv"
+	"sync"
 
 	"github.com/juju/zaputil/zapctx"
 	"go.uber.org/zap"
@@ -46,13 +47,26 @@ func (e CommandExecutorError) Error() string {
 	return "command failed with return code " + strconv.Itoa(e.Code)
 }
 
-func (e CommandExecutorError) Unwrap() error {
-	return e
-}
-
 // CommandExecutor wraps a MinimalCommandExecutor and provides some convenient helper functions
 type CommandExecutor struct {
 	MinimalCommandExecutor
+
+	// cache holds facts about the instance which do not change during the lifetime of the executor
+	cache sync.Map
+}
+
+// Cached returns the value stored for key, f is only called if there is no value yet.
+// Errors are returned but not cached, so a failed lookup is retried on the next call.
+func (e *CommandExecutor) Cached(key any, f func() (any, error)) (any, error) {
+	if value, ok := e.cache.Load(key); ok {
+		return value, nil
+	}
+	value, err := f()
+	if err != nil {
+		return nil, err
+	}
+	value, _ = e.cache.LoadOrStore(key, value)
+	return value, nil
 }
 
 func (e *CommandExecutor) Exec(ctx context.Context, cmd string) ([]byte, error) {
@@ -0,0 +1,23 @@
+package compute
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCommandExecutorErrorIs(t *testing.T) {
+	target := errors.New("target")
+	err := fmt.Errorf("apt-get: %w", CommandExecutorError{Code: 100})
+
+	// an Unwrap returning the error itself made errors.Is loop forever
+	require.False(t, errors.Is(CommandExecutorError{Code: 1}, target))
+	require.False(t, errors.Is(err, target))
+	require.True(t, errors.Is(err, CommandExecutorError{Code: 100}))
+
+	var cErr CommandExecutorError
+	require.True(t, errors.As(err, &cErr))
+	require.Equal(t, 100, cErr.Code)
+}
@@ -0,0 +1,76 @@
+package compute
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var shellSafeRegex = regexp.MustCompile(`^[a-zA-Z0-9_./:=@%+,-]+$`)
+
+// ShellQuote quotes s so that a POSIX shell treats it as a single word.
+// Strings that only contain safe characters are returned unchanged to keep logged commands readable.
+func ShellQuote(s string) string {
+	if shellSafeRegex.MatchString(s) {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+var ErrUnterminatedQuote = errors.New("unterminated quote")
+
+// SplitShellWords splits s into words with the quoting rules of a POSIX shell.
+// Parameter expansion, command substitution and globbing are not performed.
+func SplitShellWords(s string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	inWord := false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+			continue
+		case c == '\\':
+			i++
+			// a backslash before a newline continues the line
+			if i < len(s) && s[i] != '\n' {
+				word.WriteByte(s[i])
+			}
+		case c == '\'':
+			end := strings.IndexByte(s[i+1:], '\'')
+			if end < 0 {
+				return nil, fmt.Errorf("%w: %s", ErrUnterminatedQuote, s)
+			}
+			word.WriteString(s[i+1 : i+1+end])
+			i += end + 1
+		case c == '"':
+			i++
+			for ; i < len(s) && s[i] != '"'; i++ {
+				// inside double quotes the backslash only escapes characters which are special there
+				if s[i] == '\\' && i+1 < len(s) && strings.IndexByte("$`\"\\\n", s[i+1]) >= 0 {
+					i++
+					if s[i] == '\n' {
+						continue
+					}
+				}
+				word.WriteByte(s[i])
+			}
+			if i == len(s) {
+				return nil, fmt.Errorf("%w: %s", ErrUnterminatedQuote, s)
+			}
+		default:
+			word.WriteByte(c)
+		}
+		inWord = true
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
@@ -0,0 +1,39 @@
+package compute
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSplitShellWords(t *testing.T) {
+	for input, expected := range map[string][]string{
+		"":                             nil,
+		"  serve --port 8080 ":         {"serve", "--port", "8080"},
+		`sh -c 'echo "$HOME"; exit 1'`: {"sh", "-c", `echo "$HOME"; exit 1`},
+		`echo "a \"b\" \$c \d" ''`:     {"echo", `a "b" $c \d`, ""},
+		`a\ b c\\d "x"'y'z`:            {"a b", `c\d`, "xyz"},
+		"one \\\ntwo":                  {"one", "two"},
+		"redis-server --save 60 1":     {"redis-server", "--save", "60", "1"},
+		`--name='it'\''s'`:             {"--name=it's"},
+	} {
+		words, err := SplitShellWords(input)
+		require.NoError(t, err, input)
+		require.Equal(t, expected, words, input)
+	}
+
+	for _, input := range []string{`echo 'a`, `echo "a`, `echo "a\"`} {
+		_, err := SplitShellWords(input)
+		require.ErrorIs(t, err, ErrUnterminatedQuote, input)
+	}
+
+	// words quoted by ShellQuote are split back into the original words
+	args := []string{"serve", "--port 8080", "it's", ""}
+	quoted := ""
+	for _, arg := range args {
+		quoted += " " + ShellQuote(arg)
+	}
+	words, err := SplitShellWords(quoted)
+	require.NoError(t, err)
+	require.Equal(t, args, words)
+}
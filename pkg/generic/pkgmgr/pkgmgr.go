@@ -0,0 +1,42 @@
+package pkgmgr
+
+import (
+	"context"
+	"errors"
+
+	"github.com/ctr2cloud/ctr2cloud/pkg/pipeline"
+)
+
+var ErrNotFound = errors.New("package not found")
+
+type PackageSpec struct {
+	Name string
+	// Version pins the package to an exact version, any installed version is accepted if empty
+	Version string
+	// Hold prevents the package from being upgraded or removed by the package manager
+	Hold bool
+}
+
+type RemoveOptions struct {
+	// Purge also removes configuration files, including those of already removed packages.
+	// It is ignored by package managers which do not distinguish between remove and purge.
+	Purge bool
+	// Autoremove removes dependencies which are no longer needed after a package was removed
+	Autoremove bool
+}
+
+// PackageManager is implemented by the distribution specific package provisioners
+// so that callers do not need to know which one is used on an instance
+type PackageManager interface {
+	// GetPackageVersions returns the installed versions of packageNames.
+	// Packages that are not installed are omitted from the result.
+	GetPackageVersions(ctx context.Context, packageNames ...string) (map[string]string, error)
+	// EnsurePackagesInstalled ensures that all packages are installed at the requested version
+	EnsurePackagesInstalled(ctx context.Context, specs []PackageSpec) (bool, error)
+	// EnsurePackagesInstalledP is the pipeline version of EnsurePackagesInstalled
+	EnsurePackagesInstalledP(specs ...PackageSpec) pipeline.FuncT
+	// EnsurePackagesAbsent ensures that none of the packages are installed
+	EnsurePackagesAbsent(ctx context.Context, packageNames []string, opts RemoveOptions) (bool, error)
+	// EnsurePackagesAbsentP is the pipeline version of EnsurePackagesAbsent
+	EnsurePackagesAbsentP(packageNames []string, opts RemoveOptions) pipeline.FuncT
+}
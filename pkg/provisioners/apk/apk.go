@@ -0,0 +1,314 @@
+package apk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/ctr2cloud/ctr2cloud/pkg/generic/compute"
+	"github.com/ctr2cloud/ctr2cloud/pkg/generic/pkgmgr"
+	"github.com/ctr2cloud/ctr2cloud/pkg/pipeline"
+	"github.com/ctr2cloud/ctr2cloud/pkg/provisioners/file"
+	"github.com/juju/zaputil/zapctx"
+	"github.com/samber/lo"
+	"go.uber.org/zap"
+)
+
+var _ pkgmgr.PackageManager = &Provisioner{}
+
+type Provisioner struct {
+	*compute.CommandExecutor
+}
+
+var ErrNotFound = pkgmgr.ErrNotFound
+
+type PackageSpec = pkgmgr.PackageSpec
+type RemoveOptions = pkgmgr.RemoveOptions
+
+// worldPath lists the packages explicitly requested by the user together with their version constraints
+const worldPath = "/etc/apk/world"
+
+// splitPackageVersion splits name-pkgver-rN as printed by apk into name and pkgver-rN
+func splitPackageVersion(nameVersion string) (string, string, bool) {
+	releaseIdx := strings.LastIndex(nameVersion, "-")
+	if releaseIdx == -1 {
+		return "", "", false
+	}
+	versionIdx := strings.LastIndex(nameVersion[:releaseIdx], "-")
+	if versionIdx == -1 {
+		return "", "", false
+	}
+	return nameVersion[:versionIdx], nameVersion[versionIdx+1:], true
+}
+
+// parseAPKListOutput parses the output of apk list --installed into a map of package name to version
+func parseAPKListOutput(output string) map[string]string {
+	res := make(map[string]string)
+	for _, line := range strings.Split(output, "\n") {
+		// example line:
+		// openssh-server-9.6_p1-r0 x86_64 {openssh} (SSH-OpenSSH AND ISC AND BSD-3-Clause) [installed]
+		if !strings.Contains(line, "[installed]") {
+			continue
+		}
+		fields := strings.Fields(line)
+		name, version, ok := splitPackageVersion(fields[0])
+		if !ok {
+			continue
+		}
+		res[name] = version
+	}
+	return res
+}
+
+// parseWorld parses /etc/apk/world into a map of package name to constraint, e.g. =1.7.1-r0
+func parseWorld(world string) map[string]string {
+	res := make(map[string]string)
+	for _, entry := range strings.Fields(world) {
+		idx := strings.IndexAny(entry, "=<>~@")
+		if idx == -1 {
+			res[entry] = ""
+			continue
+		}
+		res[entry[:idx]] = entry[idx:]
+	}
+	return res
+}
+
+// versionMatches returns true if the installed pkgver-rN satisfies wanted, which may omit the release
+func versionMatches(installed, wanted string) bool {
+	return installed == wanted || strings.HasPrefix(installed, wanted+"-r")
+}
+
+// constraint returns the world constraint for spec given the installed version.
+// A package with a version is always pinned since apk keeps constraints in the world file.
+func constraint(spec PackageSpec, installedVersion string) string {
+	switch {
+	case spec.Version != "" && strings.Contains(spec.Version, "-r"):
+		return spec.Name + "=" + spec.Version
+	case spec.Version != "":
+		// ~ accepts any release of the version
+		return spec.Name + "~" + spec.Version
+	case spec.Hold && installedVersion != "":
+		return spec.Name + "=" + installedVersion
+	default:
+		return spec.Name
+	}
+}
+
+// GetPackageVersions returns the installed versions of packageNames using a single apk query.
+// Packages that are not installed are omitted from the result.
+func (p *Provisioner) GetPackageVersions(ctx context.Context, packageNames ...string) (map[string]string, error) {
+	logger := zapctx.Logger(ctx)
+	quotedNames := lo.Map(packageNames, func(name string, _ int) string { return compute.ShellQuote(name) })
+	output, err := p.CommandExecutor.ExecString(ctx, "apk list --installed "+strings.Join(quotedNames, " "))
+	logger.Debug("apk list", zap.Error(err), zap.String("output", output))
+	if err != nil {
+		return nil, fmt.Errorf("apk list: %w", err)
+	}
+	// apk list matches patterns, only keep the exact names
+	return lo.PickByKeys(parseAPKListOutput(output), packageNames), nil
+}
+
+// GetPackageVersion returns the installed version of packageName or ErrNotFound if it is not installed
+func (p *Provisioner) GetPackageVersion(ctx context.Context, packageName string) (string, error) {
+	versions, err := p.GetPackageVersions(ctx, packageName)
+	if err != nil {
+		return "", err
+	}
+	version, ok := versions[packageName]
+	if !ok {
+		return "", ErrNotFound
+	}
+	return version, nil
+}
+
+func (p *Provisioner) getWorld(ctx context.Context) (map[string]string, error) {
+	fProvisioner := file.Provisioner{CommandExecutor: p.CommandExecutor}
+	world, err := fProvisioner.GetFileContents(ctx, worldPath)
+	if err != nil {
+		if errors.Is(err, file.ErrFileNotFound) {
+			return map[string]string{}, nil
+		}
+		return nil, fmt.Errorf("reading %s: %w", worldPath, err)
+	}
+	return parseWorld(string(world)), nil
+}
+
+// Update unconditionally refreshes the package index
+func (p *Provisioner) Update(ctx context.Context) error {
+	return p.apk(ctx, "update")
+}
+
+// apk runs apk with the given (already quoted) arguments
+func (p *Provisioner) apk(ctx context.Context, args string) error {
+	logger := zapctx.Logger(ctx)
+	cmd := "apk --no-progress " + args
+	output, err := p.CommandExecutor.ExecString(ctx, cmd)
+	logger.Debug("apk", zap.String("cmd", cmd), zap.Error(err), zap.String("output", output))
+	if err != nil {
+		// ERROR: unable to select packages:
+		//   foo (no such package):
+		if strings.Contains(output, "no such package") {
+			return fmt.Errorf("%w: %s: %w", ErrNotFound, strings.TrimSpace(output), err)
+		}
+		return fmt.Errorf("%s: %w", strings.TrimSpace(output), err)
+	}
+	return nil
+}
+
+// add runs apk add and refreshes the package index once if a package is unknown.
+// Container images usually ship without an index.
+func (p *Provisioner) add(ctx context.Context, args string) error {
+	err := p.apk(ctx, "add "+args)
+	if !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	zapctx.Logger(ctx).Debug("package not found, refreshing the package index")
+	err = p.Update(ctx)
+	if err != nil {
+		return fmt.Errorf("apk update: %w", err)
+	}
+	return p.apk(ctx, "add "+args)
+}
+
+// EnsurePackagesInstalled ensures that all packages are installed at the requested version.
+// Packages with a version are pinned in the world file, Hold pins packages without a version
+// to the installed version.
+func (p *Provisioner) EnsurePackagesInstalled(ctx context.Context, specs []PackageSpec) (bool, error) {
+	logger := zapctx.Logger(ctx)
+	if len(specs) == 0 {
+		return false, nil
+	}
+	versions, err := p.GetPackageVersions(ctx, lo.Map(specs, func(spec PackageSpec, _ int) string { return spec.Name })...)
+	if err != nil {
+		return false, err
+	}
+	world, err := p.getWorld(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	toAdd := make([]string, 0)
+	toPin := make([]PackageSpec, 0)
+	for _, spec := range specs {
+		version, installed := versions[spec.Name]
+		switch {
+		case !installed:
+			logger.Debug("package not installed", zap.String("package", spec.Name))
+		case spec.Version != "" && !versionMatches(version, spec.Version):
+			logger.Debug("package version mismatch", zap.String("package", spec.Name), zap.String("version", version), zap.String("expected", spec.Version))
+		default:
+			logger.Debug("package already installed", zap.String("package", spec.Name), zap.String("version", version))
+			if spec.Hold && world[spec.Name] != "="+version {
+				toPin = append(toPin, PackageSpec{Name: spec.Name, Version: version, Hold: true})
+			}
+			continue
+		}
+		toAdd = append(toAdd, compute.ShellQuote(constraint(spec, "")))
+		if spec.Hold && spec.Version == "" {
+			toPin = append(toPin, spec)
+		}
+	}
+
+	if len(toAdd) > 0 {
+		err = p.add(ctx, strings.Join(toAdd, " "))
+		if err != nil {
+			return true, fmt.Errorf("apk add: %w", err)
+		}
+	}
+	if len(toPin) > 0 {
+		// the version of newly added packages is only known after installing them
+		versions, err = p.GetPackageVersions(ctx, lo.Map(toPin, func(spec PackageSpec, _ int) string { return spec.Name })...)
+		if err != nil {
+			return true, err
+		}
+		pins := lo.Map(toPin, func(spec PackageSpec, _ int) string {
+			return compute.ShellQuote(constraint(PackageSpec{Name: spec.Name, Hold: true}, versions[spec.Name]))
+		})
+		err = p.apk(ctx, "add "+strings.Join(pins, " "))
+		if err != nil {
+			return true, fmt.Errorf("apk add pin: %w", err)
+		}
+	}
+	return len(toAdd) > 0 || len(toPin) > 0, nil
+}
+
+// EnsurePackagesInstalledP is the pipeline version of EnsurePackagesInstalled
+func (p *Provisioner) EnsurePackagesInstalledP(specs ...PackageSpec) pipeline.FuncT {
+	return func(ctx *pipeline.Context) error {
+		updated, err := p.EnsurePackagesInstalled(ctx, specs)
+		if err != nil {
+			return err
+		}
+		ctx.SetResult(updated)
+		return nil
+	}
+}
+
+// EnsurePackagesAbsent ensures that none of the packages are installed.
+// apk removes dependencies which are no longer needed on its own, so Autoremove is implied.
+// Purge also removes modified configuration files.
+func (p *Provisioner) EnsurePackagesAbsent(ctx context.Context, packageNames []string, opts RemoveOptions) (bool, error) {
+	logger := zapctx.Logger(ctx)
+	if len(packageNames) == 0 {
+		return false, nil
+	}
+	versions, err := p.GetPackageVersions(ctx, packageNames...)
+	if err != nil {
+		return false, err
+	}
+	toRemove := make([]string, 0)
+	for _, packageName := range packageNames {
+		if _, installed := versions[packageName]; !installed {
+			logger.Debug("package already absent", zap.String("package", packageName))
+			continue
+		}
+		toRemove = append(toRemove, compute.ShellQuote(packageName))
+	}
+	if len(toRemove) == 0 {
+		return false, nil
+	}
+
+	args := "del "
+	if opts.Purge {
+		args += "--purge "
+	}
+	err = p.apk(ctx, args+strings.Join(toRemove, " "))
+	if err != nil {
+		return true, fmt.Errorf("apk del: %w", err)
+	}
+	return true, nil
+}
+
+// EnsurePackagesAbsentP is the pipeline version of EnsurePackagesAbsent
+func (p *Provisioner) EnsurePackagesAbsentP(packageNames []string, opts RemoveOptions) pipeline.FuncT {
+	return func(ctx *pipeline.Context) error {
+		updated, err := p.EnsurePackagesAbsent(ctx, packageNames, opts)
+		if err != nil {
+			return err
+		}
+		ctx.SetResult(updated)
+		return nil
+	}
+}
+
+// EnsurePackageInstalled ensures that a single package is installed
+func (p *Provisioner) EnsurePackageInstalled(ctx context.Context, packageName string) (bool, error) {
+	return p.EnsurePackagesInstalled(ctx, []PackageSpec{{Name: packageName}})
+}
+
+// EnsurePackageInstalledP is the pipeline version of EnsurePackageInstalled
+func (p *Provisioner) EnsurePackageInstalledP(packageName string) pipeline.FuncT {
+	return p.EnsurePackagesInstalledP(PackageSpec{Name: packageName})
+}
+
+// EnsurePackageAbsent ensures that a single package is not installed
+func (p *Provisioner) EnsurePackageAbsent(ctx context.Context, packageName string, opts RemoveOptions) (bool, error) {
+	return p.EnsurePackagesAbsent(ctx, []string{packageName}, opts)
+}
+
+// EnsurePackageAbsentP is the pipeline version of EnsurePackageAbsent
+func (p *Provisioner) EnsurePackageAbsentP(packageName string, opts RemoveOptions) pipeline.FuncT {
+	return p.EnsurePackagesAbsentP([]string{packageName}, opts)
+}
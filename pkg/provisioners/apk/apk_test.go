@@ -0,0 +1,55 @@
+package apk
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseAPKListOutput(t *testing.T) {
+	output := `WARNING: opening from cache https://dl-cdn.alpinelinux.org/alpine/v3.19/main: No such file or directory
+jq-1.7.1-r0 x86_64 {jq} (MIT) [installed]
+openssh-server-9.6_p1-r0 x86_64 {openssh} (SSH-OpenSSH AND ISC AND BSD-3-Clause) [installed]
+`
+	require.Equal(t, map[string]string{
+		"jq":             "1.7.1-r0",
+		"openssh-server": "9.6_p1-r0",
+	}, parseAPKListOutput(output))
+	require.Empty(t, parseAPKListOutput(""))
+}
+
+func TestParseWorld(t *testing.T) {
+	require.Equal(t, map[string]string{
+		"alpine-base": "",
+		"jq":          "=1.7.1-r0",
+		"curl":        "~8.5",
+		"htop":        "@edge",
+	}, parseWorld("alpine-base\njq=1.7.1-r0\ncurl~8.5\nhtop@edge\n"))
+}
+
+func TestVersionMatches(t *testing.T) {
+	require.True(t, versionMatches("1.7.1-r0", "1.7.1-r0"))
+	require.True(t, versionMatches("1.7.1-r0", "1.7.1"))
+	require.False(t, versionMatches("1.7.1-r0", "1.7"))
+	require.False(t, versionMatches("1.7.1-r0", "1.7.1-r1"))
+}
+
+func TestConstraint(t *testing.T) {
+	require.Equal(t, "jq", constraint(PackageSpec{Name: "jq"}, "1.7.1-r0"))
+	require.Equal(t, "jq=1.7.1-r0", constraint(PackageSpec{Name: "jq", Version: "1.7.1-r0"}, ""))
+	require.Equal(t, "jq~1.7.1", constraint(PackageSpec{Name: "jq", Version: "1.7.1"}, ""))
+	require.Equal(t, "jq=1.7.1-r0", constraint(PackageSpec{Name: "jq", Hold: true}, "1.7.1-r0"))
+}
+
+func TestUpdateRepositories(t *testing.T) {
+	base := "https://dl-cdn.alpinelinux.org/alpine/v3.19/main\nhttps://dl-cdn.alpinelinux.org/alpine/v3.19/community\n"
+	added := updateRepositories(base, "edge-testing", "@testing https://dl-cdn.alpinelinux.org/alpine/edge/testing")
+	require.Equal(t, base+"# ctr2cloud: edge-testing\n@testing https://dl-cdn.alpinelinux.org/alpine/edge/testing\n", added)
+
+	// replacing an entry keeps a single copy
+	replaced := updateRepositories(added, "edge-testing", "https://dl-cdn.alpinelinux.org/alpine/edge/testing")
+	require.Equal(t, base+"# ctr2cloud: edge-testing\nhttps://dl-cdn.alpinelinux.org/alpine/edge/testing\n", replaced)
+
+	require.Equal(t, base, updateRepositories(replaced, "edge-testing", ""))
+	require.Equal(t, "", updateRepositories("", "edge-testing", ""))
+}
@@ -0,0 +1,155 @@
+package apk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/ctr2cloud/ctr2cloud/pkg/pipeline"
+	"github.com/ctr2cloud/ctr2cloud/pkg/provisioners/file"
+	"github.com/juju/zaputil/zapctx"
+	"go.uber.org/zap"
+)
+
+const (
+	repositoriesPath = "/etc/apk/repositories"
+	keysDir          = "/etc/apk/keys"
+	// repositoryMarkerPrefix precedes every repository line managed by EnsureRepository
+	repositoryMarkerPrefix = "# ctr2cloud: "
+)
+
+type EnsureRepositoryArgs struct {
+	// Name identifies the repository in /etc/apk/repositories
+	Name string
+	// URL of the repository, e.g. https://dl-cdn.alpinelinux.org/alpine/edge/testing
+	URL string
+	// Tag pins the repository, packages are then only installed from it if requested as name@tag
+	Tag string
+	// RSA public key in PEM format used to sign the repository index
+	Key string
+	// KeyName must match the key name used in the index signature, e.g. builder@example.com-5f1a2b3c.rsa.pub.
+	// Defaults to Name.rsa.pub.
+	KeyName string
+	// whether to refresh the package index right away if the repository changed
+	Update bool
+}
+
+func (args EnsureRepositoryArgs) keyPath() string {
+	keyName := args.KeyName
+	if keyName == "" {
+		keyName = args.Name + ".rsa.pub"
+	}
+	return path.Join(keysDir, keyName)
+}
+
+func (args EnsureRepositoryArgs) repositoryLine() string {
+	if args.Tag != "" {
+		return fmt.Sprintf("@%s %s", args.Tag, args.URL)
+	}
+	return args.URL
+}
+
+// updateRepositories returns repositories with the managed entry of name replaced by line.
+// The entry is removed if line is empty.
+func updateRepositories(repositories, name, line string) string {
+	marker := repositoryMarkerPrefix + name
+	lines := strings.Split(strings.TrimSuffix(repositories, "\n"), "\n")
+	res := make([]string, 0, len(lines)+2)
+	for i := 0; i < len(lines); i++ {
+		if lines[i] == marker {
+			// skip the marker and the repository line following it
+			i++
+			continue
+		}
+		if lines[i] != "" || len(res) > 0 {
+			res = append(res, lines[i])
+		}
+	}
+	if line != "" {
+		res = append(res, marker, line)
+	}
+	if len(res) == 0 {
+		return ""
+	}
+	return strings.Join(res, "\n") + "\n"
+}
+
+func (p *Provisioner) ensureRepositoryLine(ctx context.Context, name, line string) (bool, error) {
+	fProvisioner := file.Provisioner{CommandExecutor: p.CommandExecutor}
+	current, err := fProvisioner.GetFileContents(ctx, repositoriesPath)
+	if err != nil && !errors.Is(err, file.ErrFileNotFound) {
+		return false, fmt.Errorf("reading %s: %w", repositoriesPath, err)
+	}
+	updated := updateRepositories(string(current), name, line)
+	zapctx.Logger(ctx).Debug("ensuring repositories", zap.String("path", repositoriesPath), zap.String("repositories", updated))
+	changed, err := fProvisioner.EnsureFileContentsString(ctx, repositoriesPath, updated)
+	if err != nil {
+		return changed, fmt.Errorf("ensuring repositories: %w", err)
+	}
+	return changed, nil
+}
+
+// EnsureRepository ensures that the given repository and its signing key are configured
+func (p *Provisioner) EnsureRepository(ctx context.Context, args EnsureRepositoryArgs) (bool, error) {
+	fProvisioner := file.Provisioner{CommandExecutor: p.CommandExecutor}
+	keyUpdated := false
+	if args.Key != "" {
+		var err error
+		keyUpdated, err = fProvisioner.EnsureFileContentsString(ctx, args.keyPath(), args.Key)
+		if err != nil {
+			return false, fmt.Errorf("ensuring apk key: %w", err)
+		}
+	}
+	repositoryUpdated, err := p.ensureRepositoryLine(ctx, args.Name, args.repositoryLine())
+	if err != nil {
+		return keyUpdated, err
+	}
+	changed := keyUpdated || repositoryUpdated
+	if changed && args.Update {
+		err = p.Update(ctx)
+		if err != nil {
+			return true, fmt.Errorf("apk update after repo add: %w", err)
+		}
+	}
+	return changed, nil
+}
+
+// EnsureRepositoryP is the pipeline version of EnsureRepository
+func (p *Provisioner) EnsureRepositoryP(args EnsureRepositoryArgs) pipeline.FuncT {
+	return func(ctx *pipeline.Context) error {
+		updated, err := p.EnsureRepository(ctx, args)
+		if err != nil {
+			return err
+		}
+		ctx.SetResult(updated)
+		return nil
+	}
+}
+
+// EnsureRepositoryAbsent removes the repository name and its key, KeyName is only needed if it was set when adding it
+func (p *Provisioner) EnsureRepositoryAbsent(ctx context.Context, args EnsureRepositoryArgs) (bool, error) {
+	changed, err := p.ensureRepositoryLine(ctx, args.Name, "")
+	if err != nil {
+		return changed, err
+	}
+	fProvisioner := file.Provisioner{CommandExecutor: p.CommandExecutor}
+	removed, err := fProvisioner.EnsureFileAbsent(ctx, args.keyPath())
+	if err != nil {
+		return changed, fmt.Errorf("removing %s: %w", args.keyPath(), err)
+	}
+	return changed || removed, nil
+}
+
+// EnsureRepositoryAbsentP is the pipeline version of EnsureRepositoryAbsent
+func (p *Provisioner) EnsureRepositoryAbsentP(args EnsureRepositoryArgs) pipeline.FuncT {
+	return func(ctx *pipeline.Context) error {
+		updated, err := p.EnsureRepositoryAbsent(ctx, args)
+		if err != nil {
+			return err
+		}
+		ctx.SetResult(updated)
+		return nil
+	}
+}
@@ -4,50 +4,55 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"path"
 	"strings"
+	"time"
 
 	"github.com/ctr2cloud/ctr2cloud/pkg/generic/compute"
+	"github.com/ctr2cloud/ctr2cloud/pkg/generic/pkgmgr"
 	"github.com/ctr2cloud/ctr2cloud/pkg/pipeline"
-	"github.com/ctr2cloud/ctr2cloud/pkg/provisioners/file"
 	"github.com/juju/zaputil/zapctx"
+	"github.com/samber/lo"
 	"go.uber.org/zap"
 )
 
+var _ pkgmgr.PackageManager = &Provisioner{}
+
 type Provisioner struct {
 	*compute.CommandExecutor
+
+	// LockTimeout is the maximum time to wait for the dpkg lock, defaults to DefaultLockTimeout
+	LockTimeout time.Duration
+	// CacheValidTime is the maximum age of the package index before it is refreshed, defaults to DefaultCacheValidTime
+	CacheValidTime time.Duration
 }
 
+// Update unconditionally refreshes the package index
 func (p *Provisioner) Update(ctx context.Context) error {
-	_, err := p.CommandExecutor.Exec(ctx, "apt update")
-	return err
+	_, err := p.aptGet(ctx, "update")
+	if err != nil {
+		return err
+	}
+	_, err = p.CommandExecutor.Exec(ctx, "touch "+updateStampPath)
+	if err != nil {
+		return fmt.Errorf("touching update stamp: %w", err)
+	}
+	return nil
 }
 
-var ErrNotFound = errors.New("package not found")
+var ErrNotFound = pkgmgr.ErrNotFound
 
+// GetPackageVersion returns the installed version of packageName, ErrNotFound if it is not installed.
+// Packages of which only the configuration files are left are not installed.
 func (p *Provisioner) GetPackageVersion(ctx context.Context, packageName string) (string, error) {
-	logger := zapctx.Logger(ctx)
-	currentState, err := p.CommandExecutor.ExecString(ctx, "dpkg-query -W "+packageName)
-	logger.Debug("dpkg-query", zap.Error(err), zap.String("output", currentState))
+	states, err := p.getPackageStates(ctx, []string{packageName})
 	if err != nil {
-		return "", fmt.Errorf("dpkg query: %w", err)
-	}
-	currentState = strings.Trim(currentState, " \n")
-	stateLines := strings.Split(currentState, "\n")
-	if len(stateLines) != 1 {
-		return "", fmt.Errorf("unexpected dpkg-query output: %s", currentState)
+		return "", err
 	}
-
-	// example line if match:
-	// openssh-server	1:8.2p1-4ubuntu0.11
-	//
-	// example line if no match:
-	// ssh
-	stateLine := strings.Split(stateLines[0], "\t")
-	if len(stateLine) != 2 {
+	state, ok := states[packageName]
+	if !ok || !state.installed() {
 		return "", ErrNotFound
 	}
-	return stateLine[1], nil
+	return state.Version, nil
 }
 
 func (p *Provisioner) EnsurePackageInstalled(ctx context.Context, packageName string, update bool) (bool, error) {
@@ -62,18 +67,31 @@ func (p *Provisioner) EnsurePackageInstalled(ctx context.Context, packageName st
 		logger.Debug("package not installed", zap.String("package", packageName), zap.Error(err))
 	}
 
-	aptUpdateRes, err := p.CommandExecutor.Exec(ctx, "apt update")
-	logger.Debug("apt update", zap.Error(err), zap.ByteString("output", aptUpdateRes))
+	_, err = p.installWithFreshCache(ctx, "install "+compute.ShellQuote(packageName))
 	if err != nil {
-		return false, fmt.Errorf("apt update: %w", err)
+		return false, fmt.Errorf("apt install: %w", err)
 	}
+	return true, nil
+}
 
-	aptInstallRes, err := p.CommandExecutor.Exec(ctx, "apt install -qy "+packageName)
-	logger.Debug("apt install", zap.Error(err), zap.ByteString("output", aptInstallRes))
+// installWithFreshCache runs apt-get with installArgs after making sure the package index is fresh.
+// If a package is not found in a cache that was considered fresh, the index is refreshed once and
+// the installation retried.
+func (p *Provisioner) installWithFreshCache(ctx context.Context, installArgs string) ([]byte, error) {
+	refreshed, err := p.EnsureCacheFresh(ctx)
 	if err != nil {
-		return false, fmt.Errorf("apt install: %w", err)
+		return nil, err
 	}
-	return true, nil
+	output, err := p.aptGet(ctx, installArgs)
+	if err == nil || refreshed || !errors.Is(err, ErrNotFound) {
+		return output, err
+	}
+	zapctx.Logger(ctx).Debug("package not found in cached index, refreshing", zap.Error(err))
+	err = p.Update(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("apt update: %w", err)
+	}
+	return p.aptGet(ctx, installArgs)
 }
 
 // EnsurePackageInstalledP is the pipeline version of EnsurePackageInstalled
@@ -88,57 +106,144 @@ func (p *Provisioner) EnsurePackageInstalledP(packageName string) pipeline.FuncT
 	}
 }
 
-// ensureAptKey ensures that the given ASCII armorred key is installed in the apt keyring
-func (p *Provisioner) ensureAptKey(ctx context.Context, keyName, key string) (bool, error) {
-	fProvisioner := file.Provisioner{CommandExecutor: p.CommandExecutor}
-	keyPath := path.Join("/etc/apt/trusted.gpg.d", keyName+".asc")
-	return fProvisioner.EnsureFileContentsString(ctx, keyPath, key)
+type PackageSpec = pkgmgr.PackageSpec
+
+type packageState struct {
+	Version string
+	Held    bool
+	// State is the current state of the package as abbreviated by dpkg,
+	// e.g. i for installed or c if only configuration files remain
+	State byte
 }
 
-// EnsureRepository ensures that the given repository is added to the apt sources
-func (p *Provisioner) ensureRepository(ctx context.Context, name, specification string) (bool, error) {
-	fProvisioner := file.Provisioner{CommandExecutor: p.CommandExecutor}
-	repoPath := path.Join("/etc/apt/sources.list.d", name+".list")
-	return fProvisioner.EnsureFileContentsString(ctx, repoPath, specification)
+func (s packageState) installed() bool {
+	return s.State == 'i'
 }
 
-type EnsureRepositoryArgs struct {
-	Name string
-	// ASCII armored key
-	Key string
-	// sources.list line(s) for the repository
-	Specification string
-	// whether to update the apt cache after adding the repository
-	Update bool
+// dpkgQueryFormat is the dpkg-query output format parsed by parseDpkgQueryOutput
+const dpkgQueryFormat = `${Package}\t${Version}\t${db:Status-Abbrev}\n`
+
+// parseDpkgQueryOutput parses the output of dpkg-query using dpkgQueryFormat.
+// Packages which are not present on the system at all are omitted.
+func parseDpkgQueryOutput(output string) map[string]packageState {
+	res := make(map[string]packageState)
+	for _, line := range strings.Split(output, "\n") {
+		// example lines:
+		// openssh-server	1:9.2p1-2+deb12u3	ii
+		// ssh		un
+		// exim4-base	4.96-15+deb12u4	rc
+		fields := strings.Split(line, "\t")
+		if len(fields) != 3 {
+			continue
+		}
+		// the first character of the status is the desired action, the second the current state
+		status := fields[2]
+		if len(status) < 2 || status[1] == 'n' {
+			continue
+		}
+		res[fields[0]] = packageState{
+			Version: fields[1],
+			Held:    status[0] == 'h',
+			State:   status[1],
+		}
+	}
+	return res
 }
 
-// EnsureRepository ensures that the given repository is added to the apt sources
-// TODO: detect transport https
-// TODO: support arch/codename interpolation
-func (p *Provisioner) EnsureRepository(ctx context.Context, args EnsureRepositoryArgs) (bool, error) {
+// getPackageStates returns the state of all present packages in packageNames using a single dpkg-query call
+func (p *Provisioner) getPackageStates(ctx context.Context, packageNames []string) (map[string]packageState, error) {
 	logger := zapctx.Logger(ctx)
-	keyUpdated, err := p.ensureAptKey(ctx, args.Name, args.Key)
+	quotedNames := lo.Map(packageNames, func(name string, _ int) string { return compute.ShellQuote(name) })
+	cmd := fmt.Sprintf("dpkg-query -W -f='%s' %s 2>/dev/null", dpkgQueryFormat, strings.Join(quotedNames, " "))
+	output, err := p.CommandExecutor.ExecString(ctx, cmd)
+	logger.Debug("dpkg-query", zap.Error(err), zap.String("output", output))
+	if err != nil {
+		// dpkg-query returns 1 if any of the packages is unknown
+		var cErr compute.CommandExecutorError
+		if !errors.As(err, &cErr) || cErr.Code != 1 {
+			return nil, fmt.Errorf("dpkg query: %w", err)
+		}
+	}
+	return parseDpkgQueryOutput(output), nil
+}
+
+// GetPackageVersions returns the installed versions of packageNames.
+// Packages that are not installed are omitted from the result.
+func (p *Provisioner) GetPackageVersions(ctx context.Context, packageNames ...string) (map[string]string, error) {
+	states, err := p.getPackageStates(ctx, packageNames)
 	if err != nil {
-		return false, fmt.Errorf("ensuring apt key: %w", err)
+		return nil, err
+	}
+	installed := lo.PickBy(states, func(_ string, state packageState) bool { return state.installed() })
+	return lo.MapValues(installed, func(state packageState, _ string) string { return state.Version }), nil
+}
+
+// EnsurePackagesInstalled ensures that all packages are installed at the requested version.
+// Missing or mismatched packages are installed with a single apt-get invocation.
+func (p *Provisioner) EnsurePackagesInstalled(ctx context.Context, specs []PackageSpec) (bool, error) {
+	logger := zapctx.Logger(ctx)
+	if len(specs) == 0 {
+		return false, nil
 	}
-	repositoryUpdated, err := p.ensureRepository(ctx, args.Name, args.Specification)
+	states, err := p.getPackageStates(ctx, lo.Map(specs, func(spec PackageSpec, _ int) string { return spec.Name }))
 	if err != nil {
-		return false, fmt.Errorf("ensuring repository: %w", err)
+		return false, err
+	}
+
+	installArgs := make([]string, 0)
+	toHold := make([]string, 0)
+	changesHeld := false
+	for _, spec := range specs {
+		state := states[spec.Name]
+		switch {
+		case !state.installed():
+			logger.Debug("package not installed", zap.String("package", spec.Name))
+		case spec.Version != "" && state.Version != spec.Version:
+			logger.Debug("package version mismatch", zap.String("package", spec.Name), zap.String("version", state.Version), zap.String("expected", spec.Version))
+			changesHeld = changesHeld || state.Held
+		default:
+			logger.Debug("package already installed", zap.String("package", spec.Name), zap.String("version", state.Version))
+			if spec.Hold && !state.Held {
+				toHold = append(toHold, compute.ShellQuote(spec.Name))
+			}
+			continue
+		}
+		if spec.Version != "" {
+			installArgs = append(installArgs, compute.ShellQuote(spec.Name+"="+spec.Version))
+		} else {
+			installArgs = append(installArgs, compute.ShellQuote(spec.Name))
+		}
+		if spec.Hold {
+			toHold = append(toHold, compute.ShellQuote(spec.Name))
+		}
 	}
-	if args.Update && (keyUpdated || repositoryUpdated) {
-		aptUpdateRes, err := p.CommandExecutor.Exec(ctx, "apt update")
-		logger.Debug("apt update", zap.Error(err), zap.ByteString("output", aptUpdateRes))
+
+	if len(installArgs) > 0 {
+		installArgsPrefix := "install --allow-downgrades "
+		if changesHeld {
+			installArgsPrefix += "--allow-change-held-packages "
+		}
+		_, err = p.installWithFreshCache(ctx, installArgsPrefix+strings.Join(installArgs, " "))
 		if err != nil {
-			return false, fmt.Errorf("apt update after repo add: %w", err)
+			return true, fmt.Errorf("apt-get install: %w", err)
 		}
 	}
-	return keyUpdated || repositoryUpdated, nil
+
+	if len(toHold) > 0 {
+		holdRes, err := p.CommandExecutor.Exec(ctx, "apt-mark hold "+strings.Join(toHold, " "))
+		logger.Debug("apt-mark hold", zap.Error(err), zap.ByteString("output", holdRes))
+		if err != nil {
+			return true, fmt.Errorf("apt-mark hold: %w", err)
+		}
+	}
+
+	return len(installArgs) > 0 || len(toHold) > 0, nil
 }
 
-// EnsureRepositoryP is the pipeline version of EnsureRepository
-func (p *Provisioner) EnsureRepositoryP(args EnsureRepositoryArgs) pipeline.FuncT {
+// EnsurePackagesInstalledP is the pipeline version of EnsurePackagesInstalled
+func (p *Provisioner) EnsurePackagesInstalledP(specs ...PackageSpec) pipeline.FuncT {
 	return func(ctx *pipeline.Context) error {
-		updated, err := p.EnsureRepository(ctx, args)
+		updated, err := p.EnsurePackagesInstalled(ctx, specs)
 		if err != nil {
 			return err
 		}
@@ -146,3 +251,80 @@ func (p *Provisioner) EnsureRepositoryP(args EnsureRepositoryArgs) pipeline.Func
 		return nil
 	}
 }
+
+type RemoveOptions = pkgmgr.RemoveOptions
+
+// EnsurePackagesAbsent ensures that none of the packages are installed.
+// It only reports a change if a package was actually uninstalled or purged.
+func (p *Provisioner) EnsurePackagesAbsent(ctx context.Context, packageNames []string, opts RemoveOptions) (bool, error) {
+	logger := zapctx.Logger(ctx)
+	if len(packageNames) == 0 {
+		return false, nil
+	}
+	states, err := p.getPackageStates(ctx, packageNames)
+	if err != nil {
+		return false, err
+	}
+
+	toRemove := make([]string, 0)
+	changesHeld := false
+	for _, packageName := range packageNames {
+		state, present := states[packageName]
+		if !present || (!opts.Purge && state.State == 'c') {
+			logger.Debug("package already absent", zap.String("package", packageName))
+			continue
+		}
+		toRemove = append(toRemove, compute.ShellQuote(packageName))
+		changesHeld = changesHeld || state.Held
+	}
+	if len(toRemove) == 0 {
+		return false, nil
+	}
+
+	action := "remove"
+	if opts.Purge {
+		action = "purge"
+	}
+	removeArgs := action + " "
+	if changesHeld {
+		removeArgs += "--allow-change-held-packages "
+	}
+	_, err = p.aptGet(ctx, removeArgs+strings.Join(toRemove, " "))
+	if err != nil {
+		return true, fmt.Errorf("apt-get %s: %w", action, err)
+	}
+
+	if opts.Autoremove {
+		autoremoveArgs := "autoremove"
+		if opts.Purge {
+			autoremoveArgs += " --purge"
+		}
+		_, err = p.aptGet(ctx, autoremoveArgs)
+		if err != nil {
+			return true, fmt.Errorf("apt-get autoremove: %w", err)
+		}
+	}
+	return true, nil
+}
+
+// EnsurePackagesAbsentP is the pipeline version of EnsurePackagesAbsent
+func (p *Provisioner) EnsurePackagesAbsentP(packageNames []string, opts RemoveOptions) pipeline.FuncT {
+	return func(ctx *pipeline.Context) error {
+		updated, err := p.EnsurePackagesAbsent(ctx, packageNames, opts)
+		if err != nil {
+			return err
+		}
+		ctx.SetResult(updated)
+		return nil
+	}
+}
+
+// EnsurePackageAbsent ensures that a single package is not installed
+func (p *Provisioner) EnsurePackageAbsent(ctx context.Context, packageName string, opts RemoveOptions) (bool, error) {
+	return p.EnsurePackagesAbsent(ctx, []string{packageName}, opts)
+}
+
+// EnsurePackageAbsentP is the pipeline version of EnsurePackageAbsent
+func (p *Provisioner) EnsurePackageAbsentP(packageName string, opts RemoveOptions) pipeline.FuncT {
+	return p.EnsurePackagesAbsentP([]string{packageName}, opts)
+}
@@ -5,6 +5,7 @@ import (
 	"time"
 
 	"github.com/ctr2cloud/ctr2cloud/internal/test"
+	"github.com/stretchr/testify/require"
 )
 
 const testEnsureFileContentsInstanceName = "test-custom-package"
@@ -62,17 +63,20 @@ FsEME5XNmBGdNEo2flRVFfpG1IWds2Ba3IsdbYd9nzmbBW7/n0InVRDrIg==
 =9QWY
 -----END PGP PUBLIC KEY BLOCK-----`
 
+const nvidiaKeyFingerprint = "C95B 321B 61E8 8C18 09C4  F759 DDCA E044 F796 ECB0"
+
 const nvidiaCustomPackage = "libnvidia-container1"
 
 func TestCustomPackage(t *testing.T) {
 	executor, err := test.GetLXDExecutorFactory(t, testEnsureFileContentsInstanceName)()
 	ctx, r := test.DefaultPreamble(t, 45*time.Second)
 	r.NoError(err)
-	aptProvisioner := Provisioner{executor}
+	aptProvisioner := Provisioner{CommandExecutor: executor}
 
 	args := EnsureRepositoryArgs{
 		Name:          "nvidia-container-runtime",
 		Key:           nvidiaKey,
+		Fingerprints:  []string{nvidiaKeyFingerprint},
 		Specification: "deb https://nvidia.github.io/libnvidia-container/stable/deb/$(ARCH) /\n",
 		Update:        true,
 	}
@@ -85,4 +89,81 @@ func TestCustomPackage(t *testing.T) {
 		return aptProvisioner.EnsurePackageInstalled(ctx, nvidiaCustomPackage, false)
 	})
 
+	test.RequireIdempotence(r, func() (bool, error) {
+		return aptProvisioner.EnsureRepositoryAbsent(ctx, args.Name)
+	})
+
+}
+
+func TestParseDpkgQueryOutput(t *testing.T) {
+	output := "openssh-server\t1:9.2p1-2+deb12u3\tii \n" +
+		"jq\t1.6-2.1\thi \n" +
+		"ssh\t\tun \n" +
+		"exim4-base\t4.96-15+deb12u4\trc \n"
+	states := parseDpkgQueryOutput(output)
+	require.Equal(t, map[string]packageState{
+		"openssh-server": {Version: "1:9.2p1-2+deb12u3", State: 'i'},
+		"jq":             {Version: "1.6-2.1", Held: true, State: 'i'},
+		"exim4-base":     {Version: "4.96-15+deb12u4", State: 'c'},
+	}, states)
+	require.False(t, states["exim4-base"].installed())
+}
+
+const testEnsurePackagesInstalledInstanceName = "test-ensure-packages-installed"
+
+func TestEnsurePackagesInstalled(t *testing.T) {
+	executor, err := test.GetLXDExecutorFactory(t, testEnsurePackagesInstalledInstanceName)()
+	ctx, r := test.DefaultPreamble(t, 2*time.Minute)
+	r.NoError(err)
+	aptProvisioner := Provisioner{CommandExecutor: executor}
+
+	specs := []PackageSpec{{Name: "jq"}, {Name: "curl"}, {Name: "tree"}}
+	test.RequireIdempotence(r, func() (bool, error) {
+		return aptProvisioner.EnsurePackagesInstalled(ctx, specs)
+	})
+
+	versions, err := aptProvisioner.GetPackageVersions(ctx, "jq", "curl", "tree", "nonexistent-package")
+	r.NoError(err)
+	r.Len(versions, 3)
+
+	// pinning the installed version only adds the hold
+	pinned := []PackageSpec{{Name: "jq", Version: versions["jq"], Hold: true}}
+	test.RequireIdempotence(r, func() (bool, error) {
+		return aptProvisioner.EnsurePackagesInstalled(ctx, pinned)
+	})
+}
+
+const testEnsurePackageAbsentInstanceName = "test-ensure-package-absent"
+
+func TestEnsurePackageAbsent(t *testing.T) {
+	executor, err := test.GetLXDExecutorFactory(t, testEnsurePackageAbsentInstanceName)()
+	ctx, r := test.DefaultPreamble(t, 2*time.Minute)
+	r.NoError(err)
+	aptProvisioner := Provisioner{CommandExecutor: executor}
+
+	// nano ships conffiles, so removing it leaves the package in the config-files state
+	_, err = aptProvisioner.EnsurePackagesInstalled(ctx, []PackageSpec{{Name: "nano"}})
+	r.NoError(err)
+
+	test.RequireIdempotence(r, func() (bool, error) {
+		return aptProvisioner.EnsurePackageAbsent(ctx, "nano", RemoveOptions{})
+	})
+
+	// a package in the config-files state is not installed
+	_, err = aptProvisioner.GetPackageVersion(ctx, "nano")
+	r.ErrorIs(err, ErrNotFound)
+	test.RequireIdempotence(r, func() (bool, error) {
+		return aptProvisioner.EnsurePackageInstalled(ctx, "nano", false)
+	})
+	test.RequireIdempotence(r, func() (bool, error) {
+		return aptProvisioner.EnsurePackageAbsent(ctx, "nano", RemoveOptions{})
+	})
+
+	test.RequireIdempotence(r, func() (bool, error) {
+		return aptProvisioner.EnsurePackageAbsent(ctx, "nano", RemoveOptions{Purge: true, Autoremove: true})
+	})
+
+	updated, err := aptProvisioner.EnsurePackagesAbsent(ctx, []string{"nonexistent-package"}, RemoveOptions{Purge: true})
+	r.NoError(err)
+	r.False(updated)
 }
@@ -0,0 +1,91 @@
+package apt
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/juju/zaputil/zapctx"
+	"go.uber.org/zap"
+)
+
+// DefaultCacheValidTime is used if Provisioner.CacheValidTime is not set
+const DefaultCacheValidTime = time.Hour
+
+// updateStampPath is touched after every successful apt-get update.
+// It lives outside of /var/lib/apt/lists because apt-get update removes unknown files from there.
+const updateStampPath = "/var/lib/apt/ctr2cloud-update-stamp"
+
+// listsPath is used to determine the cache age if the stamp file does not exist yet
+const listsPath = "/var/lib/apt/lists"
+
+func (p *Provisioner) cacheValidTime() time.Duration {
+	if p.CacheValidTime > 0 {
+		return p.CacheValidTime
+	}
+	return DefaultCacheValidTime
+}
+
+// parseCacheAge parses the output of cacheAgeCmd, which is the current time followed by the
+// modification time of the cache, both in seconds since the epoch
+func parseCacheAge(output string) (time.Duration, error) {
+	fields := strings.Fields(output)
+	if len(fields) != 2 {
+		return 0, fmt.Errorf("unexpected cache age output: %s", output)
+	}
+	now, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("parsing current time: %w", err)
+	}
+	mtime, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("parsing cache mtime: %w", err)
+	}
+	return time.Duration(now-mtime) * time.Second, nil
+}
+
+var cacheAgeCmd = fmt.Sprintf("echo $(date +%%s) $(stat -c %%Y %s 2>/dev/null || stat -c %%Y %s)", updateStampPath, listsPath)
+
+// GetCacheAge returns the time since the package index was last refreshed
+func (p *Provisioner) GetCacheAge(ctx context.Context) (time.Duration, error) {
+	output, err := p.CommandExecutor.ExecString(ctx, cacheAgeCmd)
+	if err != nil {
+		return 0, fmt.Errorf("getting cache age: %w", err)
+	}
+	return parseCacheAge(output)
+}
+
+// InvalidateCache marks the package index as stale so that the next EnsureCacheFresh refreshes it.
+// This is used after the apt sources changed.
+func (p *Provisioner) InvalidateCache(ctx context.Context) error {
+	_, err := p.CommandExecutor.Exec(ctx, "touch -d @0 "+updateStampPath)
+	if err != nil {
+		return fmt.Errorf("invalidating apt cache: %w", err)
+	}
+	return nil
+}
+
+// EnsureCacheFresh refreshes the package index if it is older than the cache valid time
+// or was invalidated by a repository change. The state is kept on the instance, so it is
+// shared by all apt calls in a pipeline.
+//
+// There is no pipeline version on purpose: refreshing the index does not change the system
+// and must not trigger dependent steps.
+func (p *Provisioner) EnsureCacheFresh(ctx context.Context) (bool, error) {
+	logger := zapctx.Logger(ctx)
+	age, err := p.GetCacheAge(ctx)
+	if err != nil {
+		logger.Debug("unable to determine cache age", zap.Error(err))
+	} else if age < p.cacheValidTime() {
+		logger.Debug("apt cache is fresh", zap.Duration("age", age))
+		return false, nil
+	}
+	logger.Debug("apt cache is stale", zap.Duration("age", age))
+	err = p.Update(ctx)
+	if err != nil {
+		return false, fmt.Errorf("apt update: %w", err)
+	}
+	return true, nil
+}
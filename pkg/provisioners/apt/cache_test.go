@@ -0,0 +1,53 @@
+package apt
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ctr2cloud/ctr2cloud/internal/test"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseCacheAge(t *testing.T) {
+	age, err := parseCacheAge("1700003600 1700000000\n")
+	require.NoError(t, err)
+	require.Equal(t, time.Hour, age)
+
+	// an invalidated cache has an mtime of 0
+	age, err = parseCacheAge("1700000000 0\n")
+	require.NoError(t, err)
+	require.Greater(t, age, DefaultCacheValidTime)
+
+	_, err = parseCacheAge("stat: cannot statx '/var/lib/apt/lists': No such file or directory\n1700000000\n")
+	require.Error(t, err)
+}
+
+const testEnsureCacheFreshInstanceName = "test-ensure-cache-fresh"
+
+func TestEnsureCacheFresh(t *testing.T) {
+	executor, err := test.GetLXDExecutorFactory(t, testEnsureCacheFreshInstanceName)()
+	ctx, r := test.DefaultPreamble(t, 2*time.Minute)
+	r.NoError(err)
+	aptProvisioner := Provisioner{CommandExecutor: executor}
+
+	err = aptProvisioner.InvalidateCache(ctx)
+	r.NoError(err)
+	test.RequireIdempotence(r, func() (bool, error) {
+		return aptProvisioner.EnsureCacheFresh(ctx)
+	})
+
+	// installing several packages one by one only refreshes the index once
+	for _, packageName := range []string{"jq", "tree"} {
+		_, err = aptProvisioner.EnsurePackageInstalled(ctx, packageName, false)
+		r.NoError(err)
+	}
+	refreshed, err := aptProvisioner.EnsureCacheFresh(ctx)
+	r.NoError(err)
+	r.False(refreshed)
+
+	err = aptProvisioner.InvalidateCache(ctx)
+	r.NoError(err)
+	refreshed, err = aptProvisioner.EnsureCacheFresh(ctx)
+	r.NoError(err)
+	r.True(refreshed)
+}
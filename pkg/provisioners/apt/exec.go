@@ -0,0 +1,98 @@
+package apt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/juju/zaputil/zapctx"
+	"go.uber.org/zap"
+)
+
+// DefaultLockTimeout is used if Provisioner.LockTimeout is not set
+const DefaultLockTimeout = 5 * time.Minute
+
+// lockRetryInterval is the delay between attempts if apt-get does not wait for the lock itself
+const lockRetryInterval = 2 * time.Second
+
+var ErrLockTimeout = errors.New("timed out waiting for the dpkg lock")
+var ErrBrokenDependencies = errors.New("broken dependencies")
+
+// aptGetBaseCmd runs apt-get without any interactive prompts.
+// Conffile questions are answered by keeping local modifications and using the package default
+// for files which were not modified.
+const aptGetBaseCmd = "DEBIAN_FRONTEND=noninteractive apt-get -qy -o Dpkg::Options::=--force-confdef -o Dpkg::Options::=--force-confold"
+
+func (p *Provisioner) lockTimeout() time.Duration {
+	if p.LockTimeout > 0 {
+		return p.LockTimeout
+	}
+	return DefaultLockTimeout
+}
+
+// classifyAptError wraps err with ErrLockTimeout, ErrNotFound or ErrBrokenDependencies
+// depending on the output of apt-get
+func classifyAptError(output string, err error) error {
+	var errorLines []string
+	for _, line := range strings.Split(output, "\n") {
+		if strings.HasPrefix(line, "E: ") {
+			errorLines = append(errorLines, strings.TrimPrefix(line, "E: "))
+		}
+	}
+	details := strings.Join(errorLines, "; ")
+
+	var kind error
+	switch {
+	case strings.Contains(output, "Could not get lock"),
+		strings.Contains(output, "Unable to acquire the dpkg frontend lock"),
+		strings.Contains(output, "Unable to lock directory"):
+		kind = ErrLockTimeout
+	case strings.Contains(output, "Unable to locate package"),
+		strings.Contains(output, "has no installation candidate"),
+		strings.Contains(output, "' was not found"):
+		kind = ErrNotFound
+	case strings.Contains(output, "Unmet dependencies"),
+		strings.Contains(output, "held broken packages"):
+		kind = ErrBrokenDependencies
+	}
+
+	switch {
+	case kind != nil && details != "":
+		return fmt.Errorf("%w: %s: %w", kind, details, err)
+	case kind != nil:
+		return fmt.Errorf("%w: %w", kind, err)
+	case details != "":
+		return fmt.Errorf("%s: %w", details, err)
+	}
+	return err
+}
+
+// aptGet runs apt-get non-interactively with the given (already quoted) arguments.
+// If the dpkg lock is held by another process, e.g. unattended-upgrades right after boot,
+// it waits up to the lock timeout before failing with ErrLockTimeout.
+func (p *Provisioner) aptGet(ctx context.Context, args string) ([]byte, error) {
+	logger := zapctx.Logger(ctx)
+	timeout := p.lockTimeout()
+	deadline := time.Now().Add(timeout)
+	// apt >= 1.9.11 waits for the lock itself, older versions fail immediately and are retried below
+	cmd := fmt.Sprintf("%s -o DPkg::Lock::Timeout=%d %s", aptGetBaseCmd, int(timeout.Seconds()), args)
+	for {
+		output, err := p.CommandExecutor.Exec(ctx, cmd)
+		logger.Debug("apt-get", zap.String("cmd", cmd), zap.Error(err), zap.ByteString("output", output))
+		if err == nil {
+			return output, nil
+		}
+		err = classifyAptError(string(output), err)
+		if !errors.Is(err, ErrLockTimeout) || time.Now().Add(lockRetryInterval).After(deadline) {
+			return output, err
+		}
+		logger.Info("dpkg lock is held, retrying", zap.String("cmd", cmd))
+		select {
+		case <-ctx.Done():
+			return output, fmt.Errorf("%w: %w", ErrLockTimeout, ctx.Err())
+		case <-time.After(lockRetryInterval):
+		}
+	}
+}
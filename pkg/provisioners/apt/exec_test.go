@@ -0,0 +1,53 @@
+package apt
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/ctr2cloud/ctr2cloud/pkg/generic/compute"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClassifyAptError(t *testing.T) {
+	execErr := compute.CommandExecutorError{Code: 100}
+	cases := []struct {
+		Name     string
+		Output   string
+		Expected error
+	}{
+		{
+			Name: "lock",
+			Output: "E: Could not get lock /var/lib/dpkg/lock-frontend. It is held by process 1234 (unattended-upgr)\n" +
+				"E: Unable to acquire the dpkg frontend lock (/var/lib/dpkg/lock-frontend), is another process using it?\n",
+			Expected: ErrLockTimeout,
+		},
+		{
+			Name:     "unknown package",
+			Output:   "Reading package lists...\nE: Unable to locate package doesnotexist\n",
+			Expected: ErrNotFound,
+		},
+		{
+			Name:     "unknown version",
+			Output:   "E: Version '0.0.1' for 'jq' was not found\n",
+			Expected: ErrNotFound,
+		},
+		{
+			Name: "broken dependencies",
+			Output: "The following packages have unmet dependencies:\n libfoo : Depends: libbar (>= 2) but 1 is to be installed\n" +
+				"E: Unable to correct problems, you have held broken packages.\n",
+			Expected: ErrBrokenDependencies,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.Name, func(t *testing.T) {
+			err := classifyAptError(tc.Output, execErr)
+			require.ErrorIs(t, err, tc.Expected)
+			require.ErrorIs(t, err, execErr)
+		})
+	}
+
+	err := classifyAptError("E: Something else went wrong\n", execErr)
+	require.ErrorIs(t, err, execErr)
+	require.False(t, errors.Is(err, ErrNotFound) || errors.Is(err, ErrLockTimeout) || errors.Is(err, ErrBrokenDependencies))
+	require.Contains(t, err.Error(), "Something else went wrong")
+}
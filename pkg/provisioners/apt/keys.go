@@ -0,0 +1,174 @@
+package apt
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+var ErrKeyFingerprintMismatch = errors.New("key fingerprint mismatch")
+var ErrKeyFingerprintRequired = errors.New("key fingerprints are required")
+
+const (
+	armorBegin = "-----BEGIN PGP PUBLIC KEY BLOCK-----"
+	armorEnd   = "-----END PGP PUBLIC KEY BLOCK-----"
+
+	packetTagPublicKey = 6
+)
+
+// dearmorKey decodes an ASCII armored OpenPGP public key block
+func dearmorKey(armored string) ([]byte, error) {
+	lines := strings.Split(strings.ReplaceAll(armored, "\r\n", "\n"), "\n")
+	start := slices.IndexFunc(lines, func(line string) bool { return strings.TrimSpace(line) == armorBegin })
+	if start == -1 {
+		return nil, fmt.Errorf("missing %q", armorBegin)
+	}
+	lines = lines[start+1:]
+	// armor headers are terminated by an empty line
+	headerEnd := slices.IndexFunc(lines, func(line string) bool { return strings.TrimSpace(line) == "" })
+	if headerEnd == -1 {
+		return nil, errors.New("missing end of armor headers")
+	}
+
+	var encoded strings.Builder
+	for _, line := range lines[headerEnd+1:] {
+		line = strings.TrimSpace(line)
+		// the checksum line starts with = and is followed by the end marker
+		if line == armorEnd || strings.HasPrefix(line, "=") {
+			return base64.StdEncoding.DecodeString(encoded.String())
+		}
+		encoded.WriteString(line)
+	}
+	return nil, fmt.Errorf("missing %q", armorEnd)
+}
+
+// readPacket reads a single OpenPGP packet and returns its tag, body and the remaining data
+func readPacket(data []byte) (byte, []byte, []byte, error) {
+	if len(data) < 2 || data[0]&0x80 == 0 {
+		return 0, nil, nil, errors.New("invalid packet header")
+	}
+	var tag byte
+	var length, headerLen int
+	if data[0]&0x40 != 0 {
+		// new format
+		tag = data[0] & 0x3f
+		switch first := int(data[1]); {
+		case first < 192:
+			length, headerLen = first, 2
+		case first < 224:
+			if len(data) < 3 {
+				return 0, nil, nil, errors.New("truncated packet length")
+			}
+			length, headerLen = (first-192)<<8+int(data[2])+192, 3
+		case first == 255:
+			if len(data) < 6 {
+				return 0, nil, nil, errors.New("truncated packet length")
+			}
+			length, headerLen = int(binary.BigEndian.Uint32(data[2:6])), 6
+		default:
+			return 0, nil, nil, errors.New("partial body lengths are not supported for keys")
+		}
+	} else {
+		// old format
+		tag = (data[0] >> 2) & 0x0f
+		switch data[0] & 0x03 {
+		case 0:
+			length, headerLen = int(data[1]), 2
+		case 1:
+			if len(data) < 3 {
+				return 0, nil, nil, errors.New("truncated packet length")
+			}
+			length, headerLen = int(binary.BigEndian.Uint16(data[1:3])), 3
+		case 2:
+			if len(data) < 5 {
+				return 0, nil, nil, errors.New("truncated packet length")
+			}
+			length, headerLen = int(binary.BigEndian.Uint32(data[1:5])), 5
+		default:
+			length, headerLen = len(data)-1, 1
+		}
+	}
+	if length < 0 || len(data) < headerLen+length {
+		return 0, nil, nil, errors.New("truncated packet")
+	}
+	return tag, data[headerLen : headerLen+length], data[headerLen+length:], nil
+}
+
+// publicKeyFingerprint calculates the fingerprint of a public key packet body
+func publicKeyFingerprint(body []byte) (string, error) {
+	if len(body) == 0 {
+		return "", errors.New("empty public key packet")
+	}
+	switch version := body[0]; version {
+	case 4:
+		h := sha1.New()
+		h.Write([]byte{0x99, byte(len(body) >> 8), byte(len(body))})
+		h.Write(body)
+		return strings.ToUpper(hex.EncodeToString(h.Sum(nil))), nil
+	case 6:
+		h := sha256.New()
+		lengthBytes := binary.BigEndian.AppendUint32(nil, uint32(len(body)))
+		h.Write(append([]byte{0x9b}, lengthBytes...))
+		h.Write(body)
+		return strings.ToUpper(hex.EncodeToString(h.Sum(nil))), nil
+	default:
+		return "", fmt.Errorf("unsupported public key version %d", version)
+	}
+}
+
+// GetKeyFingerprints returns the fingerprints of all primary keys in an ASCII armored key block
+func GetKeyFingerprints(armored string) ([]string, error) {
+	data, err := dearmorKey(armored)
+	if err != nil {
+		return nil, fmt.Errorf("dearmoring key: %w", err)
+	}
+	fingerprints := make([]string, 0)
+	for len(data) > 0 {
+		var tag byte
+		var body []byte
+		tag, body, data, err = readPacket(data)
+		if err != nil {
+			return nil, fmt.Errorf("reading key packet: %w", err)
+		}
+		if tag != packetTagPublicKey {
+			continue
+		}
+		fingerprint, err := publicKeyFingerprint(body)
+		if err != nil {
+			return nil, err
+		}
+		fingerprints = append(fingerprints, fingerprint)
+	}
+	if len(fingerprints) == 0 {
+		return nil, errors.New("no public key found")
+	}
+	return fingerprints, nil
+}
+
+func normalizeFingerprint(fingerprint string) string {
+	return strings.ToUpper(strings.ReplaceAll(fingerprint, " ", ""))
+}
+
+// verifyKeyFingerprints ensures that every primary key in the armored key block has one of the allowed fingerprints
+func verifyKeyFingerprints(armored string, allowed []string) error {
+	fingerprints, err := GetKeyFingerprints(armored)
+	if err != nil {
+		return err
+	}
+	allowedNormalized := make([]string, 0, len(allowed))
+	for _, fingerprint := range allowed {
+		allowedNormalized = append(allowedNormalized, normalizeFingerprint(fingerprint))
+	}
+	for _, fingerprint := range fingerprints {
+		if !slices.Contains(allowedNormalized, fingerprint) {
+			return fmt.Errorf("%w: unexpected key %s", ErrKeyFingerprintMismatch, fingerprint)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,29 @@
+package apt
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetKeyFingerprints(t *testing.T) {
+	r := require.New(t)
+	fingerprints, err := GetKeyFingerprints(nvidiaKey)
+	r.NoError(err)
+	r.Equal([]string{normalizeFingerprint(nvidiaKeyFingerprint)}, fingerprints)
+
+	r.NoError(verifyKeyFingerprints(nvidiaKey, []string{nvidiaKeyFingerprint}))
+	r.ErrorIs(verifyKeyFingerprints(nvidiaKey, []string{"0000000000000000000000000000000000000000"}), ErrKeyFingerprintMismatch)
+
+	_, err = GetKeyFingerprints(strings.ReplaceAll(nvidiaKey, "PUBLIC KEY", "PRIVATE KEY"))
+	r.Error(err)
+}
+
+func TestEnsureRepositoryRequiresFingerprints(t *testing.T) {
+	// the key is rejected before any command runs on the instance
+	provisioner := Provisioner{}
+	_, err := provisioner.EnsureRepository(context.Background(), EnsureRepositoryArgs{Name: "example", Key: nvidiaKey})
+	require.ErrorIs(t, err, ErrKeyFingerprintRequired)
+}
@@ -0,0 +1,374 @@
+package apt
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/ctr2cloud/ctr2cloud/pkg/pipeline"
+	"github.com/ctr2cloud/ctr2cloud/pkg/provisioners/file"
+	"github.com/ctr2cloud/ctr2cloud/pkg/provisioners/systemd"
+	"github.com/juju/zaputil/zapctx"
+	"go.uber.org/zap"
+)
+
+const (
+	sourcesDir = "/etc/apt/sources.list.d"
+	keyringDir = "/etc/apt/keyrings"
+	// legacyKeyDir was used before keys were scoped to their repository with Signed-By
+	legacyKeyDir = "/etc/apt/trusted.gpg.d"
+)
+
+// Repository is a single deb822 source stanza
+type Repository struct {
+	// Types defaults to deb
+	Types         []string
+	URIs          []string
+	Suites        []string
+	Components    []string
+	Architectures []string
+	// SignedBy is the path of an existing keyring, it is replaced by the keyring of EnsureRepositoryArgs.Key if set
+	SignedBy string
+}
+
+type EnsureRepositoryArgs struct {
+	Name string
+	// ASCII armored key
+	Key string
+	// Fingerprints of the keys in Key, Key must only contain keys with these fingerprints.
+	// They are required if Key is set and verified before anything is written to the instance.
+	Fingerprints []string
+	// InsecureSkipFingerprints trusts Key without verifying its fingerprints
+	InsecureSkipFingerprints bool
+	// sources.list line(s) for the repository, converted to deb822 stanzas.
+	// Takes precedence over Repositories.
+	Specification string
+	// Repositories are the deb822 stanzas for the repository
+	Repositories []Repository
+	// whether to refresh the apt cache right away if the repository changed,
+	// otherwise the next install refreshes it
+	Update bool
+}
+
+func keyringPath(name string) string {
+	return path.Join(keyringDir, name+".asc")
+}
+
+// parseSourcesListLine parses a one-line style sources.list entry, e.g.
+// deb [arch=amd64 signed-by=/usr/share/keyrings/foo.gpg] https://example.com/debian bookworm main
+func parseSourcesListLine(line string) (Repository, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 3 {
+		return Repository{}, fmt.Errorf("invalid sources.list line: %s", line)
+	}
+	repo := Repository{Types: []string{fields[0]}}
+	fields = fields[1:]
+	if strings.HasPrefix(fields[0], "[") {
+		end := 0
+		for !strings.HasSuffix(fields[end], "]") {
+			end++
+			if end == len(fields) {
+				return Repository{}, fmt.Errorf("unterminated options in sources.list line: %s", line)
+			}
+		}
+		options := strings.Fields(strings.Trim(strings.Join(fields[:end+1], " "), "[]"))
+		// other options are dropped
+		for _, option := range options {
+			key, value, _ := strings.Cut(option, "=")
+			switch key {
+			case "arch":
+				repo.Architectures = strings.Split(value, ",")
+			case "signed-by":
+				repo.SignedBy = value
+			}
+		}
+		fields = fields[end+1:]
+	}
+	if len(fields) < 2 {
+		return Repository{}, fmt.Errorf("missing uri or suite in sources.list line: %s", line)
+	}
+	repo.URIs = []string{fields[0]}
+	repo.Suites = []string{fields[1]}
+	repo.Components = fields[2:]
+	return repo, nil
+}
+
+// parseSourcesList parses all non-comment lines of a one-line style sources.list
+func parseSourcesList(specification string) ([]Repository, error) {
+	repos := make([]Repository, 0)
+	for _, line := range strings.Split(specification, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		repo, err := parseSourcesListLine(line)
+		if err != nil {
+			return nil, err
+		}
+		repos = append(repos, repo)
+	}
+	return repos, nil
+}
+
+// renderSources renders repos as a deb822 .sources file using signedBy as keyring.
+// Repositories keep their own keyring if signedBy is empty.
+func renderSources(repos []Repository, signedBy string) string {
+	var sb strings.Builder
+	writeField := func(name string, values []string) {
+		if len(values) > 0 {
+			sb.WriteString(fmt.Sprintf("%s: %s\n", name, strings.Join(values, " ")))
+		}
+	}
+	for i, repo := range repos {
+		if i > 0 {
+			sb.WriteString("\n")
+		}
+		types := repo.Types
+		if len(types) == 0 {
+			types = []string{"deb"}
+		}
+		writeField("Types", types)
+		writeField("URIs", repo.URIs)
+		writeField("Suites", repo.Suites)
+		writeField("Components", repo.Components)
+		writeField("Architectures", repo.Architectures)
+		if signedBy != "" {
+			writeField("Signed-By", []string{signedBy})
+		} else if repo.SignedBy != "" {
+			writeField("Signed-By", []string{repo.SignedBy})
+		}
+	}
+	return sb.String()
+}
+
+// interpolate replaces $(ARCH) and $(CODENAME) in s, the values are only looked up if needed
+func (p *Provisioner) interpolate(ctx context.Context, s string, cache map[string]string) (string, error) {
+	lookups := map[string]func(context.Context) (string, error){
+		"$(ARCH)":     p.getArchitecture,
+		"$(CODENAME)": p.getCodename,
+	}
+	for placeholder, lookup := range lookups {
+		if !strings.Contains(s, placeholder) {
+			continue
+		}
+		value, ok := cache[placeholder]
+		if !ok {
+			var err error
+			value, err = lookup(ctx)
+			if err != nil {
+				return "", err
+			}
+			cache[placeholder] = value
+		}
+		s = strings.ReplaceAll(s, placeholder, value)
+	}
+	return s, nil
+}
+
+func (p *Provisioner) getArchitecture(ctx context.Context) (string, error) {
+	arch, err := p.CommandExecutor.ExecString(ctx, "dpkg --print-architecture")
+	if err != nil {
+		return "", fmt.Errorf("dpkg --print-architecture: %w", err)
+	}
+	return strings.TrimSpace(arch), nil
+}
+
+func (p *Provisioner) getCodename(ctx context.Context) (string, error) {
+	sProvisioner := systemd.Provisioner{CommandExecutor: p.CommandExecutor}
+	osRelease, err := sProvisioner.GetOSRelease(ctx)
+	if err != nil {
+		return "", err
+	}
+	codename := osRelease["VERSION_CODENAME"]
+	if codename == "" {
+		return "", fmt.Errorf("VERSION_CODENAME missing from os-release")
+	}
+	return codename, nil
+}
+
+// resolveRepositories returns the interpolated deb822 stanzas for args
+func (p *Provisioner) resolveRepositories(ctx context.Context, args EnsureRepositoryArgs) ([]Repository, error) {
+	repos := args.Repositories
+	if args.Specification != "" {
+		var err error
+		repos, err = parseSourcesList(args.Specification)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(repos) == 0 {
+		return nil, fmt.Errorf("repository %s has no sources", args.Name)
+	}
+
+	cache := make(map[string]string)
+	interpolateAll := func(values []string) ([]string, error) {
+		res := make([]string, 0, len(values))
+		for _, value := range values {
+			interpolated, err := p.interpolate(ctx, value, cache)
+			if err != nil {
+				return nil, fmt.Errorf("interpolating %s: %w", value, err)
+			}
+			res = append(res, interpolated)
+		}
+		return res, nil
+	}
+	resolved := make([]Repository, 0, len(repos))
+	for _, repo := range repos {
+		var err error
+		for _, field := range []*[]string{&repo.URIs, &repo.Suites, &repo.Components, &repo.Architectures} {
+			*field, err = interpolateAll(*field)
+			if err != nil {
+				return nil, err
+			}
+		}
+		resolved = append(resolved, repo)
+	}
+	return resolved, nil
+}
+
+func usesHTTPS(repos []Repository) bool {
+	for _, repo := range repos {
+		for _, uri := range repo.URIs {
+			if strings.HasPrefix(uri, "https://") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// removeLegacyRepositoryFiles removes the one-line .list file and the globally trusted key
+// written by earlier versions of EnsureRepository
+func (p *Provisioner) removeLegacyRepositoryFiles(ctx context.Context, name string) (bool, error) {
+	fProvisioner := file.Provisioner{CommandExecutor: p.CommandExecutor}
+	changed := false
+	for _, legacyPath := range []string{path.Join(sourcesDir, name+".list"), path.Join(legacyKeyDir, name+".asc")} {
+		removed, err := fProvisioner.EnsureFileAbsent(ctx, legacyPath)
+		if err != nil {
+			return changed, fmt.Errorf("removing %s: %w", legacyPath, err)
+		}
+		changed = changed || removed
+	}
+	return changed, nil
+}
+
+// EnsureRepository ensures that the given repository is added to the apt sources as a deb822 .sources file.
+// The key is only trusted for this repository by referencing it with Signed-By.
+func (p *Provisioner) EnsureRepository(ctx context.Context, args EnsureRepositoryArgs) (bool, error) {
+	logger := zapctx.Logger(ctx)
+	switch {
+	case args.Key == "":
+	case len(args.Fingerprints) > 0:
+		err := verifyKeyFingerprints(args.Key, args.Fingerprints)
+		if err != nil {
+			return false, fmt.Errorf("verifying key of %s: %w", args.Name, err)
+		}
+	case args.InsecureSkipFingerprints:
+		logger.Info("trusting repository key without fingerprint verification", zap.String("name", args.Name))
+	default:
+		return false, fmt.Errorf("%w: repository %s", ErrKeyFingerprintRequired, args.Name)
+	}
+	repos, err := p.resolveRepositories(ctx, args)
+	if err != nil {
+		return false, err
+	}
+
+	// apt >= 1.5 supports https natively but needs the CA certificates to verify the repository
+	if usesHTTPS(repos) {
+		_, err = p.EnsurePackagesInstalled(ctx, []PackageSpec{{Name: "ca-certificates"}})
+		if err != nil {
+			return false, fmt.Errorf("ensuring ca-certificates for https repository: %w", err)
+		}
+	}
+
+	fProvisioner := file.Provisioner{CommandExecutor: p.CommandExecutor}
+	signedBy := ""
+	keyUpdated := false
+	if args.Key != "" {
+		_, err = p.CommandExecutor.Exec(ctx, "mkdir -p "+keyringDir)
+		if err != nil {
+			return false, fmt.Errorf("creating keyring directory: %w", err)
+		}
+		signedBy = keyringPath(args.Name)
+		keyUpdated, err = fProvisioner.EnsureFileContentsString(ctx, signedBy, args.Key)
+		if err != nil {
+			return false, fmt.Errorf("ensuring apt key: %w", err)
+		}
+	}
+
+	sourcesPath := path.Join(sourcesDir, args.Name+".sources")
+	sources := renderSources(repos, signedBy)
+	logger.Debug("ensuring repository", zap.String("path", sourcesPath), zap.String("sources", sources))
+	repositoryUpdated, err := fProvisioner.EnsureFileContentsString(ctx, sourcesPath, sources)
+	if err != nil {
+		return keyUpdated, fmt.Errorf("ensuring repository: %w", err)
+	}
+
+	legacyRemoved, err := p.removeLegacyRepositoryFiles(ctx, args.Name)
+	if err != nil {
+		return keyUpdated || repositoryUpdated, err
+	}
+
+	changed := keyUpdated || repositoryUpdated || legacyRemoved
+	if changed {
+		err = p.InvalidateCache(ctx)
+		if err != nil {
+			return true, err
+		}
+	}
+	if args.Update {
+		_, err = p.EnsureCacheFresh(ctx)
+		if err != nil {
+			return changed, fmt.Errorf("apt update after repo add: %w", err)
+		}
+	}
+	return changed, nil
+}
+
+// EnsureRepositoryP is the pipeline version of EnsureRepository
+func (p *Provisioner) EnsureRepositoryP(args EnsureRepositoryArgs) pipeline.FuncT {
+	return func(ctx *pipeline.Context) error {
+		updated, err := p.EnsureRepository(ctx, args)
+		if err != nil {
+			return err
+		}
+		ctx.SetResult(updated)
+		return nil
+	}
+}
+
+// EnsureRepositoryAbsent removes the sources and keyring of the repository name
+func (p *Provisioner) EnsureRepositoryAbsent(ctx context.Context, name string) (bool, error) {
+	fProvisioner := file.Provisioner{CommandExecutor: p.CommandExecutor}
+	changed, err := p.removeLegacyRepositoryFiles(ctx, name)
+	if err != nil {
+		return changed, err
+	}
+	for _, repoPath := range []string{path.Join(sourcesDir, name+".sources"), keyringPath(name)} {
+		removed, err := fProvisioner.EnsureFileAbsent(ctx, repoPath)
+		if err != nil {
+			return changed, fmt.Errorf("removing %s: %w", repoPath, err)
+		}
+		changed = changed || removed
+	}
+	if changed {
+		err = p.InvalidateCache(ctx)
+		if err != nil {
+			return true, err
+		}
+	}
+	return changed, nil
+}
+
+// EnsureRepositoryAbsentP is the pipeline version of EnsureRepositoryAbsent
+func (p *Provisioner) EnsureRepositoryAbsentP(name string) pipeline.FuncT {
+	return func(ctx *pipeline.Context) error {
+		updated, err := p.EnsureRepositoryAbsent(ctx, name)
+		if err != nil {
+			return err
+		}
+		ctx.SetResult(updated)
+		return nil
+	}
+}
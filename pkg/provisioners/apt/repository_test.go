@@ -0,0 +1,71 @@
+package apt
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSourcesList(t *testing.T) {
+	specification := `# docker
+deb [arch=amd64,arm64 signed-by=/usr/share/keyrings/docker.gpg] https://download.docker.com/linux/debian $(CODENAME) stable
+deb https://nvidia.github.io/libnvidia-container/stable/deb/$(ARCH) /
+`
+	repos, err := parseSourcesList(specification)
+	require.NoError(t, err)
+	require.Equal(t, []Repository{
+		{
+			Types:         []string{"deb"},
+			URIs:          []string{"https://download.docker.com/linux/debian"},
+			Suites:        []string{"$(CODENAME)"},
+			Components:    []string{"stable"},
+			Architectures: []string{"amd64", "arm64"},
+			SignedBy:      "/usr/share/keyrings/docker.gpg",
+		},
+		{
+			Types:      []string{"deb"},
+			URIs:       []string{"https://nvidia.github.io/libnvidia-container/stable/deb/$(ARCH)"},
+			Suites:     []string{"/"},
+			Components: []string{},
+		},
+	}, repos)
+
+	_, err = parseSourcesList("deb [arch=amd64 https://example.com bookworm main")
+	require.Error(t, err)
+}
+
+func TestRenderSources(t *testing.T) {
+	repos := []Repository{
+		{
+			URIs:       []string{"https://download.docker.com/linux/debian"},
+			Suites:     []string{"bookworm"},
+			Components: []string{"stable"},
+		},
+		{
+			Types:  []string{"deb", "deb-src"},
+			URIs:   []string{"https://example.com/flat"},
+			Suites: []string{"/"},
+		},
+	}
+	expected := `Types: deb
+URIs: https://download.docker.com/linux/debian
+Suites: bookworm
+Components: stable
+Signed-By: /etc/apt/keyrings/docker.asc
+
+Types: deb deb-src
+URIs: https://example.com/flat
+Suites: /
+Signed-By: /etc/apt/keyrings/docker.asc
+`
+	require.Equal(t, expected, renderSources(repos, keyringPath("docker")))
+
+	// without a managed key the keyring of the specification is kept
+	repos[0].SignedBy = "/usr/share/keyrings/docker.gpg"
+	require.Equal(t, `Types: deb
+URIs: https://download.docker.com/linux/debian
+Suites: bookworm
+Components: stable
+Signed-By: /usr/share/keyrings/docker.gpg
+`, renderSources(repos[:1], ""))
+}
@@ -0,0 +1,300 @@
+package compose
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+
+	"github.com/ctr2cloud/ctr2cloud/pkg/generic/compute"
+	"github.com/ctr2cloud/ctr2cloud/pkg/pipeline"
+	"github.com/ctr2cloud/ctr2cloud/pkg/provisioners/docker"
+	"github.com/juju/zaputil/zapctx"
+	"github.com/samber/lo"
+	"go.uber.org/zap"
+)
+
+var ErrInvalidProject = errors.New("invalid project")
+
+const (
+	// LabelProject is set on all containers, networks and volumes of a project
+	LabelProject = "ctr2cloud.project"
+	// LabelService is set on the containers of a project
+	LabelService = "ctr2cloud.service"
+)
+
+// defaultNetwork is used by services which do not list networks
+const defaultNetwork = "default"
+
+// labels returns labels extended by the project labels, service is only set for containers
+func (p Project) labels(labels map[string]string, service string) map[string]string {
+	res := maps.Clone(labels)
+	if res == nil {
+		res = make(map[string]string)
+	}
+	res[LabelProject] = p.Name
+	if service != "" {
+		res[LabelService] = service
+	}
+	return res
+}
+
+func (p Project) containerName(service string) string {
+	if name := p.Services[service].ContainerName; name != "" {
+		return name
+	}
+	return fmt.Sprintf("%s-%s-1", p.Name, service)
+}
+
+func (p Project) networkName(network string) string {
+	declared := p.networks()[network]
+	switch {
+	case declared.Name != "":
+		return declared.Name
+	case declared.External:
+		return network
+	default:
+		return fmt.Sprintf("%s_%s", p.Name, network)
+	}
+}
+
+func (p Project) volumeName(volume string) string {
+	declared := p.Volumes[volume]
+	switch {
+	case declared.Name != "":
+		return declared.Name
+	case declared.External:
+		return volume
+	default:
+		return fmt.Sprintf("%s_%s", p.Name, volume)
+	}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := lo.Keys(m)
+	slices.Sort(keys)
+	return keys
+}
+
+// serviceNetworks returns the sorted network keys of service
+func (p Project) serviceNetworks(service string) []string {
+	networks := sortedKeys(p.Services[service].Networks)
+	if len(networks) == 0 {
+		return []string{defaultNetwork}
+	}
+	return networks
+}
+
+// networks returns the declared networks and the default network if it is used
+func (p Project) networks() map[string]Network {
+	networks := maps.Clone(p.Networks)
+	if networks == nil {
+		networks = make(map[string]Network)
+	}
+	for service := range p.Services {
+		if len(p.Services[service].Networks) == 0 {
+			if _, ok := networks[defaultNetwork]; !ok {
+				networks[defaultNetwork] = Network{}
+			}
+		}
+	}
+	return networks
+}
+
+// ServiceOrder returns the services sorted so that every service follows its dependencies
+func (p Project) ServiceOrder() ([]string, error) {
+	order := make([]string, 0, len(p.Services))
+	done := make(map[string]bool)
+	visiting := make(map[string]bool)
+
+	var visit func(name string) error
+	visit = func(name string) error {
+		if done[name] {
+			return nil
+		}
+		if visiting[name] {
+			return fmt.Errorf("%w: dependency cycle at service %s", ErrInvalidProject, name)
+		}
+		visiting[name] = true
+		for _, dependency := range p.Services[name].DependsOn {
+			if _, ok := p.Services[dependency]; !ok {
+				return fmt.Errorf("%w: service %s depends on unknown service %s", ErrInvalidProject, name, dependency)
+			}
+			err := visit(dependency)
+			if err != nil {
+				return err
+			}
+		}
+		visiting[name] = false
+		done[name] = true
+		order = append(order, name)
+		return nil
+	}
+
+	for _, name := range sortedKeys(p.Services) {
+		err := visit(name)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return order, nil
+}
+
+// Validate checks that the project can be deployed
+func (p Project) Validate() error {
+	if !isValidName(p.Name) {
+		return fmt.Errorf("%w: project name %q must consist of lower case letters, digits, dashes and underscores", ErrInvalidProject, p.Name)
+	}
+	if len(p.Services) == 0 {
+		return fmt.Errorf("%w: no services", ErrInvalidProject)
+	}
+	for name, service := range p.Services {
+		if service.Image == "" {
+			return fmt.Errorf("%w: service %s has no image", ErrInvalidProject, name)
+		}
+		for network := range service.Networks {
+			if _, ok := p.Networks[network]; !ok && network != defaultNetwork {
+				return fmt.Errorf("%w: service %s uses undeclared network %s", ErrInvalidProject, name, network)
+			}
+		}
+		_, err := p.containerSpec(name)
+		if err != nil {
+			return fmt.Errorf("%w: service %s: %w", ErrInvalidProject, name, err)
+		}
+	}
+	_, err := p.ServiceOrder()
+	return err
+}
+
+// Provisioner deploys projects of containers with the docker provisioner
+type Provisioner struct {
+	*compute.CommandExecutor
+}
+
+// EnsureProject ensures that the networks, volumes and containers of project exist and match their spec.
+// Containers are created in dependency order. Containers labelled with the project which are no longer
+// declared are removed, volumes are never removed to preserve their data.
+func (p *Provisioner) EnsureProject(ctx context.Context, project Project) (bool, error) {
+	logger := zapctx.Logger(ctx).With(zap.String("project", project.Name))
+	err := project.Validate()
+	if err != nil {
+		return false, err
+	}
+	order, err := project.ServiceOrder()
+	if err != nil {
+		return false, err
+	}
+	dProvisioner := docker.Provisioner{CommandExecutor: p.CommandExecutor}
+	changed := false
+
+	// stale containers are removed first to free their ports and names
+	existing, err := dProvisioner.ListContainers(ctx, map[string]string{LabelProject: project.Name})
+	if err != nil {
+		return false, err
+	}
+	declared := lo.Map(order, func(service string, _ int) string { return project.containerName(service) })
+	for _, name := range existing {
+		if slices.Contains(declared, name) {
+			continue
+		}
+		logger.Debug("removing undeclared container", zap.String("name", name))
+		removed, err := dProvisioner.EnsureContainerAbsent(ctx, name)
+		changed = changed || removed
+		if err != nil {
+			return changed, err
+		}
+	}
+
+	networks := project.networks()
+	for _, name := range sortedKeys(networks) {
+		if networks[name].External {
+			continue
+		}
+		updated, err := dProvisioner.EnsureNetwork(ctx, project.networkSpec(name))
+		changed = changed || updated
+		if err != nil {
+			return changed, fmt.Errorf("network %s: %w", name, err)
+		}
+	}
+
+	for _, name := range sortedKeys(project.Volumes) {
+		if project.Volumes[name].External {
+			continue
+		}
+		updated, err := dProvisioner.EnsureVolume(ctx, project.volumeSpec(name))
+		changed = changed || updated
+		if err != nil {
+			return changed, fmt.Errorf("volume %s: %w", name, err)
+		}
+	}
+
+	for _, name := range order {
+		spec, err := project.containerSpec(name)
+		if err != nil {
+			return changed, err
+		}
+		updated, err := dProvisioner.EnsureContainer(ctx, spec)
+		changed = changed || updated
+		if err != nil {
+			return changed, fmt.Errorf("service %s: %w", name, err)
+		}
+	}
+	return changed, nil
+}
+
+// EnsureProjectP is the pipeline version of EnsureProject
+func (p *Provisioner) EnsureProjectP(project Project) pipeline.FuncT {
+	return func(ctx *pipeline.Context) error {
+		changed, err := p.EnsureProject(ctx, project)
+		if err != nil {
+			return err
+		}
+		ctx.SetResult(changed)
+		return nil
+	}
+}
+
+// EnsureProjectAbsent removes all containers and networks labelled with the project name, volumes are kept
+func (p *Provisioner) EnsureProjectAbsent(ctx context.Context, name string) (bool, error) {
+	dProvisioner := docker.Provisioner{CommandExecutor: p.CommandExecutor}
+	labels := map[string]string{LabelProject: name}
+	changed := false
+
+	containers, err := dProvisioner.ListContainers(ctx, labels)
+	if err != nil {
+		return false, err
+	}
+	for _, container := range containers {
+		removed, err := dProvisioner.EnsureContainerAbsent(ctx, container)
+		changed = changed || removed
+		if err != nil {
+			return changed, err
+		}
+	}
+
+	networks, err := dProvisioner.ListNetworks(ctx, labels)
+	if err != nil {
+		return changed, err
+	}
+	for _, network := range networks {
+		removed, err := dProvisioner.EnsureNetworkAbsent(ctx, network)
+		changed = changed || removed
+		if err != nil {
+			return changed, err
+		}
+	}
+	return changed, nil
+}
+
+// EnsureProjectAbsentP is the pipeline version of EnsureProjectAbsent
+func (p *Provisioner) EnsureProjectAbsentP(name string) pipeline.FuncT {
+	return func(ctx *pipeline.Context) error {
+		changed, err := p.EnsureProjectAbsent(ctx, name)
+		if err != nil {
+			return err
+		}
+		ctx.SetResult(changed)
+		return nil
+	}
+}
@@ -0,0 +1,165 @@
+package compose
+
+import (
+	_ "embed"
+	"testing"
+	"time"
+
+	"github.com/ctr2cloud/ctr2cloud/internal/test"
+	"github.com/ctr2cloud/ctr2cloud/pkg/provisioners/docker"
+	"github.com/stretchr/testify/require"
+)
+
+//go:embed testdata/shop.yaml
+var shopYAML []byte
+
+func TestParseProject(t *testing.T) {
+	project, err := ParseProject("ignored", shopYAML)
+	require.NoError(t, err)
+	require.Equal(t, "shop", project.Name)
+	require.Len(t, project.Services, 4)
+
+	order, err := project.ServiceOrder()
+	require.NoError(t, err)
+	require.Equal(t, []string{"db", "api", "web", "worker"}, order)
+
+	api, err := project.containerSpec("api")
+	require.NoError(t, err)
+	require.Equal(t, "shop-api-1", api.Name)
+	require.Equal(t, docker.PullAlways, api.PullPolicy)
+	require.Equal(t, []string{"serve", "--listen", ":8000"}, api.Args)
+	require.Equal(t, map[string]string{"DB_HOST": "db", "DB_PORT": "5432", "DEBUG": "false"}, api.Env)
+	require.Equal(t, []string{"/srv/shop/api.env"}, api.EnvFiles)
+	require.Equal(t, map[string]string{"traefik.enable": "true", LabelProject: "shop", LabelService: "api"}, api.Labels)
+	require.Equal(t, []docker.NetworkAttachment{
+		{Name: "shop_backend", Aliases: []string{"api"}},
+		{Name: "shop_frontend", Aliases: []string{"api", "backend-api"}},
+	}, api.Networks)
+	require.Equal(t, docker.Resources{MemoryBytes: 512 << 20, CPUs: 0.5}, api.Resources)
+	require.Equal(t, &docker.Healthcheck{Command: "wget -q -O - http://localhost:8000/health", Interval: 10 * time.Second, Retries: 3}, api.Healthcheck)
+	require.Equal(t, "on-failure", api.RestartPolicy)
+	require.Equal(t, 5, api.RestartMaxRetries)
+
+	web, err := project.containerSpec("web")
+	require.NoError(t, err)
+	require.Equal(t, []docker.PortMapping{{HostPort: 8080, ContainerPort: 80}, {HostIP: "127.0.0.1", HostPort: 8443, ContainerPort: 443, Protocol: "tcp"}}, web.Ports)
+	require.Equal(t, map[string]string{"/srv/shop/nginx.conf": "/etc/nginx/conf.d/default.conf"}, web.Mounts)
+
+	db, err := project.containerSpec("db")
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"shop_db-data": "/var/lib/postgresql/data"}, db.Volumes)
+	require.Equal(t, "json-file", db.LogDriver)
+
+	worker, err := project.containerSpec("worker")
+	require.NoError(t, err)
+	require.Equal(t, []docker.NetworkAttachment{{Name: "shop_default", Aliases: []string{"worker"}}}, worker.Networks)
+	require.Equal(t, []string{"work", "--queue", "orders high"}, worker.Args)
+	require.Empty(t, worker.Command)
+
+	backend := project.networkSpec("backend")
+	require.Equal(t, docker.NetworkSpec{Name: "shop_backend", Subnet: "172.31.0.0/24", Internal: true, Labels: map[string]string{LabelProject: "shop"}}, backend)
+	require.Contains(t, project.networks(), "default")
+}
+
+func TestParseProjectInvalid(t *testing.T) {
+	for name, data := range map[string]string{
+		"unknown key":        "services:\n  web:\n    image: nginx\n    build: .\n",
+		"no image":           "services:\n  web:\n    ports: [\"80\"]\n",
+		"cycle":              "services:\n  a:\n    image: x\n    depends_on: [b]\n  b:\n    image: x\n    depends_on: [a]\n",
+		"unknown dependency": "services:\n  a:\n    image: x\n    depends_on: [b]\n",
+		"undeclared network": "services:\n  a:\n    image: x\n    networks: [b]\n",
+		"undeclared volume":  "services:\n  a:\n    image: x\n    volumes: [\"data:/data\"]\n",
+		"relative bind":      "services:\n  a:\n    image: x\n    volumes: [\"./data:/data\"]\n",
+		"mount options":      "services:\n  a:\n    image: x\n    volumes: [\"/data:/data:ro\"]\n",
+		"unterminated quote": "services:\n  a:\n    image: x\n    command: echo 'a\n",
+	} {
+		_, err := ParseProject("test", []byte(data))
+		require.Error(t, err, name)
+	}
+
+	_, err := ParseProject("Invalid Name", []byte("services:\n  a:\n    image: x\n"))
+	require.ErrorIs(t, err, ErrInvalidProject)
+}
+
+func TestConvertHealthcheck(t *testing.T) {
+	for _, h := range []Healthcheck{{Test: StringOrList{"NONE"}}, {Disable: true}, {Test: StringOrList{"CMD", "true"}, Disable: true}} {
+		res, err := convertHealthcheck(h)
+		require.NoError(t, err)
+		require.Equal(t, &docker.Healthcheck{Disable: true}, res)
+	}
+	res, err := convertHealthcheck(Healthcheck{Test: StringOrList{"CMD", "pg_isready", "-U", "shop user"}, Timeout: "5s"})
+	require.NoError(t, err)
+	require.Equal(t, &docker.Healthcheck{Command: "pg_isready -U 'shop user'", Timeout: 5 * time.Second}, res)
+	_, err = convertHealthcheck(Healthcheck{Test: StringOrList{"CMD-SHELL", "true", "false"}})
+	require.ErrorIs(t, err, ErrUnsupported)
+}
+
+func TestParsePort(t *testing.T) {
+	for input, expected := range map[string]docker.PortMapping{
+		"80":                {ContainerPort: 80},
+		"8080:80":           {HostPort: 8080, ContainerPort: 80},
+		"53:53/udp":         {HostPort: 53, ContainerPort: 53, Protocol: "udp"},
+		"127.0.0.1::80":     {HostIP: "127.0.0.1", ContainerPort: 80},
+		"127.0.0.1:8080:80": {HostIP: "127.0.0.1", HostPort: 8080, ContainerPort: 80},
+	} {
+		mapping, err := parsePort(input)
+		require.NoError(t, err, input)
+		require.Equal(t, expected, mapping, input)
+	}
+	_, err := parsePort("8000-8010:8000-8010")
+	require.ErrorIs(t, err, ErrUnsupported)
+}
+
+func TestParseByteSize(t *testing.T) {
+	for input, expected := range map[string]int64{"1024": 1024, "512m": 512 << 20, "1g": 1 << 30, "2GB": 2 << 30, "64k": 64 << 10} {
+		size, err := parseByteSize(input)
+		require.NoError(t, err, input)
+		require.Equal(t, expected, size, input)
+	}
+	_, err := parseByteSize("lots")
+	require.Error(t, err)
+}
+
+const testEnsureProjectInstanceName = "test-compose-ensure-project"
+
+func TestEnsureProject(t *testing.T) {
+	executor, err := test.GetLXDExecutorFactory(t, testEnsureProjectInstanceName)()
+	ctx, r := test.DefaultPreamble(t, time.Minute*5)
+	r.NoError(err)
+
+	dProvisioner := docker.Provisioner{CommandExecutor: executor}
+	_, err = dProvisioner.EnsureDockerDaemon(ctx)
+	r.NoError(err)
+
+	project, err := ParseProject("demo", []byte(`
+services:
+  cache:
+    image: redis:7
+    command: ["sh", "-c", "redis-server --save 60 1"]
+    volumes: ["cache-data:/data"]
+  web:
+    image: nginx
+    depends_on: [cache]
+    ports: ["8080:80"]
+volumes:
+  cache-data:
+`))
+	r.NoError(err)
+	cProvisioner := Provisioner{CommandExecutor: executor}
+	test.RequireIdempotence(r, func() (bool, error) {
+		return cProvisioner.EnsureProject(ctx, project)
+	})
+
+	// removed services are removed from the instance
+	delete(project.Services, "web")
+	test.RequireIdempotence(r, func() (bool, error) {
+		return cProvisioner.EnsureProject(ctx, project)
+	})
+	containers, err := dProvisioner.ListContainers(ctx, map[string]string{LabelProject: "demo"})
+	r.NoError(err)
+	r.Equal([]string{"demo-cache-1"}, containers)
+
+	test.RequireIdempotence(r, func() (bool, error) {
+		return cProvisioner.EnsureProjectAbsent(ctx, "demo")
+	})
+}
@@ -0,0 +1,265 @@
+package compose
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/ctr2cloud/ctr2cloud/pkg/generic/compute"
+	"github.com/ctr2cloud/ctr2cloud/pkg/provisioners/docker"
+	"github.com/samber/lo"
+)
+
+var ErrUnsupported = errors.New("unsupported compose feature")
+
+// parsePort parses the short syntax [[HOST_IP:]HOST_PORT:]CONTAINER_PORT[/PROTOCOL]
+func parsePort(s string) (docker.PortMapping, error) {
+	var mapping docker.PortMapping
+	spec, protocol, ok := strings.Cut(s, "/")
+	if ok {
+		mapping.Protocol = protocol
+	}
+	parts := strings.Split(spec, ":")
+	if len(parts) > 3 {
+		return docker.PortMapping{}, fmt.Errorf("%w: port %s", ErrUnsupported, s)
+	}
+	var err error
+	mapping.ContainerPort, err = strconv.Atoi(parts[len(parts)-1])
+	if err != nil {
+		return docker.PortMapping{}, fmt.Errorf("%w: port %s", ErrUnsupported, s)
+	}
+	if len(parts) >= 2 && parts[len(parts)-2] != "" {
+		mapping.HostPort, err = strconv.Atoi(parts[len(parts)-2])
+		if err != nil {
+			return docker.PortMapping{}, fmt.Errorf("%w: port %s", ErrUnsupported, s)
+		}
+	}
+	if len(parts) == 3 {
+		mapping.HostIP = parts[0]
+	}
+	return mapping, nil
+}
+
+// parseByteSize parses sizes like 512m or 1g into bytes
+func parseByteSize(s string) (int64, error) {
+	s = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(s)), "b")
+	multiplier := int64(1)
+	if s != "" {
+		switch s[len(s)-1] {
+		case 'k':
+			multiplier = 1 << 10
+		case 'm':
+			multiplier = 1 << 20
+		case 'g':
+			multiplier = 1 << 30
+		}
+		if multiplier != 1 {
+			s = s[:len(s)-1]
+		}
+	}
+	value, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %s: %w", s, err)
+	}
+	return value * multiplier, nil
+}
+
+func parseDevice(s string) docker.Device {
+	parts := strings.SplitN(s, ":", 3)
+	device := docker.Device{PathOnHost: parts[0]}
+	if len(parts) > 1 {
+		device.PathInContainer = parts[1]
+	}
+	if len(parts) > 2 {
+		device.Permissions = parts[2]
+	}
+	return device
+}
+
+func parseDuration(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	return time.ParseDuration(s)
+}
+
+func convertHealthcheck(h Healthcheck) (*docker.Healthcheck, error) {
+	if h.Disable || len(h.Test) > 0 && h.Test[0] == "NONE" {
+		return &docker.Healthcheck{Disable: true}, nil
+	}
+	res := &docker.Healthcheck{Retries: h.Retries}
+	switch {
+	case len(h.Test) == 1:
+		res.Command = h.Test[0]
+	case len(h.Test) == 2 && h.Test[0] == "CMD-SHELL":
+		res.Command = h.Test[1]
+	case len(h.Test) > 1 && h.Test[0] == "CMD":
+		res.Command = strings.Join(lo.Map(h.Test[1:], func(arg string, _ int) string { return compute.ShellQuote(arg) }), " ")
+	default:
+		return nil, fmt.Errorf("%w: healthcheck test %v", ErrUnsupported, h.Test)
+	}
+	var err error
+	for _, d := range []struct {
+		value  string
+		target *time.Duration
+	}{
+		{h.Interval, &res.Interval},
+		{h.Timeout, &res.Timeout},
+		{h.StartPeriod, &res.StartPeriod},
+	} {
+		*d.target, err = parseDuration(d.value)
+		if err != nil {
+			return nil, fmt.Errorf("healthcheck: %w", err)
+		}
+	}
+	return res, nil
+}
+
+func convertPullPolicy(policy string) (docker.PullPolicy, error) {
+	switch policy {
+	case "", "missing", "if_not_present":
+		return docker.PullIfNotPresent, nil
+	case "always":
+		return docker.PullAlways, nil
+	case "never":
+		return docker.PullNever, nil
+	default:
+		return "", fmt.Errorf("%w: pull_policy %s", ErrUnsupported, policy)
+	}
+}
+
+// isValidName returns true for project names accepted by compose
+func isValidName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i, r := range name {
+		if !(unicode.IsDigit(r) || (r >= 'a' && r <= 'z') || (i > 0 && (r == '-' || r == '_'))) {
+			return false
+		}
+	}
+	return true
+}
+
+// containerSpec converts the service name to a container spec
+func (p Project) containerSpec(name string) (docker.ContainerSpec, error) {
+	service := p.Services[name]
+	pullPolicy, err := convertPullPolicy(service.PullPolicy)
+	if err != nil {
+		return docker.ContainerSpec{}, err
+	}
+
+	spec := docker.ContainerSpec{
+		Image:      service.Image,
+		PullPolicy: pullPolicy,
+		Name:       p.containerName(name),
+		Args:       service.Command,
+		Entrypoint: service.Entrypoint,
+		User:       service.User,
+		WorkDir:    service.WorkingDir,
+		Env:        service.Environment,
+		EnvFiles:   service.EnvFile,
+		Labels:     p.labels(service.Labels, name),
+		Resources: docker.Resources{
+			CPUs:      service.CPUs,
+			PidsLimit: service.PidsLimit,
+		},
+		CapAdd:     service.CapAdd,
+		CapDrop:    service.CapDrop,
+		Privileged: service.Privileged,
+		Devices:    lo.Map(service.Devices, func(device string, _ int) docker.Device { return parseDevice(device) }),
+	}
+
+	policy, retries, _ := strings.Cut(service.Restart, ":")
+	spec.RestartPolicy = policy
+	if retries != "" {
+		spec.RestartMaxRetries, err = strconv.Atoi(retries)
+		if err != nil {
+			return docker.ContainerSpec{}, fmt.Errorf("invalid restart policy %s: %w", service.Restart, err)
+		}
+	}
+
+	if service.MemLimit != "" {
+		spec.Resources.MemoryBytes, err = parseByteSize(service.MemLimit)
+		if err != nil {
+			return docker.ContainerSpec{}, fmt.Errorf("mem_limit: %w", err)
+		}
+	}
+
+	for _, port := range service.Ports {
+		mapping, err := parsePort(port)
+		if err != nil {
+			return docker.ContainerSpec{}, err
+		}
+		spec.Ports = append(spec.Ports, mapping)
+	}
+
+	for _, volume := range service.Volumes {
+		parts := strings.Split(volume, ":")
+		if len(parts) != 2 {
+			return docker.ContainerSpec{}, fmt.Errorf("%w: volume %s, only SOURCE:TARGET is supported", ErrUnsupported, volume)
+		}
+		source, target := parts[0], parts[1]
+		if path.IsAbs(source) {
+			if spec.Mounts == nil {
+				spec.Mounts = make(map[string]string)
+			}
+			spec.Mounts[source] = target
+			continue
+		}
+		if _, ok := p.Volumes[source]; !ok {
+			return docker.ContainerSpec{}, fmt.Errorf("service %s uses undeclared volume %s, bind mounts must use absolute paths", name, source)
+		}
+		if spec.Volumes == nil {
+			spec.Volumes = make(map[string]string)
+		}
+		spec.Volumes[p.volumeName(source)] = target
+	}
+
+	for _, network := range p.serviceNetworks(name) {
+		// like compose, the service name is an alias on all networks
+		aliases := append([]string{name}, service.Networks[network].Aliases...)
+		spec.Networks = append(spec.Networks, docker.NetworkAttachment{Name: p.networkName(network), Aliases: aliases})
+	}
+
+	if service.Logging != nil {
+		spec.LogDriver = service.Logging.Driver
+		spec.LogOptions = service.Logging.Options
+	}
+	if service.Healthcheck != nil {
+		spec.Healthcheck, err = convertHealthcheck(*service.Healthcheck)
+		if err != nil {
+			return docker.ContainerSpec{}, err
+		}
+	}
+	return spec, nil
+}
+
+func (p Project) networkSpec(name string) docker.NetworkSpec {
+	network := p.networks()[name]
+	spec := docker.NetworkSpec{
+		Name:     p.networkName(name),
+		Driver:   network.Driver,
+		Internal: network.Internal,
+		Labels:   p.labels(network.Labels, ""),
+	}
+	if len(network.IPAM.Config) > 0 {
+		spec.Subnet = network.IPAM.Config[0].Subnet
+		spec.Gateway = network.IPAM.Config[0].Gateway
+	}
+	return spec
+}
+
+func (p Project) volumeSpec(name string) docker.VolumeSpec {
+	volume := p.Volumes[name]
+	return docker.VolumeSpec{
+		Name:    p.volumeName(name),
+		Driver:  volume.Driver,
+		Options: volume.DriverOpts,
+		Labels:  p.labels(volume.Labels, ""),
+	}
+}
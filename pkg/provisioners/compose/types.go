@@ -0,0 +1,238 @@
+package compose
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/ctr2cloud/ctr2cloud/pkg/generic/compute"
+	"github.com/samber/lo"
+	"gopkg.in/yaml.v3"
+)
+
+// StringOrList accepts a single string or a list of strings
+type StringOrList []string
+
+func (s *StringOrList) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		*s = StringOrList{node.Value}
+		return nil
+	}
+	var list []string
+	err := node.Decode(&list)
+	*s = list
+	return err
+}
+
+// MappingOrList accepts a mapping or a list of KEY=VALUE strings
+type MappingOrList map[string]string
+
+func (m *MappingOrList) UnmarshalYAML(node *yaml.Node) error {
+	res := make(MappingOrList)
+	if node.Kind == yaml.SequenceNode {
+		var list []string
+		err := node.Decode(&list)
+		if err != nil {
+			return err
+		}
+		for _, entry := range list {
+			key, value, _ := strings.Cut(entry, "=")
+			res[key] = value
+		}
+		*m = res
+		return nil
+	}
+	if node.Kind != yaml.MappingNode {
+		return fmt.Errorf("line %d: expected a mapping or a list", node.Line)
+	}
+	// values may be numbers or booleans, their literal form is used
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+		if value.Kind != yaml.ScalarNode {
+			return fmt.Errorf("line %d: expected a scalar value for %s", value.Line, key.Value)
+		}
+		if value.Tag == "!!null" {
+			res[key.Value] = ""
+		} else {
+			res[key.Value] = value.Value
+		}
+	}
+	*m = res
+	return nil
+}
+
+// ShellCommand accepts a list of arguments or a command string, which is split into
+// arguments like compose splits it, without a shell in the container
+type ShellCommand []string
+
+func (c *ShellCommand) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		args, err := compute.SplitShellWords(node.Value)
+		if err != nil {
+			return fmt.Errorf("line %d: %w", node.Line, err)
+		}
+		*c = args
+		return nil
+	}
+	var args []string
+	err := node.Decode(&args)
+	if err != nil {
+		return err
+	}
+	*c = args
+	return nil
+}
+
+// DependsOn accepts a list of service names or a mapping of service names to conditions.
+// Conditions are ignored, services are only started in order.
+type DependsOn []string
+
+func (d *DependsOn) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.SequenceNode {
+		var list []string
+		err := node.Decode(&list)
+		*d = list
+		return err
+	}
+	if node.Kind != yaml.MappingNode {
+		return fmt.Errorf("line %d: expected a mapping or a list", node.Line)
+	}
+	keys := make([]string, 0, len(node.Content)/2)
+	for i := 0; i < len(node.Content); i += 2 {
+		keys = append(keys, node.Content[i].Value)
+	}
+	slices.Sort(keys)
+	*d = keys
+	return nil
+}
+
+type ServiceNetwork struct {
+	Aliases []string `yaml:"aliases"`
+}
+
+// ServiceNetworks accepts a list of network names or a mapping of network names to their settings
+type ServiceNetworks map[string]ServiceNetwork
+
+func (n *ServiceNetworks) UnmarshalYAML(node *yaml.Node) error {
+	res := make(ServiceNetworks)
+	if node.Kind == yaml.SequenceNode {
+		var list []string
+		err := node.Decode(&list)
+		if err != nil {
+			return err
+		}
+		for _, name := range list {
+			res[name] = ServiceNetwork{}
+		}
+		*n = res
+		return nil
+	}
+	var mapping map[string]*ServiceNetwork
+	err := node.Decode(&mapping)
+	if err != nil {
+		return err
+	}
+	for name, network := range mapping {
+		res[name] = lo.FromPtr(network)
+	}
+	*n = res
+	return nil
+}
+
+type Logging struct {
+	Driver  string            `yaml:"driver"`
+	Options map[string]string `yaml:"options"`
+}
+
+type Healthcheck struct {
+	// Test is a shell command or a list starting with CMD, CMD-SHELL or NONE
+	Test        StringOrList `yaml:"test"`
+	Disable     bool         `yaml:"disable"`
+	Interval    string       `yaml:"interval"`
+	Timeout     string       `yaml:"timeout"`
+	StartPeriod string       `yaml:"start_period"`
+	Retries     int          `yaml:"retries"`
+}
+
+// Service is the subset of a compose service which is supported by docker.ContainerSpec
+type Service struct {
+	Image         string          `yaml:"image"`
+	PullPolicy    string          `yaml:"pull_policy"`
+	ContainerName string          `yaml:"container_name"`
+	Command       ShellCommand    `yaml:"command"`
+	Entrypoint    string          `yaml:"entrypoint"`
+	User          string          `yaml:"user"`
+	WorkingDir    string          `yaml:"working_dir"`
+	Environment   MappingOrList   `yaml:"environment"`
+	EnvFile       StringOrList    `yaml:"env_file"`
+	Labels        MappingOrList   `yaml:"labels"`
+	Ports         []string        `yaml:"ports"`
+	Volumes       []string        `yaml:"volumes"`
+	Networks      ServiceNetworks `yaml:"networks"`
+	DependsOn     DependsOn       `yaml:"depends_on"`
+	Restart       string          `yaml:"restart"`
+	CapAdd        []string        `yaml:"cap_add"`
+	CapDrop       []string        `yaml:"cap_drop"`
+	Privileged    bool            `yaml:"privileged"`
+	Devices       []string        `yaml:"devices"`
+	MemLimit      string          `yaml:"mem_limit"`
+	CPUs          float64         `yaml:"cpus"`
+	PidsLimit     int64           `yaml:"pids_limit"`
+	Logging       *Logging        `yaml:"logging"`
+	Healthcheck   *Healthcheck    `yaml:"healthcheck"`
+}
+
+type IPAMConfig struct {
+	Subnet  string `yaml:"subnet"`
+	Gateway string `yaml:"gateway"`
+}
+
+type Network struct {
+	// Name overrides the project scoped name
+	Name     string        `yaml:"name"`
+	Driver   string        `yaml:"driver"`
+	Internal bool          `yaml:"internal"`
+	Labels   MappingOrList `yaml:"labels"`
+	IPAM     struct {
+		Config []IPAMConfig `yaml:"config"`
+	} `yaml:"ipam"`
+	// External networks are not managed by the project
+	External bool `yaml:"external"`
+}
+
+type Volume struct {
+	// Name overrides the project scoped name
+	Name       string            `yaml:"name"`
+	Driver     string            `yaml:"driver"`
+	DriverOpts map[string]string `yaml:"driver_opts"`
+	Labels     MappingOrList     `yaml:"labels"`
+	// External volumes are not managed by the project
+	External bool `yaml:"external"`
+}
+
+// Project is a set of services with their networks and volumes, modelled after compose files
+type Project struct {
+	// Version is obsolete in compose files and ignored
+	Version  string             `yaml:"version"`
+	Name     string             `yaml:"name"`
+	Services map[string]Service `yaml:"services"`
+	Networks map[string]Network `yaml:"networks"`
+	Volumes  map[string]Volume  `yaml:"volumes"`
+}
+
+// ParseProject parses a compose file, name is used if the file does not set a project name.
+// Unknown keys are rejected so unsupported compose features are not silently ignored.
+func ParseProject(name string, data []byte) (Project, error) {
+	var project Project
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	err := decoder.Decode(&project)
+	if err != nil {
+		return Project{}, fmt.Errorf("parse compose file: %w", err)
+	}
+	if project.Name == "" {
+		project.Name = name
+	}
+	return project, project.Validate()
+}
@@ -0,0 +1,304 @@
+package dnf
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/ctr2cloud/ctr2cloud/pkg/generic/compute"
+	"github.com/ctr2cloud/ctr2cloud/pkg/generic/pkgmgr"
+	"github.com/ctr2cloud/ctr2cloud/pkg/pipeline"
+	"github.com/juju/zaputil/zapctx"
+	"github.com/samber/lo"
+	"go.uber.org/zap"
+)
+
+var _ pkgmgr.PackageManager = &Provisioner{}
+
+type Provisioner struct {
+	*compute.CommandExecutor
+}
+
+var ErrNotFound = pkgmgr.ErrNotFound
+
+type PackageSpec = pkgmgr.PackageSpec
+type RemoveOptions = pkgmgr.RemoveOptions
+
+// dnfCmd falls back to yum on releases which predate dnf
+const dnfCmd = "$(command -v dnf || command -v yum) -y -q"
+
+// rpmQueryFormat prints the name and [epoch:]version-release of a package,
+// the epoch is omitted if the package does not have one
+const rpmQueryFormat = `%{NAME}\t%|EPOCH?{%{EPOCH}:}:{}|%{VERSION}-%{RELEASE}\n`
+
+// versionlockPluginPackage provides the versionlock command used for holds
+const versionlockPluginPackage = "dnf-command(versionlock)"
+
+// parseRPMQueryOutput parses the output of rpm -q using rpmQueryFormat.
+// Packages which are not installed are omitted.
+func parseRPMQueryOutput(output string) map[string]string {
+	res := make(map[string]string)
+	for _, line := range strings.Split(output, "\n") {
+		// example lines:
+		// jq	1.6-17.el9
+		// openssh-server	1:8.7p1-38.el9
+		// package foo is not installed
+		fields := strings.Split(line, "\t")
+		if len(fields) != 2 {
+			continue
+		}
+		res[fields[0]] = fields[1]
+	}
+	return res
+}
+
+// versionMatches returns true if the installed [epoch:]version-release satisfies wanted,
+// which may omit the epoch or the release
+func versionMatches(installed, wanted string) bool {
+	if installed == wanted {
+		return true
+	}
+	_, withoutEpoch, hasEpoch := strings.Cut(installed, ":")
+	if !hasEpoch {
+		withoutEpoch = installed
+	}
+	if withoutEpoch == wanted {
+		return true
+	}
+	version, _, _ := strings.Cut(withoutEpoch, "-")
+	return !strings.Contains(wanted, "-") && version == wanted
+}
+
+// versionlockEntryRegex matches name-epoch:version-release.* as printed by dnf versionlock list
+var versionlockEntryRegex = regexp.MustCompile(`^(.+)-\d+:[^-]+-[^-]+$`)
+
+// parseVersionlockList returns the names of all packages in the output of dnf versionlock list
+func parseVersionlockList(output string) map[string]bool {
+	res := make(map[string]bool)
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSuffix(strings.TrimSpace(line), ".*")
+		// example line:
+		// jq-0:1.6-17.el9.*
+		if match := versionlockEntryRegex.FindStringSubmatch(line); match != nil {
+			res[match[1]] = true
+		}
+	}
+	return res
+}
+
+// GetPackageVersions returns the installed versions of packageNames using a single rpm query.
+// Packages that are not installed are omitted from the result.
+func (p *Provisioner) GetPackageVersions(ctx context.Context, packageNames ...string) (map[string]string, error) {
+	logger := zapctx.Logger(ctx)
+	quotedNames := lo.Map(packageNames, func(name string, _ int) string { return compute.ShellQuote(name) })
+	cmd := fmt.Sprintf("rpm -q --qf '%s' %s", rpmQueryFormat, strings.Join(quotedNames, " "))
+	output, err := p.CommandExecutor.ExecString(ctx, cmd)
+	logger.Debug("rpm -q", zap.Error(err), zap.String("output", output))
+	if err != nil {
+		// rpm returns the number of packages which are not installed
+		var cErr compute.CommandExecutorError
+		if !errors.As(err, &cErr) || cErr.IsNotFound() {
+			return nil, fmt.Errorf("rpm query: %w", err)
+		}
+	}
+	return parseRPMQueryOutput(output), nil
+}
+
+// GetPackageVersion returns the installed version of packageName or ErrNotFound if it is not installed
+func (p *Provisioner) GetPackageVersion(ctx context.Context, packageName string) (string, error) {
+	versions, err := p.GetPackageVersions(ctx, packageName)
+	if err != nil {
+		return "", err
+	}
+	version, ok := versions[packageName]
+	if !ok {
+		return "", ErrNotFound
+	}
+	return version, nil
+}
+
+func (p *Provisioner) getHeldPackages(ctx context.Context) (map[string]bool, error) {
+	output, err := p.CommandExecutor.ExecString(ctx, dnfCmd+" versionlock list")
+	if err != nil {
+		// the versionlock plugin is not installed, so nothing can be held
+		return map[string]bool{}, nil
+	}
+	return parseVersionlockList(output), nil
+}
+
+// dnf runs dnf with the given (already quoted) arguments
+func (p *Provisioner) dnf(ctx context.Context, args string) error {
+	logger := zapctx.Logger(ctx)
+	cmd := dnfCmd + " " + args
+	output, err := p.CommandExecutor.ExecString(ctx, cmd)
+	logger.Debug("dnf", zap.String("cmd", cmd), zap.Error(err), zap.String("output", output))
+	if err != nil {
+		if strings.Contains(output, "No match for argument") || strings.Contains(output, "Unable to find a match") {
+			return fmt.Errorf("%w: %s: %w", ErrNotFound, strings.TrimSpace(output), err)
+		}
+		return fmt.Errorf("%s: %w", strings.TrimSpace(output), err)
+	}
+	return nil
+}
+
+// EnsurePackagesInstalled ensures that all packages are installed at the requested version.
+// Missing or mismatched packages are installed with a single dnf invocation.
+func (p *Provisioner) EnsurePackagesInstalled(ctx context.Context, specs []PackageSpec) (bool, error) {
+	logger := zapctx.Logger(ctx)
+	if len(specs) == 0 {
+		return false, nil
+	}
+	versions, err := p.GetPackageVersions(ctx, lo.Map(specs, func(spec PackageSpec, _ int) string { return spec.Name })...)
+	if err != nil {
+		return false, err
+	}
+	// a package locked earlier has to be unlocked before another version can be installed,
+	// even if the spec no longer holds it
+	needsLocks := lo.ContainsBy(specs, func(spec PackageSpec) bool {
+		version, installed := versions[spec.Name]
+		return spec.Hold || installed && spec.Version != "" && !versionMatches(version, spec.Version)
+	})
+	var held map[string]bool
+	if needsLocks {
+		held, err = p.getHeldPackages(ctx)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	installArgs := make([]string, 0)
+	toUnlock := make([]string, 0)
+	toHold := make([]string, 0)
+	for _, spec := range specs {
+		version, installed := versions[spec.Name]
+		switch {
+		case !installed:
+			logger.Debug("package not installed", zap.String("package", spec.Name))
+		case spec.Version != "" && !versionMatches(version, spec.Version):
+			logger.Debug("package version mismatch", zap.String("package", spec.Name), zap.String("version", version), zap.String("expected", spec.Version))
+			if held[spec.Name] {
+				toUnlock = append(toUnlock, compute.ShellQuote(spec.Name))
+			}
+		default:
+			logger.Debug("package already installed", zap.String("package", spec.Name), zap.String("version", version))
+			if spec.Hold && !held[spec.Name] {
+				toHold = append(toHold, compute.ShellQuote(spec.Name))
+			}
+			continue
+		}
+		if spec.Version != "" {
+			installArgs = append(installArgs, compute.ShellQuote(spec.Name+"-"+spec.Version))
+		} else {
+			installArgs = append(installArgs, compute.ShellQuote(spec.Name))
+		}
+		if spec.Hold {
+			toHold = append(toHold, compute.ShellQuote(spec.Name))
+		}
+	}
+
+	if len(toUnlock) > 0 {
+		err = p.dnf(ctx, "versionlock delete "+strings.Join(toUnlock, " "))
+		if err != nil {
+			return false, fmt.Errorf("dnf versionlock delete: %w", err)
+		}
+	}
+	if len(installArgs) > 0 {
+		err = p.dnf(ctx, "install "+strings.Join(installArgs, " "))
+		if err != nil {
+			return true, fmt.Errorf("dnf install: %w", err)
+		}
+	}
+	if len(toHold) > 0 {
+		err = p.dnf(ctx, "install "+compute.ShellQuote(versionlockPluginPackage))
+		if err != nil {
+			return true, fmt.Errorf("installing versionlock plugin: %w", err)
+		}
+		err = p.dnf(ctx, "versionlock add "+strings.Join(toHold, " "))
+		if err != nil {
+			return true, fmt.Errorf("dnf versionlock add: %w", err)
+		}
+	}
+	return len(installArgs) > 0 || len(toHold) > 0, nil
+}
+
+// EnsurePackagesInstalledP is the pipeline version of EnsurePackagesInstalled
+func (p *Provisioner) EnsurePackagesInstalledP(specs ...PackageSpec) pipeline.FuncT {
+	return func(ctx *pipeline.Context) error {
+		updated, err := p.EnsurePackagesInstalled(ctx, specs)
+		if err != nil {
+			return err
+		}
+		ctx.SetResult(updated)
+		return nil
+	}
+}
+
+// EnsurePackagesAbsent ensures that none of the packages are installed.
+// RPM has no notion of purging, modified configuration files are kept as .rpmsave files.
+func (p *Provisioner) EnsurePackagesAbsent(ctx context.Context, packageNames []string, opts RemoveOptions) (bool, error) {
+	logger := zapctx.Logger(ctx)
+	if len(packageNames) == 0 {
+		return false, nil
+	}
+	versions, err := p.GetPackageVersions(ctx, packageNames...)
+	if err != nil {
+		return false, err
+	}
+	toRemove := make([]string, 0)
+	for _, packageName := range packageNames {
+		if _, installed := versions[packageName]; !installed {
+			logger.Debug("package already absent", zap.String("package", packageName))
+			continue
+		}
+		toRemove = append(toRemove, compute.ShellQuote(packageName))
+	}
+	if len(toRemove) == 0 {
+		return false, nil
+	}
+
+	err = p.dnf(ctx, "remove "+strings.Join(toRemove, " "))
+	if err != nil {
+		return true, fmt.Errorf("dnf remove: %w", err)
+	}
+	if opts.Autoremove {
+		err = p.dnf(ctx, "autoremove")
+		if err != nil {
+			return true, fmt.Errorf("dnf autoremove: %w", err)
+		}
+	}
+	return true, nil
+}
+
+// EnsurePackagesAbsentP is the pipeline version of EnsurePackagesAbsent
+func (p *Provisioner) EnsurePackagesAbsentP(packageNames []string, opts RemoveOptions) pipeline.FuncT {
+	return func(ctx *pipeline.Context) error {
+		updated, err := p.EnsurePackagesAbsent(ctx, packageNames, opts)
+		if err != nil {
+			return err
+		}
+		ctx.SetResult(updated)
+		return nil
+	}
+}
+
+// EnsurePackageInstalled ensures that a single package is installed
+func (p *Provisioner) EnsurePackageInstalled(ctx context.Context, packageName string) (bool, error) {
+	return p.EnsurePackagesInstalled(ctx, []PackageSpec{{Name: packageName}})
+}
+
+// EnsurePackageInstalledP is the pipeline version of EnsurePackageInstalled
+func (p *Provisioner) EnsurePackageInstalledP(packageName string) pipeline.FuncT {
+	return p.EnsurePackagesInstalledP(PackageSpec{Name: packageName})
+}
+
+// EnsurePackageAbsent ensures that a single package is not installed
+func (p *Provisioner) EnsurePackageAbsent(ctx context.Context, packageName string, opts RemoveOptions) (bool, error) {
+	return p.EnsurePackagesAbsent(ctx, []string{packageName}, opts)
+}
+
+// EnsurePackageAbsentP is the pipeline version of EnsurePackageAbsent
+func (p *Provisioner) EnsurePackageAbsentP(packageName string, opts RemoveOptions) pipeline.FuncT {
+	return p.EnsurePackagesAbsentP([]string{packageName}, opts)
+}
@@ -0,0 +1,61 @@
+package dnf
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRPMQueryOutput(t *testing.T) {
+	output := "jq\t1.6-17.el9\nopenssh-server\t1:8.7p1-38.el9\npackage foo is not installed\n"
+	require.Equal(t, map[string]string{
+		"jq":             "1.6-17.el9",
+		"openssh-server": "1:8.7p1-38.el9",
+	}, parseRPMQueryOutput(output))
+	require.Empty(t, parseRPMQueryOutput("package foo is not installed\n"))
+}
+
+func TestVersionMatches(t *testing.T) {
+	require.True(t, versionMatches("1:8.7p1-38.el9", "1:8.7p1-38.el9"))
+	require.True(t, versionMatches("1:8.7p1-38.el9", "8.7p1-38.el9"))
+	require.True(t, versionMatches("1:8.7p1-38.el9", "8.7p1"))
+	require.True(t, versionMatches("1.6-17.el9", "1.6"))
+	require.False(t, versionMatches("1.6-17.el9", "1.6-16.el9"))
+	require.False(t, versionMatches("1.6-17.el9", "1.7"))
+	require.False(t, versionMatches("1.6-17.el9", "1"))
+}
+
+func TestParseVersionlockList(t *testing.T) {
+	output := "Last metadata expiration check: 0:01:02 ago on Mon 01 Jan 2024 00:00:00 AM UTC.\njq-0:1.6-17.el9.*\nopenssh-server-1:8.7p1-38.el9.*\n"
+	require.Equal(t, map[string]bool{
+		"jq":             true,
+		"openssh-server": true,
+	}, parseVersionlockList(output))
+}
+
+func TestRenderRepoFile(t *testing.T) {
+	require.Equal(t, `[docker-ce-stable]
+name=Docker CE Stable
+baseurl=https://download.docker.com/linux/centos/$releasever/$basearch/stable
+enabled=1
+gpgcheck=1
+gpgkey=file:///etc/pki/rpm-gpg/RPM-GPG-KEY-docker-ce-stable
+`, renderRepoFile(EnsureRepositoryArgs{
+		Name:        "docker-ce-stable",
+		Description: "Docker CE Stable",
+		BaseURL:     "https://download.docker.com/linux/centos/$releasever/$basearch/stable",
+		Key:         "-----BEGIN PGP PUBLIC KEY BLOCK-----",
+	}))
+
+	require.Equal(t, `[local]
+name=local
+baseurl=file:///srv/repo
+enabled=1
+gpgcheck=0
+`, renderRepoFile(EnsureRepositoryArgs{Name: "local", BaseURL: "file:///srv/repo", NoGPGCheck: true}))
+
+	// unsigned repositories have to be opted in
+	_, err := (&Provisioner{}).EnsureRepository(context.Background(), EnsureRepositoryArgs{Name: "local", BaseURL: "file:///srv/repo"})
+	require.ErrorIs(t, err, ErrKeyRequired)
+}
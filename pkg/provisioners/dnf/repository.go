@@ -0,0 +1,150 @@
+package dnf
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/ctr2cloud/ctr2cloud/pkg/generic/compute"
+	"github.com/ctr2cloud/ctr2cloud/pkg/pipeline"
+	"github.com/ctr2cloud/ctr2cloud/pkg/provisioners/file"
+	"github.com/juju/zaputil/zapctx"
+	"go.uber.org/zap"
+)
+
+var ErrKeyRequired = errors.New("a repository key is required")
+
+const (
+	reposDir = "/etc/yum.repos.d"
+	keyDir   = "/etc/pki/rpm-gpg"
+)
+
+type EnsureRepositoryArgs struct {
+	// Name is used as the repository id and for the .repo and key file names
+	Name string
+	// Description defaults to Name
+	Description string
+	// BaseURL of the repository, dnf variables such as $releasever and $basearch are expanded by dnf
+	BaseURL string
+	// ASCII armored key, required unless NoGPGCheck is set
+	Key string
+	// NoGPGCheck disables the signature check of the packages of the repository
+	NoGPGCheck bool
+	// whether to refresh the metadata of the repository right away if it changed,
+	// otherwise dnf refreshes it on the next install
+	Update bool
+}
+
+func repoFilePath(name string) string {
+	return path.Join(reposDir, name+".repo")
+}
+
+func keyPath(name string) string {
+	return path.Join(keyDir, "RPM-GPG-KEY-"+name)
+}
+
+// renderRepoFile renders the .repo file for args
+func renderRepoFile(args EnsureRepositoryArgs) string {
+	description := args.Description
+	if description == "" {
+		description = args.Name
+	}
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("[%s]\n", args.Name))
+	sb.WriteString(fmt.Sprintf("name=%s\n", description))
+	sb.WriteString(fmt.Sprintf("baseurl=%s\n", args.BaseURL))
+	sb.WriteString("enabled=1\n")
+	if args.NoGPGCheck {
+		sb.WriteString("gpgcheck=0\n")
+	} else {
+		sb.WriteString("gpgcheck=1\n")
+		sb.WriteString(fmt.Sprintf("gpgkey=file://%s\n", keyPath(args.Name)))
+	}
+	return sb.String()
+}
+
+// EnsureRepository ensures that the given repository is configured in /etc/yum.repos.d.
+// The key is imported into the rpm database when it changes.
+func (p *Provisioner) EnsureRepository(ctx context.Context, args EnsureRepositoryArgs) (bool, error) {
+	logger := zapctx.Logger(ctx)
+	if args.Key == "" && !args.NoGPGCheck {
+		return false, fmt.Errorf("%w: repository %s", ErrKeyRequired, args.Name)
+	}
+	fProvisioner := file.Provisioner{CommandExecutor: p.CommandExecutor}
+
+	keyUpdated := false
+	if args.Key != "" {
+		_, err := p.CommandExecutor.Exec(ctx, "mkdir -p "+keyDir)
+		if err != nil {
+			return false, fmt.Errorf("creating key directory: %w", err)
+		}
+		keyUpdated, err = fProvisioner.EnsureFileContentsString(ctx, keyPath(args.Name), args.Key)
+		if err != nil {
+			return false, fmt.Errorf("ensuring rpm key: %w", err)
+		}
+		if keyUpdated {
+			output, err := p.CommandExecutor.ExecString(ctx, "rpm --import "+compute.ShellQuote(keyPath(args.Name)))
+			if err != nil {
+				return true, fmt.Errorf("rpm --import: %s: %w", strings.TrimSpace(output), err)
+			}
+		}
+	}
+
+	repoPath := repoFilePath(args.Name)
+	contents := renderRepoFile(args)
+	logger.Debug("ensuring repository", zap.String("path", repoPath), zap.String("contents", contents))
+	repositoryUpdated, err := fProvisioner.EnsureFileContentsString(ctx, repoPath, contents)
+	if err != nil {
+		return keyUpdated, fmt.Errorf("ensuring repository: %w", err)
+	}
+
+	changed := keyUpdated || repositoryUpdated
+	if changed && args.Update {
+		err = p.dnf(ctx, "makecache --repo "+compute.ShellQuote(args.Name))
+		if err != nil {
+			return true, fmt.Errorf("dnf makecache after repo add: %w", err)
+		}
+	}
+	return changed, nil
+}
+
+// EnsureRepositoryP is the pipeline version of EnsureRepository
+func (p *Provisioner) EnsureRepositoryP(args EnsureRepositoryArgs) pipeline.FuncT {
+	return func(ctx *pipeline.Context) error {
+		updated, err := p.EnsureRepository(ctx, args)
+		if err != nil {
+			return err
+		}
+		ctx.SetResult(updated)
+		return nil
+	}
+}
+
+// EnsureRepositoryAbsent removes the .repo file and key file of the repository name.
+// Keys which were already imported into the rpm database are kept.
+func (p *Provisioner) EnsureRepositoryAbsent(ctx context.Context, name string) (bool, error) {
+	fProvisioner := file.Provisioner{CommandExecutor: p.CommandExecutor}
+	changed := false
+	for _, repoPath := range []string{repoFilePath(name), keyPath(name)} {
+		removed, err := fProvisioner.EnsureFileAbsent(ctx, repoPath)
+		if err != nil {
+			return changed, fmt.Errorf("removing %s: %w", repoPath, err)
+		}
+		changed = changed || removed
+	}
+	return changed, nil
+}
+
+// EnsureRepositoryAbsentP is the pipeline version of EnsureRepositoryAbsent
+func (p *Provisioner) EnsureRepositoryAbsentP(name string) pipeline.FuncT {
+	return func(ctx *pipeline.Context) error {
+		updated, err := p.EnsureRepositoryAbsent(ctx, name)
+		if err != nil {
+			return err
+		}
+		ctx.SetResult(updated)
+		return nil
+	}
+}
@@ -0,0 +1,540 @@
+package docker
+
+import (
+	"fmt"
+	"maps"
+	"math"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ctr2cloud/ctr2cloud/pkg/generic/compute"
+	"github.com/samber/lo"
+)
+
+// PortMapping publishes a container port on the host
+type PortMapping struct {
+	// HostIP defaults to all addresses, IPv6 addresses may be given with or without brackets
+	HostIP string
+	// HostPort is chosen by docker if zero
+	HostPort      int
+	ContainerPort int
+	// Protocol defaults to tcp
+	Protocol string
+}
+
+func (m PortMapping) protocol() string {
+	if m.Protocol == "" {
+		return "tcp"
+	}
+	return m.Protocol
+}
+
+// hostIP returns HostIP without the brackets of IPv6 addresses, as docker inspect reports it
+func (m PortMapping) hostIP() string {
+	return strings.TrimSuffix(strings.TrimPrefix(m.HostIP, "["), "]")
+}
+
+// String returns the mapping in the format of docker run -p
+func (m PortMapping) String() string {
+	var sb strings.Builder
+	if hostIP := m.hostIP(); strings.Contains(hostIP, ":") {
+		sb.WriteString("[" + hostIP + "]:")
+	} else if hostIP != "" {
+		sb.WriteString(hostIP + ":")
+	}
+	if m.HostPort != 0 {
+		sb.WriteString(strconv.Itoa(m.HostPort))
+	}
+	if sb.Len() > 0 {
+		sb.WriteString(":")
+	}
+	fmt.Fprintf(&sb, "%d/%s", m.ContainerPort, m.protocol())
+	return sb.String()
+}
+
+// key identifies the mapping independently of defaults
+func (m PortMapping) key() string {
+	hostPort := ""
+	if m.HostPort != 0 {
+		hostPort = strconv.Itoa(m.HostPort)
+	}
+	return fmt.Sprintf("%s:%s:%d/%s", m.hostIP(), hostPort, m.ContainerPort, m.protocol())
+}
+
+// NetworkAttachment connects the container to a network
+type NetworkAttachment struct {
+	Name    string
+	Aliases []string
+}
+
+type Device struct {
+	PathOnHost string
+	// PathInContainer defaults to PathOnHost
+	PathInContainer string
+	// Permissions is a combination of r, w and m, it defaults to rwm
+	Permissions string
+}
+
+func (d Device) String() string {
+	pathInContainer := d.PathInContainer
+	if pathInContainer == "" {
+		pathInContainer = d.PathOnHost
+	}
+	permissions := d.Permissions
+	if permissions == "" {
+		permissions = "rwm"
+	}
+	return fmt.Sprintf("%s:%s:%s", d.PathOnHost, pathInContainer, permissions)
+}
+
+// Resources limits the resources of a container, zero values are unlimited
+type Resources struct {
+	MemoryBytes int64
+	CPUs        float64
+	PidsLimit   int64
+}
+
+func (r Resources) nanoCPUs() int64 {
+	return int64(math.Round(r.CPUs * 1e9))
+}
+
+// Healthcheck overrides the healthcheck of the image, zero durations use the defaults of the image or docker
+type Healthcheck struct {
+	// Disable turns off the healthcheck of the image, the other fields are ignored
+	Disable bool
+	// Command is run with the shell of the container
+	Command     string
+	Interval    time.Duration
+	Timeout     time.Duration
+	StartPeriod time.Duration
+	Retries     int
+}
+
+type ContainerSpec struct {
+	Image string
+	// PullPolicy defaults to PullIfNotPresent. The container is recreated if the resolved image differs
+	// from the image of the running container, e.g. after a tag was pushed again and pulled.
+	PullPolicy PullPolicy
+	// Credentials are used to log in before the image is pulled, their registry defaults to the registry of Image
+	Credentials *RegistryCredentials
+	Name        string
+	// Mounts are bind mounts from host paths to container paths
+	Mounts map[string]string
+	// Volumes map names of volumes, e.g. created with EnsureVolume, to container paths
+	Volumes map[string]string
+	// Restart is a shorthand for RestartPolicy always, it is ignored if RestartPolicy is set
+	Restart bool
+	// RestartPolicy is one of no, always, unless-stopped or on-failure
+	RestartPolicy string
+	// RestartMaxRetries is only used with the on-failure policy
+	RestartMaxRetries int
+	// Command is split into arguments by the shell of the instance
+	Command string
+	// Args are passed to the container unchanged, they take precedence over Command
+	Args []string
+	// Entrypoint is passed to docker as a single word, arguments belong into Command or Args
+	Entrypoint string
+	User       string
+	WorkDir    string
+	Env        map[string]string
+	// EnvFiles are paths on the host, they are read to detect drift
+	EnvFiles []string
+	Labels   map[string]string
+	Ports    []PortMapping
+	// Networks, e.g. created with EnsureNetwork, replace the default bridge network. Aliases of the first network are set on creation,
+	// the other networks are connected after the container was created.
+	Networks   []NetworkAttachment
+	Resources  Resources
+	CapAdd     []string
+	CapDrop    []string
+	Privileged bool
+	Devices    []Device
+	// LogDriver defaults to the driver configured in the daemon
+	LogDriver   string
+	LogOptions  map[string]string
+	Healthcheck *Healthcheck
+	// Strategy defaults to ReplaceRecreate
+	Strategy ReplaceStrategy
+	// HealthTimeout limits how long ReplaceStartFirst waits for the new container, it defaults to DefaultHealthTimeout
+	HealthTimeout time.Duration
+}
+
+func (s ContainerSpec) restartPolicy() string {
+	if s.RestartPolicy != "" {
+		return s.RestartPolicy
+	}
+	if s.Restart {
+		return "always"
+	}
+	return "no"
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := lo.Keys(m)
+	slices.Sort(keys)
+	return keys
+}
+
+// sortedKeyValues returns KEY=VALUE pairs of m sorted by key
+func sortedKeyValues(m map[string]string) []string {
+	res := make([]string, 0, len(m))
+	for _, key := range sortedKeys(m) {
+		res = append(res, fmt.Sprintf("%s=%s", key, m[key]))
+	}
+	return res
+}
+
+func (s ContainerSpec) GetCommand() string {
+	var cmd strings.Builder
+	flag := func(name, value string) {
+		cmd.WriteString(fmt.Sprintf(" %s %s", name, compute.ShellQuote(value)))
+	}
+
+	cmd.WriteString(fmt.Sprintf("docker run -d --name %s", compute.ShellQuote(s.Name)))
+
+	for _, hostPath := range sortedKeys(s.Mounts) {
+		flag("-v", fmt.Sprintf("%s:%s", hostPath, s.Mounts[hostPath]))
+	}
+	for _, volume := range sortedKeys(s.Volumes) {
+		flag("-v", fmt.Sprintf("%s:%s", volume, s.Volumes[volume]))
+	}
+	for _, port := range s.Ports {
+		flag("-p", port.String())
+	}
+	for _, env := range sortedKeyValues(s.Env) {
+		flag("-e", env)
+	}
+	for _, envFile := range s.EnvFiles {
+		flag("--env-file", envFile)
+	}
+	for _, label := range sortedKeyValues(s.Labels) {
+		flag("-l", label)
+	}
+	if len(s.Networks) > 0 {
+		flag("--network", s.Networks[0].Name)
+		for _, alias := range s.Networks[0].Aliases {
+			flag("--network-alias", alias)
+		}
+	}
+	if s.User != "" {
+		flag("-u", s.User)
+	}
+	if s.WorkDir != "" {
+		flag("-w", s.WorkDir)
+	}
+	if s.Entrypoint != "" {
+		flag("--entrypoint", s.Entrypoint)
+	}
+
+	if policy := s.restartPolicy(); policy != "no" {
+		if policy == "on-failure" && s.RestartMaxRetries > 0 {
+			policy = fmt.Sprintf("%s:%d", policy, s.RestartMaxRetries)
+		}
+		flag("--restart", policy)
+	}
+
+	if s.Resources.MemoryBytes != 0 {
+		flag("--memory", strconv.FormatInt(s.Resources.MemoryBytes, 10))
+	}
+	if s.Resources.CPUs != 0 {
+		flag("--cpus", strconv.FormatFloat(s.Resources.CPUs, 'f', -1, 64))
+	}
+	if s.Resources.PidsLimit != 0 {
+		flag("--pids-limit", strconv.FormatInt(s.Resources.PidsLimit, 10))
+	}
+
+	for _, capability := range s.CapAdd {
+		flag("--cap-add", capability)
+	}
+	for _, capability := range s.CapDrop {
+		flag("--cap-drop", capability)
+	}
+	if s.Privileged {
+		cmd.WriteString(" --privileged")
+	}
+	for _, device := range s.Devices {
+		flag("--device", device.String())
+	}
+
+	if s.LogDriver != "" {
+		flag("--log-driver", s.LogDriver)
+	}
+	for _, option := range sortedKeyValues(s.LogOptions) {
+		flag("--log-opt", option)
+	}
+
+	if s.Healthcheck != nil && s.Healthcheck.Disable {
+		cmd.WriteString(" --no-healthcheck")
+	} else if s.Healthcheck != nil {
+		flag("--health-cmd", s.Healthcheck.Command)
+		if s.Healthcheck.Interval != 0 {
+			flag("--health-interval", s.Healthcheck.Interval.String())
+		}
+		if s.Healthcheck.Timeout != 0 {
+			flag("--health-timeout", s.Healthcheck.Timeout.String())
+		}
+		if s.Healthcheck.StartPeriod != 0 {
+			flag("--health-start-period", s.Healthcheck.StartPeriod.String())
+		}
+		if s.Healthcheck.Retries != 0 {
+			flag("--health-retries", strconv.Itoa(s.Healthcheck.Retries))
+		}
+	}
+
+	cmd.WriteString(fmt.Sprintf(" %s", s.Image))
+
+	if len(s.Args) > 0 {
+		for _, arg := range s.Args {
+			cmd.WriteString(" " + compute.ShellQuote(arg))
+		}
+	} else if s.Command != "" {
+		cmd.WriteString(fmt.Sprintf(" %s", s.Command))
+	}
+
+	return cmd.String()
+}
+
+// getNetworkConnectCommands returns the commands connecting the container to all but the first network
+func (s ContainerSpec) getNetworkConnectCommands() []string {
+	cmds := make([]string, 0)
+	for i, network := range s.Networks {
+		if i == 0 {
+			continue
+		}
+		var cmd strings.Builder
+		cmd.WriteString("docker network connect")
+		for _, alias := range network.Aliases {
+			cmd.WriteString(" --alias " + compute.ShellQuote(alias))
+		}
+		cmd.WriteString(fmt.Sprintf(" %s %s", compute.ShellQuote(network.Name), compute.ShellQuote(s.Name)))
+		cmds = append(cmds, cmd.String())
+	}
+	return cmds
+}
+
+// parseEnvFile parses the KEY=VALUE lines of a docker env file.
+// Lines without a value are passed from the environment of the docker client and are skipped.
+func parseEnvFile(content string) map[string]string {
+	env := make(map[string]string)
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimLeft(line, " \t")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if key, value, ok := strings.Cut(line, "="); ok {
+			env[key] = value
+		}
+	}
+	return env
+}
+
+// normalizeCapability returns the CAP_ prefixed upper case form used by the docker daemon
+func normalizeCapability(capability string) string {
+	capability = strings.ToUpper(capability)
+	if capability == "ALL" || strings.HasPrefix(capability, "CAP_") {
+		return capability
+	}
+	return "CAP_" + capability
+}
+
+var anonymousVolumeRegex = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// equalSets compares a and b ignoring order
+func equalSets(a, b []string) bool {
+	a = slices.Clone(a)
+	b = slices.Clone(b)
+	slices.Sort(a)
+	slices.Sort(b)
+	return slices.Equal(a, b)
+}
+
+// envMap parses a list of KEY=value entries
+func envMap(env []string) map[string]string {
+	res := make(map[string]string, len(env))
+	for _, entry := range env {
+		key, value, _ := strings.Cut(entry, "=")
+		res[key] = value
+	}
+	return res
+}
+
+// containerDefaults are the values a container inherits if they are not set in its spec
+type containerDefaults struct {
+	// Image is the configuration of the image of the container
+	Image Config
+	// LogConfig is the default log driver of the daemon with the log-opts it copies into containers
+	LogConfig LogConfig
+}
+
+// matchesInspect compares the spec with a running container, fileEnv contains the variables of EnvFiles.
+// Env, labels and log options are compared with the spec applied on top of defaults, other fields
+// that default to the image configuration are only compared if they are set.
+func (s *ContainerSpec) matchesInspect(inspectRes dockerInspect, defaults containerDefaults, fileEnv map[string]string) bool {
+	if inspectRes.Config.Image != s.Image {
+		return false
+	}
+
+	if inspectRes.Name != fmt.Sprintf("/%s", s.Name) {
+		return false
+	}
+
+	mountSpecSlice := make([]string, 0, len(s.Mounts))
+	for hostPath, containerPath := range s.Mounts {
+		mountSpecSlice = append(mountSpecSlice, fmt.Sprintf("%s:%s", hostPath, containerPath))
+	}
+	volumeSpecSlice := make([]string, 0, len(s.Volumes))
+	for volume, containerPath := range s.Volumes {
+		volumeSpecSlice = append(volumeSpecSlice, fmt.Sprintf("%s:%s", volume, containerPath))
+	}
+	mountInspectSlice := make([]string, 0, len(inspectRes.Mounts))
+	volumeInspectSlice := make([]string, 0, len(inspectRes.Mounts))
+	for _, mount := range inspectRes.Mounts {
+		switch {
+		case mount.Type == "bind":
+			mountInspectSlice = append(mountInspectSlice, fmt.Sprintf("%s:%s", mount.Source, mount.Destination))
+		case mount.Type == "volume" && !anonymousVolumeRegex.MatchString(mount.Name):
+			volumeInspectSlice = append(volumeInspectSlice, fmt.Sprintf("%s:%s", mount.Name, mount.Destination))
+		}
+	}
+	if !equalSets(mountSpecSlice, mountInspectSlice) || !equalSets(volumeSpecSlice, volumeInspectSlice) {
+		return false
+	}
+
+	portInspectSlice := make([]string, 0)
+	for containerPort, bindings := range inspectRes.HostConfig.PortBindings {
+		for _, binding := range bindings {
+			portInspectSlice = append(portInspectSlice, fmt.Sprintf("%s:%s:%s", binding.HostIP, binding.HostPort, containerPort))
+		}
+	}
+	if !equalSets(lo.Map(s.Ports, func(m PortMapping, _ int) string { return m.key() }), portInspectSlice) {
+		return false
+	}
+
+	// variables set with -e take precedence over env files, which take precedence over the image
+	expectedEnv := envMap(defaults.Image.Env)
+	maps.Copy(expectedEnv, fileEnv)
+	maps.Copy(expectedEnv, s.Env)
+	expectedLabels := maps.Clone(defaults.Image.Labels)
+	if expectedLabels == nil {
+		expectedLabels = make(map[string]string)
+	}
+	maps.Copy(expectedLabels, s.Labels)
+	if !maps.Equal(expectedEnv, envMap(inspectRes.Config.Env)) || !maps.Equal(expectedLabels, inspectRes.Config.Labels) {
+		return false
+	}
+
+	if len(s.Networks) == 0 {
+		if mode := inspectRes.HostConfig.NetworkMode; mode != "default" && mode != "bridge" {
+			return false
+		}
+	} else {
+		if !equalSets(lo.Map(s.Networks, func(n NetworkAttachment, _ int) string { return n.Name }), lo.Keys(inspectRes.NetworkSettings.Networks)) {
+			return false
+		}
+		for _, network := range s.Networks {
+			endpoint := inspectRes.NetworkSettings.Networks[network.Name]
+			for _, alias := range network.Aliases {
+				if !slices.Contains(endpoint.Aliases, alias) && !slices.Contains(endpoint.DNSNames, alias) {
+					return false
+				}
+			}
+		}
+	}
+
+	if s.User != "" && s.User != inspectRes.Config.User {
+		return false
+	}
+	if s.WorkDir != "" && s.WorkDir != inspectRes.Config.WorkingDir {
+		return false
+	}
+	if s.Entrypoint != "" && !slices.Equal([]string{s.Entrypoint}, inspectRes.Config.Entrypoint) {
+		return false
+	}
+
+	inspectPolicy := inspectRes.HostConfig.RestartPolicy
+	if inspectPolicy.Name == "" {
+		inspectPolicy.Name = "no"
+	}
+	if s.restartPolicy() != inspectPolicy.Name {
+		return false
+	}
+	if inspectPolicy.Name == "on-failure" && s.RestartMaxRetries != inspectPolicy.MaximumRetryCount {
+		return false
+	}
+
+	if s.Resources.MemoryBytes != inspectRes.HostConfig.Memory || s.Resources.nanoCPUs() != inspectRes.HostConfig.NanoCpus {
+		return false
+	}
+	inspectPidsLimit := int64(0)
+	if inspectRes.HostConfig.PidsLimit != nil && *inspectRes.HostConfig.PidsLimit > 0 {
+		inspectPidsLimit = *inspectRes.HostConfig.PidsLimit
+	}
+	if s.Resources.PidsLimit != inspectPidsLimit {
+		return false
+	}
+
+	if !equalSets(lo.Map(s.CapAdd, func(c string, _ int) string { return normalizeCapability(c) }), lo.Map(inspectRes.HostConfig.CapAdd, func(c string, _ int) string { return normalizeCapability(c) })) ||
+		!equalSets(lo.Map(s.CapDrop, func(c string, _ int) string { return normalizeCapability(c) }), lo.Map(inspectRes.HostConfig.CapDrop, func(c string, _ int) string { return normalizeCapability(c) })) {
+		return false
+	}
+	if s.Privileged != inspectRes.HostConfig.Privileged {
+		return false
+	}
+	deviceInspectSlice := lo.Map(inspectRes.HostConfig.Devices, func(d DeviceMapping, _ int) string {
+		return Device{PathOnHost: d.PathOnHost, PathInContainer: d.PathInContainer, Permissions: d.CgroupPermissions}.String()
+	})
+	if !equalSets(lo.Map(s.Devices, func(d Device, _ int) string { return d.String() }), deviceInspectSlice) {
+		return false
+	}
+
+	logDriver := s.LogDriver
+	if logDriver == "" {
+		logDriver = defaults.LogConfig.Type
+	}
+	if logDriver != inspectRes.HostConfig.LogConfig.Type {
+		return false
+	}
+	// dockerd copies its default log-opts into containers using the default driver
+	expectedLogOptions := make(map[string]string)
+	if logDriver == defaults.LogConfig.Type {
+		maps.Copy(expectedLogOptions, defaults.LogConfig.Config)
+	}
+	maps.Copy(expectedLogOptions, s.LogOptions)
+	if !maps.Equal(expectedLogOptions, inspectRes.HostConfig.LogConfig.Config) {
+		return false
+	}
+
+	if s.Healthcheck != nil && s.Healthcheck.Disable {
+		if health := inspectRes.Config.Healthcheck; health == nil || !slices.Equal(health.Test, []string{"NONE"}) {
+			return false
+		}
+	} else if s.Healthcheck != nil {
+		health := inspectRes.Config.Healthcheck
+		if health == nil || !slices.Equal(health.Test, []string{"CMD-SHELL", s.Healthcheck.Command}) {
+			return false
+		}
+		if (s.Healthcheck.Interval != 0 && int64(s.Healthcheck.Interval) != health.Interval) ||
+			(s.Healthcheck.Timeout != 0 && int64(s.Healthcheck.Timeout) != health.Timeout) ||
+			(s.Healthcheck.StartPeriod != 0 && int64(s.Healthcheck.StartPeriod) != health.StartPeriod) ||
+			(s.Healthcheck.Retries != 0 && s.Healthcheck.Retries != health.Retries) {
+			return false
+		}
+	}
+
+	args := s.Args
+	if len(args) == 0 && s.Command != "" {
+		var err error
+		args, err = compute.SplitShellWords(s.Command)
+		if err != nil {
+			return false
+		}
+	}
+	if len(args) > 0 && !slices.Equal(args, inspectRes.Config.Cmd) {
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,195 @@
+package docker
+
+import (
+	_ "embed"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+//go:embed testdata/inspect-options.json
+var inspectOptionsJSON []byte
+
+func optionsSpec() ContainerSpec {
+	return ContainerSpec{
+		Image:             "ghcr.io/example/app:1.2.3",
+		Name:              "app",
+		Mounts:            map[string]string{"/srv/app/config": "/etc/app"},
+		Volumes:           map[string]string{"app-data": "/var/lib/app"},
+		RestartPolicy:     "on-failure",
+		RestartMaxRetries: 5,
+		Command:           "serve --port 8080",
+		Entrypoint:        "/usr/bin/app",
+		User:              "app",
+		WorkDir:           "/srv",
+		Env:               map[string]string{"LOG_LEVEL": "debug"},
+		EnvFiles:          []string{"/srv/app/env"},
+		Labels:            map[string]string{"traefik.enable": "true"},
+		Ports: []PortMapping{
+			{HostIP: "127.0.0.1", HostPort: 8080, ContainerPort: 8080},
+			{ContainerPort: 53, Protocol: "udp"},
+		},
+		Networks: []NetworkAttachment{
+			{Name: "frontend", Aliases: []string{"web"}},
+			{Name: "backend", Aliases: []string{"app"}},
+		},
+		Resources:   Resources{MemoryBytes: 512 * 1024 * 1024, CPUs: 1.5, PidsLimit: 100},
+		CapAdd:      []string{"net_admin"},
+		CapDrop:     []string{"MKNOD"},
+		Devices:     []Device{{PathOnHost: "/dev/fuse"}},
+		LogDriver:   "json-file",
+		LogOptions:  map[string]string{"max-size": "10m", "max-file": "3"},
+		Healthcheck: &Healthcheck{Command: "curl -f http://localhost:8080/health", Interval: 10 * time.Second},
+	}
+}
+
+// optionsDefaults returns the image and daemon defaults of testdata/inspect-options.json
+func optionsDefaults() containerDefaults {
+	return containerDefaults{
+		Image: Config{
+			Env:    []string{"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"},
+			Labels: map[string]string{"org.opencontainers.image.version": "1.2.3"},
+		},
+		LogConfig: LogConfig{Type: "json-file"},
+	}
+}
+
+func TestGetCommand(t *testing.T) {
+	spec := ContainerSpec{
+		Image:   "nginx",
+		Name:    "nginx",
+		Mounts:  map[string]string{"/var/www": "/var/www"},
+		Restart: true,
+	}
+	require.Equal(t, "docker run -d --name nginx -v /var/www:/var/www --restart always nginx", spec.GetCommand())
+
+	require.Equal(t, "docker run -d --name app"+
+		" -v /srv/app/config:/etc/app -v app-data:/var/lib/app"+
+		" -p 127.0.0.1:8080:8080/tcp -p 53/udp"+
+		" -e LOG_LEVEL=debug --env-file /srv/app/env -l traefik.enable=true"+
+		" --network frontend --network-alias web"+
+		" -u app -w /srv --entrypoint /usr/bin/app --restart on-failure:5"+
+		" --memory 536870912 --cpus 1.5 --pids-limit 100"+
+		" --cap-add net_admin --cap-drop MKNOD --device /dev/fuse:/dev/fuse:rwm"+
+		" --log-driver json-file --log-opt max-file=3 --log-opt max-size=10m"+
+		" --health-cmd 'curl -f http://localhost:8080/health' --health-interval 10s"+
+		" ghcr.io/example/app:1.2.3 serve --port 8080", optionsSpec().GetCommand())
+	require.Equal(t, []string{"docker network connect --alias app backend app"}, optionsSpec().getNetworkConnectCommands())
+
+	spec.Healthcheck = &Healthcheck{Disable: true, Command: "true"}
+	require.Equal(t, "docker run -d --name nginx -v /var/www:/var/www --restart always --no-healthcheck nginx", spec.GetCommand())
+}
+
+func TestPortMapping(t *testing.T) {
+	for _, m := range []PortMapping{
+		{HostIP: "::1", HostPort: 8080, ContainerPort: 80},
+		{HostIP: "[::1]", HostPort: 8080, ContainerPort: 80},
+	} {
+		require.Equal(t, "[::1]:8080:80/tcp", m.String())
+		require.Equal(t, "::1:8080:80/tcp", m.key())
+	}
+	require.Equal(t, "127.0.0.1::53/udp", PortMapping{HostIP: "127.0.0.1", ContainerPort: 53, Protocol: "udp"}.String())
+}
+
+func TestParseEnvFile(t *testing.T) {
+	env := parseEnvFile("# comment\n\nDB_HOST=db\nPASSTHROUGH\nURL=http://x?a=b\n")
+	require.Equal(t, map[string]string{"DB_HOST": "db", "URL": "http://x?a=b"}, env)
+}
+
+func TestMatchesInspect(t *testing.T) {
+	var inspect dockerInspect
+	require.NoError(t, json.Unmarshal(inspectJSON, &inspect))
+	spec := ContainerSpec{
+		Image:  "nginx",
+		Name:   "nginx",
+		Mounts: map[string]string{"/tmp/docker-nginx": "/tmp/docker-nginx"},
+	}
+	nginxDefaults := containerDefaults{
+		Image:     Config{Env: inspect.Config.Env, Labels: inspect.Config.Labels},
+		LogConfig: LogConfig{Type: "json-file"},
+	}
+	require.True(t, spec.matchesInspect(inspect, nginxDefaults, nil))
+	spec.Restart = true
+	require.False(t, spec.matchesInspect(inspect, nginxDefaults, nil))
+
+	inspect = dockerInspect{}
+	require.NoError(t, json.Unmarshal(inspectOptionsJSON, &inspect))
+	defaults := optionsDefaults()
+	fileEnv := map[string]string{"DB_HOST": "db"}
+	spec = optionsSpec()
+	require.True(t, spec.matchesInspect(inspect, defaults, fileEnv))
+	require.False(t, spec.matchesInspect(inspect, defaults, map[string]string{"DB_HOST": "db2"}))
+	require.False(t, spec.matchesInspect(inspect, defaults, nil))
+
+	// the log options of the daemon config are copied into the container
+	spec.LogOptions = nil
+	require.False(t, spec.matchesInspect(inspect, defaults, fileEnv))
+	defaults.LogConfig.Config = map[string]string{"max-size": "10m", "max-file": "3"}
+	require.True(t, spec.matchesInspect(inspect, defaults, fileEnv))
+	spec.LogOptions = map[string]string{"max-size": "10m"}
+	require.True(t, spec.matchesInspect(inspect, defaults, fileEnv))
+	spec.LogDriver = ""
+	require.True(t, spec.matchesInspect(inspect, defaults, fileEnv))
+	defaults.LogConfig.Type = "journald"
+	require.False(t, spec.matchesInspect(inspect, defaults, fileEnv))
+	defaults = optionsDefaults()
+	spec = optionsSpec()
+
+	// a disabled healthcheck is stored as NONE
+	spec.Healthcheck = &Healthcheck{Disable: true}
+	require.False(t, spec.matchesInspect(inspect, defaults, fileEnv))
+	health := inspect.Config.Healthcheck
+	inspect.Config.Healthcheck = &HealthConfig{Test: []string{"NONE"}}
+	require.True(t, spec.matchesInspect(inspect, defaults, fileEnv))
+	inspect.Config.Healthcheck = health
+	spec.Healthcheck = optionsSpec().Healthcheck
+
+	// the command is split like the shell of the instance splits it
+	inspect.Config.Cmd = []string{"serve", "--name", "my app"}
+	spec.Command = `serve --name "my app"`
+	require.True(t, spec.matchesInspect(inspect, defaults, fileEnv))
+	spec.Command = "serve --name my app"
+	require.False(t, spec.matchesInspect(inspect, defaults, fileEnv))
+	inspect.Config.Cmd = []string{"serve", "--port", "8080"}
+	spec.Command = "serve --port 8080"
+
+	// arguments are compared without splitting them
+	spec.Args = []string{"serve", "--port", "8080"}
+	require.True(t, spec.matchesInspect(inspect, defaults, fileEnv))
+	spec.Args = []string{"serve", "--port 8080"}
+	require.False(t, spec.matchesInspect(inspect, defaults, fileEnv))
+	require.Contains(t, spec.GetCommand(), " ghcr.io/example/app:1.2.3 serve '--port 8080'")
+
+	for name, modify := range map[string]func(*ContainerSpec){
+		"image":              func(s *ContainerSpec) { s.Image = "ghcr.io/example/app:1.2.4" },
+		"volume":             func(s *ContainerSpec) { s.Volumes = nil },
+		"port":               func(s *ContainerSpec) { s.Ports[0].HostPort = 8081 },
+		"env":                func(s *ContainerSpec) { s.Env["LOG_LEVEL"] = "info" },
+		"label":              func(s *ContainerSpec) { s.Labels["traefik.enable"] = "false" },
+		"network":            func(s *ContainerSpec) { s.Networks = s.Networks[:1] },
+		"alias":              func(s *ContainerSpec) { s.Networks[1].Aliases = []string{"api"} },
+		"user":               func(s *ContainerSpec) { s.User = "root" },
+		"workdir":            func(s *ContainerSpec) { s.WorkDir = "/" },
+		"entrypoint":         func(s *ContainerSpec) { s.Entrypoint = "/bin/sh" },
+		"restart":            func(s *ContainerSpec) { s.RestartMaxRetries = 3 },
+		"memory":             func(s *ContainerSpec) { s.Resources.MemoryBytes = 0 },
+		"cpus":               func(s *ContainerSpec) { s.Resources.CPUs = 2 },
+		"pids":               func(s *ContainerSpec) { s.Resources.PidsLimit = 0 },
+		"capability":         func(s *ContainerSpec) { s.CapAdd = append(s.CapAdd, "SYS_ADMIN") },
+		"privileged":         func(s *ContainerSpec) { s.Privileged = true },
+		"device":             func(s *ContainerSpec) { s.Devices[0].Permissions = "r" },
+		"log driver":         func(s *ContainerSpec) { s.LogDriver = "journald" },
+		"log option":         func(s *ContainerSpec) { s.LogOptions["max-file"] = "5" },
+		"removed env":        func(s *ContainerSpec) { delete(s.Env, "LOG_LEVEL") },
+		"removed label":      func(s *ContainerSpec) { delete(s.Labels, "traefik.enable") },
+		"removed log option": func(s *ContainerSpec) { delete(s.LogOptions, "max-file") },
+		"healthcheck":        func(s *ContainerSpec) { s.Healthcheck.Interval = time.Minute },
+		"command":            func(s *ContainerSpec) { s.Command = "serve" },
+	} {
+		spec := optionsSpec()
+		modify(&spec)
+		require.False(t, spec.matchesInspect(inspect, defaults, fileEnv), name)
+	}
+}
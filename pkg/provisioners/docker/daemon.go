@@ -0,0 +1,255 @@
+package docker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"net/url"
+	"path"
+	"reflect"
+	"slices"
+	"strings"
+
+	"github.com/ctr2cloud/ctr2cloud/pkg/generic/compute"
+	"github.com/ctr2cloud/ctr2cloud/pkg/pipeline"
+	"github.com/ctr2cloud/ctr2cloud/pkg/provisioners/file"
+	"github.com/ctr2cloud/ctr2cloud/pkg/provisioners/service"
+	"github.com/juju/zaputil/zapctx"
+	"go.uber.org/zap"
+)
+
+var ErrInvalidDaemonConfig = errors.New("invalid daemon config")
+
+const DaemonConfigPath = "/etc/docker/daemon.json"
+
+// AddressPool is a range from which docker allocates the subnets of networks without a configured subnet
+type AddressPool struct {
+	// Base is a CIDR, e.g. 172.80.0.0/16
+	Base string `json:"base"`
+	// Size is the prefix length of the allocated subnets
+	Size int `json:"size"`
+}
+
+// DaemonConfig holds the managed keys of daemon.json, empty fields are left unchanged
+type DaemonConfig struct {
+	RegistryMirrors    []string `json:"registry-mirrors,omitempty"`
+	InsecureRegistries []string `json:"insecure-registries,omitempty"`
+	LogDriver          string   `json:"log-driver,omitempty"`
+	// LogOpts are options of the log driver, e.g. max-size and max-file to rotate json-file logs
+	LogOpts             map[string]string `json:"log-opts,omitempty"`
+	StorageDriver       string            `json:"storage-driver,omitempty"`
+	DefaultAddressPools []AddressPool     `json:"default-address-pools,omitempty"`
+}
+
+// parseDaemonConfig parses the contents of daemon.json, an empty file is an empty config
+func parseDaemonConfig(contents []byte) (map[string]any, error) {
+	config := make(map[string]any)
+	if len(strings.TrimSpace(string(contents))) == 0 {
+		return config, nil
+	}
+	err := json.Unmarshal(contents, &config)
+	if err != nil {
+		return nil, fmt.Errorf("unmarshal daemon config: %w", err)
+	}
+	return config, nil
+}
+
+// mergeDaemonConfig returns the keys of existing overridden by the keys set in config
+func mergeDaemonConfig(existing map[string]any, config DaemonConfig) (map[string]any, error) {
+	// round trip the typed config so that its values compare equal to the parsed existing ones
+	configBytes, err := json.Marshal(config)
+	if err != nil {
+		return nil, fmt.Errorf("marshal daemon config: %w", err)
+	}
+	managed, err := parseDaemonConfig(configBytes)
+	if err != nil {
+		return nil, err
+	}
+	merged := maps.Clone(existing)
+	maps.Copy(merged, managed)
+	return merged, nil
+}
+
+// validate checks the managed keys which dockerd would reject when it starts
+func (c DaemonConfig) validate() error {
+	for _, mirror := range append(slices.Clone(c.RegistryMirrors), c.InsecureRegistries...) {
+		if strings.TrimSpace(mirror) == "" {
+			return fmt.Errorf("%w: empty registry", ErrInvalidDaemonConfig)
+		}
+	}
+	for _, mirror := range c.RegistryMirrors {
+		parsed, err := url.Parse(mirror)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return fmt.Errorf("%w: registry mirror %q must be an http or https URL", ErrInvalidDaemonConfig, mirror)
+		}
+	}
+	for _, pool := range c.DefaultAddressPools {
+		_, network, err := net.ParseCIDR(pool.Base)
+		if err != nil {
+			return fmt.Errorf("%w: address pool: %w", ErrInvalidDaemonConfig, err)
+		}
+		ones, bits := network.Mask.Size()
+		if pool.Size < ones || pool.Size > bits {
+			return fmt.Errorf("%w: address pool %s can not be split into /%d subnets", ErrInvalidDaemonConfig, pool.Base, pool.Size)
+		}
+	}
+	return nil
+}
+
+// validateDaemonConfig checks the config at configPath with dockerd. Releases without --validate,
+// e.g. docker.io 20.10 in Debian bookworm, only get a check that the written file is the expected JSON object.
+func (p *Provisioner) validateDaemonConfig(ctx context.Context, configPath string, expected map[string]any) error {
+	output, err := p.CommandExecutor.ExecString(ctx, fmt.Sprintf("dockerd --validate --config-file %s 2>&1", compute.ShellQuote(configPath)))
+	if err == nil {
+		return nil
+	}
+	if !strings.Contains(output, "unknown flag") {
+		return fmt.Errorf("%w: %s", ErrInvalidDaemonConfig, strings.TrimSpace(output))
+	}
+
+	zapctx.Logger(ctx).Info("dockerd does not support --validate, only checking the JSON of the daemon config", zap.String("path", configPath))
+	fProvisioner := file.Provisioner{CommandExecutor: p.CommandExecutor}
+	contents, err := fProvisioner.GetFileContents(ctx, configPath)
+	if err != nil {
+		return fmt.Errorf("read daemon config: %w", err)
+	}
+	written, err := parseDaemonConfig(contents)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidDaemonConfig, err)
+	}
+	if !reflect.DeepEqual(written, expected) {
+		return fmt.Errorf("%w: written config does not match", ErrInvalidDaemonConfig)
+	}
+	return nil
+}
+
+// getDefaultLogConfig returns the log driver of the daemon and the log-opts of DaemonConfigPath.
+// Options passed to dockerd on the command line are not known.
+func (p *Provisioner) getDefaultLogConfig(ctx context.Context) (LogConfig, error) {
+	output, err := p.CommandExecutor.ExecString(ctx, "docker info --format '{{ .LoggingDriver }}'")
+	if err != nil {
+		return LogConfig{}, fmt.Errorf("docker info: %s: %w", strings.TrimSpace(output), err)
+	}
+	fProvisioner := file.Provisioner{CommandExecutor: p.CommandExecutor}
+	contents, err := fProvisioner.GetFileContents(ctx, DaemonConfigPath)
+	if err != nil && !errors.Is(err, file.ErrFileNotFound) {
+		return LogConfig{}, fmt.Errorf("read daemon config: %w", err)
+	}
+	var config DaemonConfig
+	if len(strings.TrimSpace(string(contents))) > 0 {
+		err = json.Unmarshal(contents, &config)
+		if err != nil {
+			return LogConfig{}, fmt.Errorf("unmarshal daemon config: %w", err)
+		}
+	}
+	return LogConfig{Type: strings.TrimSpace(output), Config: config.LogOpts}, nil
+}
+
+// restartPendingPath marks a config which was written but not yet applied by a restart of the daemon
+const restartPendingPath = DaemonConfigPath + ".restart-pending"
+
+// EnsureDaemonConfig ensures that DaemonConfigPath contains the keys set in config.
+// Other keys of the existing file are kept. The new file is validated with dockerd before
+// it replaces the existing one and the docker daemon is restarted if the config changed.
+// A failed restart is retried by the next call even though the file is already up to date.
+func (p *Provisioner) EnsureDaemonConfig(ctx context.Context, config DaemonConfig) (bool, error) {
+	logger := zapctx.Logger(ctx)
+	err := config.validate()
+	if err != nil {
+		return false, err
+	}
+	fProvisioner := file.Provisioner{CommandExecutor: p.CommandExecutor}
+
+	existing, err := fProvisioner.GetFileContents(ctx, DaemonConfigPath)
+	if err != nil && !errors.Is(err, file.ErrFileNotFound) {
+		return false, fmt.Errorf("read daemon config: %w", err)
+	}
+	current, err := parseDaemonConfig(existing)
+	if err != nil {
+		return false, err
+	}
+	merged, err := mergeDaemonConfig(current, config)
+	if err != nil {
+		return false, err
+	}
+	output, err := p.CommandExecutor.ExecString(ctx, fmt.Sprintf("if [ -e %s ]; then echo pending; fi", compute.ShellQuote(restartPendingPath)))
+	if err != nil {
+		return false, fmt.Errorf("check pending restart: %w", err)
+	}
+	restartPending := strings.TrimSpace(output) == "pending"
+
+	if existing != nil && reflect.DeepEqual(current, merged) {
+		if !restartPending {
+			logger.Debug("daemon config already up to date", zap.String("path", DaemonConfigPath))
+			return false, nil
+		}
+		logger.Info("daemon config was written but docker was not restarted yet", zap.String("path", DaemonConfigPath))
+	} else {
+		err = p.writeDaemonConfig(ctx, merged)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	manager, err := (&service.Provisioner{CommandExecutor: p.CommandExecutor}).GetManager(ctx)
+	if err != nil {
+		return true, fmt.Errorf("restart docker: %w", err)
+	}
+	logger.Debug("restarting docker to apply daemon config")
+	_, err = manager.EnsureServiceState(ctx, "docker", service.State{Active: service.ActiveStateRestarted})
+	if err != nil {
+		return true, fmt.Errorf("restart docker: %w", err)
+	}
+	_, err = fProvisioner.EnsureFileAbsent(ctx, restartPendingPath)
+	if err != nil {
+		return true, fmt.Errorf("remove restart marker: %w", err)
+	}
+	return true, nil
+}
+
+// writeDaemonConfig validates config and moves it into place, marking the restart as pending
+func (p *Provisioner) writeDaemonConfig(ctx context.Context, config map[string]any) error {
+	fProvisioner := file.Provisioner{CommandExecutor: p.CommandExecutor}
+	contents, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal daemon config: %w", err)
+	}
+	_, err = p.CommandExecutor.Exec(ctx, fmt.Sprintf("mkdir -p %s", compute.ShellQuote(path.Dir(DaemonConfigPath))))
+	if err != nil {
+		return fmt.Errorf("create daemon config directory: %w", err)
+	}
+
+	// a config which dockerd rejects would keep the daemon from starting again
+	nextPath := DaemonConfigPath + ".next"
+	_, err = fProvisioner.EnsureFileContents(ctx, nextPath, append(contents, '\n'))
+	if err != nil {
+		return fmt.Errorf("write daemon config: %w", err)
+	}
+	err = p.validateDaemonConfig(ctx, nextPath, config)
+	if err != nil {
+		_, rmErr := fProvisioner.EnsureFileAbsent(ctx, nextPath)
+		return errors.Join(err, rmErr)
+	}
+	zapctx.Logger(ctx).Debug("writing daemon config", zap.String("path", DaemonConfigPath))
+	quotedPath := compute.ShellQuote(DaemonConfigPath)
+	_, err = p.CommandExecutor.Exec(ctx, fmt.Sprintf("touch %s && mv -f %s %s", compute.ShellQuote(restartPendingPath), compute.ShellQuote(nextPath), quotedPath))
+	if err != nil {
+		return fmt.Errorf("replace daemon config: %w", err)
+	}
+	return nil
+}
+
+// EnsureDaemonConfigP is the pipeline version of EnsureDaemonConfig
+func (p *Provisioner) EnsureDaemonConfigP(config DaemonConfig) pipeline.FuncT {
+	return func(ctx *pipeline.Context) error {
+		changed, err := p.EnsureDaemonConfig(ctx, config)
+		if err != nil {
+			return err
+		}
+		ctx.SetResult(changed)
+		return nil
+	}
+}
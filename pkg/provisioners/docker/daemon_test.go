@@ -0,0 +1,57 @@
+package docker
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMergeDaemonConfig(t *testing.T) {
+	existing, err := parseDaemonConfig([]byte(`{"debug": true, "log-driver": "journald", "registry-mirrors": ["https://old.example.com"]}`))
+	require.NoError(t, err)
+
+	config := DaemonConfig{
+		RegistryMirrors:     []string{"https://mirror.example.com"},
+		LogDriver:           "json-file",
+		LogOpts:             map[string]string{"max-size": "10m", "max-file": "3"},
+		DefaultAddressPools: []AddressPool{{Base: "172.80.0.0/16", Size: 24}},
+	}
+	merged, err := mergeDaemonConfig(existing, config)
+	require.NoError(t, err)
+	require.Equal(t, map[string]any{
+		"debug":                 true,
+		"log-driver":            "json-file",
+		"log-opts":              map[string]any{"max-size": "10m", "max-file": "3"},
+		"registry-mirrors":      []any{"https://mirror.example.com"},
+		"default-address-pools": []any{map[string]any{"base": "172.80.0.0/16", "size": float64(24)}},
+	}, merged)
+	// the existing config is not modified
+	require.Equal(t, "journald", existing["log-driver"])
+
+	// merging again does not change anything
+	again, err := mergeDaemonConfig(merged, config)
+	require.NoError(t, err)
+	require.Equal(t, merged, again)
+
+	empty, err := parseDaemonConfig(nil)
+	require.NoError(t, err)
+	require.Empty(t, empty)
+	_, err = parseDaemonConfig([]byte("{"))
+	require.Error(t, err)
+}
+
+func TestDaemonConfigValidate(t *testing.T) {
+	require.NoError(t, DaemonConfig{
+		RegistryMirrors:     []string{"https://mirror.example.com"},
+		InsecureRegistries:  []string{"registry.local:5000"},
+		DefaultAddressPools: []AddressPool{{Base: "172.80.0.0/16", Size: 24}},
+	}.validate())
+	for name, config := range map[string]DaemonConfig{
+		"mirror scheme":  {RegistryMirrors: []string{"mirror.example.com"}},
+		"empty registry": {InsecureRegistries: []string{""}},
+		"pool base":      {DefaultAddressPools: []AddressPool{{Base: "172.80.0.0", Size: 24}}},
+		"pool size":      {DefaultAddressPools: []AddressPool{{Base: "172.80.0.0/16", Size: 8}}},
+	} {
+		require.ErrorIs(t, config.validate(), ErrInvalidDaemonConfig, name)
+	}
+}
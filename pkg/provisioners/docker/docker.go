@@ -3,26 +3,37 @@ package docker
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"slices"
 	"strings"
 
+	"github.com/ctr2cloud/ctr2cloud/pkg/facts"
 	"github.com/ctr2cloud/ctr2cloud/pkg/generic/compute"
 	"github.com/ctr2cloud/ctr2cloud/pkg/pipeline"
-	"github.com/ctr2cloud/ctr2cloud/pkg/provisioners/apt"
-	"github.com/ctr2cloud/ctr2cloud/pkg/provisioners/systemd"
+	"github.com/ctr2cloud/ctr2cloud/pkg/provisioners/packages"
+	"github.com/ctr2cloud/ctr2cloud/pkg/provisioners/service"
 	"github.com/juju/zaputil/zapctx"
 	"go.uber.org/zap"
 )
 
+var ErrContainerNotFound = errors.New("container not found")
+
 type Provisioner struct {
 	*compute.CommandExecutor
 }
 
 func (p *Provisioner) ensureDockerSocket(ctx context.Context) (bool, error) {
-	sProvisioner := systemd.Provisioner{CommandExecutor: p.CommandExecutor}
+	manager, err := (&service.Provisioner{CommandExecutor: p.CommandExecutor}).GetManager(ctx)
+	if err != nil {
+		return false, fmt.Errorf("ensure docker socket enabled: %w", err)
+	}
 
-	updated, err := sProvisioner.EnsureServiceEnabledNow(ctx, "docker.socket", false)
+	// docker is socket activated with systemd, other init systems start the daemon directly
+	name := "docker"
+	if manager.InitSystem() == facts.InitSystemd {
+		name = "docker.socket"
+	}
+	updated, err := manager.EnsureServiceEnabledNow(ctx, name, false)
 	if err != nil {
 		return updated, fmt.Errorf("ensure docker socket enabled: %w", err)
 	}
@@ -35,9 +46,9 @@ func (p *Provisioner) ensureDockerSocket(ctx context.Context) (bool, error) {
 }
 
 func (p *Provisioner) EnsureDockerDaemon(ctx context.Context) (bool, error) {
-	aProvisioner := apt.Provisioner{CommandExecutor: p.CommandExecutor}
+	pProvisioner := packages.Provisioner{CommandExecutor: p.CommandExecutor}
 
-	installed, err := aProvisioner.EnsurePackageInstalled(ctx, "docker.io", false)
+	installed, err := pProvisioner.EnsurePackagesInstalled(ctx, "docker.io")
 	if err != nil {
 		return false, fmt.Errorf("ensure docker.io installed: %w", err)
 	}
@@ -49,74 +60,12 @@ func (p *Provisioner) EnsureDockerDaemon(ctx context.Context) (bool, error) {
 	return installed || enabled, nil
 }
 
-type ContainerSpec struct {
-	Image   string
-	Name    string
-	Mounts  map[string]string
-	Restart bool
-	Command string
-}
-
-func (s ContainerSpec) GetCommand() string {
-	var cmd strings.Builder
-
-	cmd.WriteString(fmt.Sprintf("docker run -d --name %s", s.Name))
-
-	for hostPath, containerPath := range s.Mounts {
-		cmd.WriteString(fmt.Sprintf(" -v \"%s:%s\"", hostPath, containerPath))
-	}
-
-	if s.Restart {
-		cmd.WriteString(" --restart always")
-	}
-
-	cmd.WriteString(fmt.Sprintf(" %s", s.Image))
-
-	if s.Command != "" {
-		cmd.WriteString(fmt.Sprintf(" %s", s.Command))
-	}
-
-	return cmd.String()
-}
-
-func (s *ContainerSpec) matchesInspect(inspectRes dockerInspect) bool {
-	if inspectRes.Config.Image != s.Image {
-		return false
-	}
-
-	if inspectRes.Name != fmt.Sprintf("/%s", s.Name) {
-		return false
-	}
-
-	mountSpecSlice := make([]string, 0, len(s.Mounts))
-	for hostPath, containerPath := range s.Mounts {
-		mountSpecSlice = append(mountSpecSlice, fmt.Sprintf("%s:%s", hostPath, containerPath))
-	}
-	slices.Sort(mountSpecSlice)
-
-	mountInspectSlice := make([]string, 0, len(inspectRes.Mounts))
-	for _, mount := range inspectRes.Mounts {
-		mountInspectSlice = append(mountInspectSlice, fmt.Sprintf("%s:%s", mount.Source, mount.Destination))
-	}
-	slices.Sort(mountInspectSlice)
-	if slices.Compare(mountSpecSlice, mountInspectSlice) != 0 {
-		return false
-	}
-
-	if s.Restart && inspectRes.HostConfig.RestartPolicy.Name != "always" {
-		return false
-	}
-
-	if s.Command != "" && s.Command != strings.Join(inspectRes.Config.Cmd, " ") {
-		return false
-	}
-
-	return true
-}
-
 func (p *Provisioner) inspectContainer(ctx context.Context, name string) (dockerInspect, error) {
-	inspectResBytes, err := p.CommandExecutor.Exec(ctx, fmt.Sprintf("docker inspect -f \"{{ json . }}\" %s", name))
+	inspectResBytes, err := p.CommandExecutor.Exec(ctx, fmt.Sprintf("docker inspect -f \"{{ json . }}\" %s", compute.ShellQuote(name)))
 	if err != nil {
+		if isNoSuchObject(string(inspectResBytes)) {
+			return dockerInspect{}, fmt.Errorf("%w: %s", ErrContainerNotFound, name)
+		}
 		return dockerInspect{}, fmt.Errorf("docker inspect: %w", err)
 	}
 
@@ -129,34 +78,109 @@ func (p *Provisioner) inspectContainer(ctx context.Context, name string) (docker
 	return inspectRes, nil
 }
 
+// readEnvFiles returns the variables defined in the env files of spec
+func (p *Provisioner) readEnvFiles(ctx context.Context, spec ContainerSpec) (map[string]string, error) {
+	env := make(map[string]string)
+	for _, envFile := range spec.EnvFiles {
+		content, err := p.CommandExecutor.ExecString(ctx, fmt.Sprintf("cat %s", compute.ShellQuote(envFile)))
+		if err != nil {
+			return nil, fmt.Errorf("read env file %s: %w", envFile, err)
+		}
+		// later files override earlier ones like in docker run
+		for key, value := range parseEnvFile(content) {
+			env[key] = value
+		}
+	}
+	return env, nil
+}
+
+// logImageChange reports the digests of a container whose image tag points to a different image
+func (p *Provisioner) logImageChange(ctx context.Context, spec ContainerSpec, oldImageID string, newImage Image) {
+	oldDigest := oldImageID
+	// the old image may have been removed by a prune
+	if oldImage, err := p.InspectImage(ctx, oldImageID); err == nil {
+		oldDigest = oldImage.Digest()
+	}
+	zapctx.Logger(ctx).Info("container image changed, recreating",
+		zap.String("name", spec.Name),
+		zap.String("image", spec.Image),
+		zap.String("oldDigest", oldDigest),
+		zap.String("newDigest", newImage.Digest()),
+	)
+}
+
 // EnsureContainer ensures that a container is running with the desired spec.
-// If the container does not match the specification, it will be deleted and recreated.
+// The image is pulled according to the pull policy of spec. If the container does not match the
+// specification or runs a different image than the one the tag resolves to, it is replaced
+// according to the replace strategy of spec. A new container which exits with an error or restarts
+// right after it was created fails with its last log lines. Leftovers of an interrupted
+// ReplaceStartFirst replacement are cleaned up first.
 func (p *Provisioner) EnsureContainer(ctx context.Context, spec ContainerSpec) (bool, error) {
 	logger := zapctx.Logger(ctx)
+	fileEnv, err := p.readEnvFiles(ctx, spec)
+	if err != nil {
+		return false, err
+	}
+	loggedIn := false
+	if spec.Credentials != nil {
+		creds := *spec.Credentials
+		if creds.Registry == "" {
+			creds.Registry = ImageRegistry(spec.Image)
+		}
+		loggedIn, err = p.EnsureRegistryLogin(ctx, creds)
+		if err != nil {
+			return false, fmt.Errorf("ensure registry login: %w", err)
+		}
+	}
+	image, err := p.EnsureImage(ctx, spec.Image, spec.PullPolicy)
+	if err != nil {
+		return loggedIn, fmt.Errorf("ensure image: %w", err)
+	}
+	cleanedUp, err := p.cleanupReplacement(ctx, spec)
+	if err != nil {
+		return loggedIn || cleanedUp, err
+	}
+	changed := loggedIn || cleanedUp
 	inspectRes, err := p.inspectContainer(ctx, spec.Name)
 	if err == nil {
-		if spec.matchesInspect(inspectRes) {
+		logConfig, err := p.getDefaultLogConfig(ctx)
+		if err != nil {
+			return changed, err
+		}
+		if !spec.matchesInspect(inspectRes, containerDefaults{Image: image.Config, LogConfig: logConfig}, fileEnv) {
+			logger.Debug("container exists but does not match spec", zap.String("name", spec.Name))
+		} else if inspectRes.Image != image.ID {
+			p.logImageChange(ctx, spec, inspectRes.Image, image)
+		} else {
 			logger.Debug("container already exists with correct config", zap.String("name", spec.Name))
-			return false, nil
+			return changed, nil
 		}
-		logger.Debug("container exists but does not match spec, deleting", zap.String("name", spec.Name))
-		_, err = p.CommandExecutor.Exec(ctx, fmt.Sprintf("docker rm -f %s", spec.Name))
-		if err != nil {
 
-			return false, fmt.Errorf("delete container: %w", err)
+		switch spec.Strategy {
+		case ReplaceRecreate, "":
+		case ReplaceStartFirst:
+			// a stopped container can not cause downtime
+			if inspectRes.State.Running {
+				replaced, err := p.replaceStartFirst(ctx, spec)
+				return changed || replaced, err
+			}
+		default:
+			return changed, fmt.Errorf("%w: %s", ErrInvalidReplaceStrategy, spec.Strategy)
+		}
+		logger.Debug("deleting container", zap.String("name", spec.Name))
+		_, err = p.CommandExecutor.Exec(ctx, fmt.Sprintf("docker rm -f %s", compute.ShellQuote(spec.Name)))
+		if err != nil {
+			return changed, fmt.Errorf("delete container: %w", err)
 		}
-
 	} else {
 		logger.Debug("inspect container failed", zap.String("name", spec.Name), zap.Error(err))
 	}
 
-	cmd := spec.GetCommand()
-	logger.Debug("creating container", zap.String("cmd", cmd))
-	_, err = p.CommandExecutor.Exec(ctx, cmd)
+	err = p.createContainer(ctx, spec)
 	if err != nil {
-		return true, fmt.Errorf("create container: %w", err)
+		return true, err
 	}
-	return true, nil
+	return true, p.checkStarted(ctx, spec.Name)
 }
 
 func (p *Provisioner) EnsureContainerP(spec ContainerSpec) pipeline.FuncT {
@@ -169,3 +193,46 @@ func (p *Provisioner) EnsureContainerP(spec ContainerSpec) pipeline.FuncT {
 		return nil
 	}
 }
+
+// ListContainers returns the names of all containers, including stopped ones, which have all labels
+func (p *Provisioner) ListContainers(ctx context.Context, labels map[string]string) ([]string, error) {
+	var cmd strings.Builder
+	cmd.WriteString("docker ps -a --format '{{ .Names }}'")
+	for _, label := range sortedKeyValues(labels) {
+		cmd.WriteString(" --filter " + compute.ShellQuote("label="+label))
+	}
+	output, err := p.CommandExecutor.ExecString(ctx, cmd.String())
+	if err != nil {
+		return nil, fmt.Errorf("docker ps: %s: %w", strings.TrimSpace(output), err)
+	}
+	return strings.Fields(output), nil
+}
+
+// EnsureContainerAbsent ensures that the container name does not exist, it is killed if it is running
+func (p *Provisioner) EnsureContainerAbsent(ctx context.Context, name string) (bool, error) {
+	_, err := p.inspectContainer(ctx, name)
+	if errors.Is(err, ErrContainerNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	zapctx.Logger(ctx).Debug("deleting container", zap.String("name", name))
+	_, err = p.CommandExecutor.Exec(ctx, fmt.Sprintf("docker rm -f %s", compute.ShellQuote(name)))
+	if err != nil {
+		return false, fmt.Errorf("delete container: %w", err)
+	}
+	return true, nil
+}
+
+// EnsureContainerAbsentP is the pipeline version of EnsureContainerAbsent
+func (p *Provisioner) EnsureContainerAbsentP(name string) pipeline.FuncT {
+	return func(ctx *pipeline.Context) error {
+		changed, err := p.EnsureContainerAbsent(ctx, name)
+		if err != nil {
+			return err
+		}
+		ctx.SetResult(changed)
+		return nil
+	}
+}
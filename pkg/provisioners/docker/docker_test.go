@@ -21,6 +21,28 @@ func TestDocker(t *testing.T) {
 	test.RequireIdempotence(r, func() (bool, error) {
 		return provisioner.EnsureDockerDaemon(ctx)
 	})
+	daemonConfig := DaemonConfig{
+		LogDriver: "json-file",
+		LogOpts:   map[string]string{"max-size": "10m", "max-file": "3"},
+	}
+	test.RequireIdempotence(r, func() (bool, error) {
+		return provisioner.EnsureDaemonConfig(ctx, daemonConfig)
+	})
+	// a config written without a successful restart is applied by the next run
+	_, err = executor.Exec(ctx, "touch "+restartPendingPath)
+	r.NoError(err)
+	test.RequireIdempotence(r, func() (bool, error) {
+		return provisioner.EnsureDaemonConfig(ctx, daemonConfig)
+	})
+
+	network := NetworkSpec{Name: "web", Subnet: "172.30.0.0/24"}
+	test.RequireIdempotence(r, func() (bool, error) {
+		return provisioner.EnsureNetwork(ctx, network)
+	})
+	volume := VolumeSpec{Name: "nginx-cache", Labels: map[string]string{"app": "nginx"}}
+	test.RequireIdempotence(r, func() (bool, error) {
+		return provisioner.EnsureVolume(ctx, volume)
+	})
 
 	spec := ContainerSpec{
 		Image: "nginx",
@@ -28,9 +50,61 @@ func TestDocker(t *testing.T) {
 		Mounts: map[string]string{
 			"/var/www": "/var/www",
 		},
-		Restart: true,
+		Volumes: map[string]string{
+			volume.Name: "/var/cache/nginx",
+		},
+		Networks: []NetworkAttachment{{Name: network.Name, Aliases: []string{"www"}}},
+		Restart:  true,
 	}
 	test.RequireIdempotence(r, func() (bool, error) {
 		return provisioner.EnsureContainer(ctx, spec)
 	})
+
+	// pulling the unchanged tag again must not recreate the container
+	spec.PullPolicy = PullAlways
+	changed, err := provisioner.EnsureContainer(ctx, spec)
+	r.NoError(err)
+	r.False(changed)
+
+	spec.Strategy = ReplaceStartFirst
+	spec.Env = map[string]string{"NGINX_ENTRYPOINT_QUIET_LOGS": "1"}
+	test.RequireIdempotence(r, func() (bool, error) {
+		return provisioner.EnsureContainer(ctx, spec)
+	})
+
+	// a replacement which never becomes healthy keeps the old container
+	failing := spec
+	failing.Command = "sh -c 'exit 1'"
+	changed, err = provisioner.EnsureContainer(ctx, failing)
+	r.ErrorIs(err, ErrContainerUnhealthy)
+	r.False(changed)
+	changed, err = provisioner.EnsureContainer(ctx, spec)
+	r.NoError(err)
+	r.False(changed)
+
+	// a healthy replacement which was not renamed yet takes the declared name
+	_, err = executor.Exec(ctx, "docker rename "+spec.Name+" "+spec.Name+nextNameSuffix)
+	r.NoError(err)
+	test.RequireIdempotence(r, func() (bool, error) {
+		return provisioner.EnsureContainer(ctx, spec)
+	})
+
+	status, err := provisioner.GetContainerStatus(ctx, spec.Name)
+	r.NoError(err)
+	r.True(status.Running)
+	r.NoError(provisioner.WaitContainerRunning(ctx, spec.Name, time.Minute))
+	// a bounded follow ends on the instance and leaves the executor usable
+	_, err = provisioner.ContainerLogs(ctx, spec.Name, LogsOptions{Tail: 1, FollowFor: time.Second})
+	r.NoError(err)
+	output, err := provisioner.ExecInContainer(ctx, spec.Name, "cat", "/etc/hostname")
+	r.NoError(err)
+	r.NotEmpty(output)
+
+	// a new container which exits right away fails with its logs
+	crashing := ContainerSpec{Image: "busybox", Name: "crashing", Command: "sh -c 'echo boom; exit 3'"}
+	_, err = provisioner.EnsureContainer(ctx, crashing)
+	r.ErrorIs(err, ErrContainerNotRunning)
+	r.Contains(err.Error(), "boom")
+	_, err = provisioner.EnsureContainerAbsent(ctx, crashing.Name)
+	r.NoError(err)
 }
@@ -39,163 +39,208 @@ type State struct {
 	Error      string    `json:"Error"`
 	StartedAt  time.Time `json:"StartedAt"`
 	FinishedAt time.Time `json:"FinishedAt"`
+	// Health is only set for containers with a healthcheck
+	Health *Health `json:"Health"`
+}
+type Health struct {
+	Status        string `json:"Status"`
+	FailingStreak int    `json:"FailingStreak"`
 }
 
 type LogConfig struct {
-	Type   string `json:"Type"`
-	Config Config `json:"Config"`
+	Type   string            `json:"Type"`
+	Config map[string]string `json:"Config"`
+}
+type PortBinding struct {
+	HostIP   string `json:"HostIp"`
+	HostPort string `json:"HostPort"`
 }
-type PortBindings struct {
+
+// PortBindings maps container ports like 80/tcp to their host bindings
+type PortBindings map[string][]PortBinding
+type DeviceMapping struct {
+	PathOnHost        string `json:"PathOnHost"`
+	PathInContainer   string `json:"PathInContainer"`
+	CgroupPermissions string `json:"CgroupPermissions"`
 }
 type RestartPolicy struct {
 	Name              string `json:"Name"`
 	MaximumRetryCount int    `json:"MaximumRetryCount"`
 }
 type HostConfig struct {
-	Binds                []string      `json:"Binds"`
-	ContainerIDFile      string        `json:"ContainerIDFile"`
-	LogConfig            LogConfig     `json:"LogConfig"`
-	NetworkMode          string        `json:"NetworkMode"`
-	PortBindings         PortBindings  `json:"PortBindings"`
-	RestartPolicy        RestartPolicy `json:"RestartPolicy"`
-	AutoRemove           bool          `json:"AutoRemove"`
-	VolumeDriver         string        `json:"VolumeDriver"`
-	VolumesFrom          any           `json:"VolumesFrom"`
-	ConsoleSize          []int         `json:"ConsoleSize"`
-	CapAdd               any           `json:"CapAdd"`
-	CapDrop              any           `json:"CapDrop"`
-	CgroupnsMode         string        `json:"CgroupnsMode"`
-	DNS                  []any         `json:"Dns"`
-	DNSOptions           []any         `json:"DnsOptions"`
-	DNSSearch            []any         `json:"DnsSearch"`
-	ExtraHosts           any           `json:"ExtraHosts"`
-	GroupAdd             any           `json:"GroupAdd"`
-	IpcMode              string        `json:"IpcMode"`
-	Cgroup               string        `json:"Cgroup"`
-	Links                any           `json:"Links"`
-	OomScoreAdj          int           `json:"OomScoreAdj"`
-	PidMode              string        `json:"PidMode"`
-	Privileged           bool          `json:"Privileged"`
-	PublishAllPorts      bool          `json:"PublishAllPorts"`
-	ReadonlyRootfs       bool          `json:"ReadonlyRootfs"`
-	SecurityOpt          any           `json:"SecurityOpt"`
-	UTSMode              string        `json:"UTSMode"`
-	UsernsMode           string        `json:"UsernsMode"`
-	ShmSize              int           `json:"ShmSize"`
-	Runtime              string        `json:"Runtime"`
-	Isolation            string        `json:"Isolation"`
-	CPUShares            int           `json:"CpuShares"`
-	Memory               int           `json:"Memory"`
-	NanoCpus             int           `json:"NanoCpus"`
-	CgroupParent         string        `json:"CgroupParent"`
-	BlkioWeight          int           `json:"BlkioWeight"`
-	BlkioWeightDevice    []any         `json:"BlkioWeightDevice"`
-	BlkioDeviceReadBps   []any         `json:"BlkioDeviceReadBps"`
-	BlkioDeviceWriteBps  []any         `json:"BlkioDeviceWriteBps"`
-	BlkioDeviceReadIOps  []any         `json:"BlkioDeviceReadIOps"`
-	BlkioDeviceWriteIOps []any         `json:"BlkioDeviceWriteIOps"`
-	CPUPeriod            int           `json:"CpuPeriod"`
-	CPUQuota             int           `json:"CpuQuota"`
-	CPURealtimePeriod    int           `json:"CpuRealtimePeriod"`
-	CPURealtimeRuntime   int           `json:"CpuRealtimeRuntime"`
-	CpusetCpus           string        `json:"CpusetCpus"`
-	CpusetMems           string        `json:"CpusetMems"`
-	Devices              []any         `json:"Devices"`
-	DeviceCgroupRules    any           `json:"DeviceCgroupRules"`
-	DeviceRequests       any           `json:"DeviceRequests"`
-	MemoryReservation    int           `json:"MemoryReservation"`
-	MemorySwap           int           `json:"MemorySwap"`
-	MemorySwappiness     any           `json:"MemorySwappiness"`
-	OomKillDisable       any           `json:"OomKillDisable"`
-	PidsLimit            any           `json:"PidsLimit"`
-	Ulimits              []any         `json:"Ulimits"`
-	CPUCount             int           `json:"CpuCount"`
-	CPUPercent           int           `json:"CpuPercent"`
-	IOMaximumIOps        int           `json:"IOMaximumIOps"`
-	IOMaximumBandwidth   int           `json:"IOMaximumBandwidth"`
-	MaskedPaths          []string      `json:"MaskedPaths"`
-	ReadonlyPaths        []string      `json:"ReadonlyPaths"`
+	Binds                []string        `json:"Binds"`
+	ContainerIDFile      string          `json:"ContainerIDFile"`
+	LogConfig            LogConfig       `json:"LogConfig"`
+	NetworkMode          string          `json:"NetworkMode"`
+	PortBindings         PortBindings    `json:"PortBindings"`
+	RestartPolicy        RestartPolicy   `json:"RestartPolicy"`
+	AutoRemove           bool            `json:"AutoRemove"`
+	VolumeDriver         string          `json:"VolumeDriver"`
+	VolumesFrom          any             `json:"VolumesFrom"`
+	ConsoleSize          []int           `json:"ConsoleSize"`
+	CapAdd               []string        `json:"CapAdd"`
+	CapDrop              []string        `json:"CapDrop"`
+	CgroupnsMode         string          `json:"CgroupnsMode"`
+	DNS                  []any           `json:"Dns"`
+	DNSOptions           []any           `json:"DnsOptions"`
+	DNSSearch            []any           `json:"DnsSearch"`
+	ExtraHosts           any             `json:"ExtraHosts"`
+	GroupAdd             any             `json:"GroupAdd"`
+	IpcMode              string          `json:"IpcMode"`
+	Cgroup               string          `json:"Cgroup"`
+	Links                any             `json:"Links"`
+	OomScoreAdj          int             `json:"OomScoreAdj"`
+	PidMode              string          `json:"PidMode"`
+	Privileged           bool            `json:"Privileged"`
+	PublishAllPorts      bool            `json:"PublishAllPorts"`
+	ReadonlyRootfs       bool            `json:"ReadonlyRootfs"`
+	SecurityOpt          any             `json:"SecurityOpt"`
+	UTSMode              string          `json:"UTSMode"`
+	UsernsMode           string          `json:"UsernsMode"`
+	ShmSize              int64           `json:"ShmSize"`
+	Runtime              string          `json:"Runtime"`
+	Isolation            string          `json:"Isolation"`
+	CPUShares            int             `json:"CpuShares"`
+	Memory               int64           `json:"Memory"`
+	NanoCpus             int64           `json:"NanoCpus"`
+	CgroupParent         string          `json:"CgroupParent"`
+	BlkioWeight          int             `json:"BlkioWeight"`
+	BlkioWeightDevice    []any           `json:"BlkioWeightDevice"`
+	BlkioDeviceReadBps   []any           `json:"BlkioDeviceReadBps"`
+	BlkioDeviceWriteBps  []any           `json:"BlkioDeviceWriteBps"`
+	BlkioDeviceReadIOps  []any           `json:"BlkioDeviceReadIOps"`
+	BlkioDeviceWriteIOps []any           `json:"BlkioDeviceWriteIOps"`
+	CPUPeriod            int             `json:"CpuPeriod"`
+	CPUQuota             int             `json:"CpuQuota"`
+	CPURealtimePeriod    int             `json:"CpuRealtimePeriod"`
+	CPURealtimeRuntime   int             `json:"CpuRealtimeRuntime"`
+	CpusetCpus           string          `json:"CpusetCpus"`
+	CpusetMems           string          `json:"CpusetMems"`
+	Devices              []DeviceMapping `json:"Devices"`
+	DeviceCgroupRules    any             `json:"DeviceCgroupRules"`
+	DeviceRequests       any             `json:"DeviceRequests"`
+	MemoryReservation    int64           `json:"MemoryReservation"`
+	MemorySwap           int64           `json:"MemorySwap"`
+	MemorySwappiness     any             `json:"MemorySwappiness"`
+	OomKillDisable       any             `json:"OomKillDisable"`
+	PidsLimit            *int64          `json:"PidsLimit"`
+	Ulimits              []any           `json:"Ulimits"`
+	CPUCount             int             `json:"CpuCount"`
+	CPUPercent           int             `json:"CpuPercent"`
+	IOMaximumIOps        int             `json:"IOMaximumIOps"`
+	IOMaximumBandwidth   int             `json:"IOMaximumBandwidth"`
+	MaskedPaths          []string        `json:"MaskedPaths"`
+	ReadonlyPaths        []string        `json:"ReadonlyPaths"`
 }
 type GraphDriver struct {
 	Data any    `json:"Data"`
 	Name string `json:"Name"`
 }
 type Mounts struct {
-	Type        string `json:"Type"`
+	Type string `json:"Type"`
+	// Name is only set for volumes
+	Name        string `json:"Name"`
 	Source      string `json:"Source"`
 	Destination string `json:"Destination"`
 	Mode        string `json:"Mode"`
 	Rw          bool   `json:"RW"`
 	Propagation string `json:"Propagation"`
 }
-type Eight0TCP struct {
-}
-type ExposedPorts struct {
-	Eight0TCP Eight0TCP `json:"80/tcp"`
-}
-type Labels struct {
-	Maintainer string `json:"maintainer"`
+
+// HealthConfig durations are in nanoseconds
+type HealthConfig struct {
+	Test        []string `json:"Test"`
+	Interval    int64    `json:"Interval"`
+	Timeout     int64    `json:"Timeout"`
+	StartPeriod int64    `json:"StartPeriod"`
+	Retries     int      `json:"Retries"`
 }
 type Config struct {
-	Hostname     string       `json:"Hostname"`
-	Domainname   string       `json:"Domainname"`
-	User         string       `json:"User"`
-	AttachStdin  bool         `json:"AttachStdin"`
-	AttachStdout bool         `json:"AttachStdout"`
-	AttachStderr bool         `json:"AttachStderr"`
-	ExposedPorts ExposedPorts `json:"ExposedPorts"`
-	Tty          bool         `json:"Tty"`
-	OpenStdin    bool         `json:"OpenStdin"`
-	StdinOnce    bool         `json:"StdinOnce"`
-	Env          []string     `json:"Env"`
-	Cmd          []string     `json:"Cmd"`
-	Image        string       `json:"Image"`
-	Volumes      any          `json:"Volumes"`
-	WorkingDir   string       `json:"WorkingDir"`
-	Entrypoint   []string     `json:"Entrypoint"`
-	OnBuild      any          `json:"OnBuild"`
-	Labels       Labels       `json:"Labels"`
-	StopSignal   string       `json:"StopSignal"`
-}
-type Ports struct {
-	Eight0TCP any `json:"80/tcp"`
-}
-type Bridge struct {
-	IPAMConfig          any    `json:"IPAMConfig"`
-	Links               any    `json:"Links"`
-	Aliases             any    `json:"Aliases"`
-	MacAddress          string `json:"MacAddress"`
-	DriverOpts          any    `json:"DriverOpts"`
-	NetworkID           string `json:"NetworkID"`
-	EndpointID          string `json:"EndpointID"`
-	Gateway             string `json:"Gateway"`
-	IPAddress           string `json:"IPAddress"`
-	IPPrefixLen         int    `json:"IPPrefixLen"`
-	IPv6Gateway         string `json:"IPv6Gateway"`
-	GlobalIPv6Address   string `json:"GlobalIPv6Address"`
-	GlobalIPv6PrefixLen int    `json:"GlobalIPv6PrefixLen"`
-	DNSNames            any    `json:"DNSNames"`
-}
-type Networks struct {
-	Bridge Bridge `json:"bridge"`
+	Hostname     string              `json:"Hostname"`
+	Domainname   string              `json:"Domainname"`
+	User         string              `json:"User"`
+	AttachStdin  bool                `json:"AttachStdin"`
+	AttachStdout bool                `json:"AttachStdout"`
+	AttachStderr bool                `json:"AttachStderr"`
+	ExposedPorts map[string]struct{} `json:"ExposedPorts"`
+	Tty          bool                `json:"Tty"`
+	OpenStdin    bool                `json:"OpenStdin"`
+	StdinOnce    bool                `json:"StdinOnce"`
+	Env          []string            `json:"Env"`
+	Cmd          []string            `json:"Cmd"`
+	Image        string              `json:"Image"`
+	Volumes      any                 `json:"Volumes"`
+	WorkingDir   string              `json:"WorkingDir"`
+	Entrypoint   []string            `json:"Entrypoint"`
+	OnBuild      any                 `json:"OnBuild"`
+	Labels       map[string]string   `json:"Labels"`
+	Healthcheck  *HealthConfig       `json:"Healthcheck"`
+	StopSignal   string              `json:"StopSignal"`
+}
+type EndpointSettings struct {
+	IPAMConfig          any      `json:"IPAMConfig"`
+	Links               any      `json:"Links"`
+	Aliases             []string `json:"Aliases"`
+	MacAddress          string   `json:"MacAddress"`
+	DriverOpts          any      `json:"DriverOpts"`
+	NetworkID           string   `json:"NetworkID"`
+	EndpointID          string   `json:"EndpointID"`
+	Gateway             string   `json:"Gateway"`
+	IPAddress           string   `json:"IPAddress"`
+	IPPrefixLen         int      `json:"IPPrefixLen"`
+	IPv6Gateway         string   `json:"IPv6Gateway"`
+	GlobalIPv6Address   string   `json:"GlobalIPv6Address"`
+	GlobalIPv6PrefixLen int      `json:"GlobalIPv6PrefixLen"`
+	DNSNames            []string `json:"DNSNames"`
 }
 type NetworkSettings struct {
-	Bridge                 string   `json:"Bridge"`
-	SandboxID              string   `json:"SandboxID"`
-	SandboxKey             string   `json:"SandboxKey"`
-	Ports                  Ports    `json:"Ports"`
-	HairpinMode            bool     `json:"HairpinMode"`
-	LinkLocalIPv6Address   string   `json:"LinkLocalIPv6Address"`
-	LinkLocalIPv6PrefixLen int      `json:"LinkLocalIPv6PrefixLen"`
-	SecondaryIPAddresses   any      `json:"SecondaryIPAddresses"`
-	SecondaryIPv6Addresses any      `json:"SecondaryIPv6Addresses"`
-	EndpointID             string   `json:"EndpointID"`
-	Gateway                string   `json:"Gateway"`
-	GlobalIPv6Address      string   `json:"GlobalIPv6Address"`
-	GlobalIPv6PrefixLen    int      `json:"GlobalIPv6PrefixLen"`
-	IPAddress              string   `json:"IPAddress"`
-	IPPrefixLen            int      `json:"IPPrefixLen"`
-	IPv6Gateway            string   `json:"IPv6Gateway"`
-	MacAddress             string   `json:"MacAddress"`
-	Networks               Networks `json:"Networks"`
+	Bridge                 string                      `json:"Bridge"`
+	SandboxID              string                      `json:"SandboxID"`
+	SandboxKey             string                      `json:"SandboxKey"`
+	Ports                  PortBindings                `json:"Ports"`
+	HairpinMode            bool                        `json:"HairpinMode"`
+	LinkLocalIPv6Address   string                      `json:"LinkLocalIPv6Address"`
+	LinkLocalIPv6PrefixLen int                         `json:"LinkLocalIPv6PrefixLen"`
+	SecondaryIPAddresses   any                         `json:"SecondaryIPAddresses"`
+	SecondaryIPv6Addresses any                         `json:"SecondaryIPv6Addresses"`
+	EndpointID             string                      `json:"EndpointID"`
+	Gateway                string                      `json:"Gateway"`
+	GlobalIPv6Address      string                      `json:"GlobalIPv6Address"`
+	GlobalIPv6PrefixLen    int                         `json:"GlobalIPv6PrefixLen"`
+	IPAddress              string                      `json:"IPAddress"`
+	IPPrefixLen            int                         `json:"IPPrefixLen"`
+	IPv6Gateway            string                      `json:"IPv6Gateway"`
+	MacAddress             string                      `json:"MacAddress"`
+	Networks               map[string]EndpointSettings `json:"Networks"`
+}
+
+type IPAMConfig struct {
+	Subnet  string `json:"Subnet"`
+	Gateway string `json:"Gateway"`
+}
+type IPAM struct {
+	Driver string       `json:"Driver"`
+	Config []IPAMConfig `json:"Config"`
+}
+type NetworkContainer struct {
+	Name string `json:"Name"`
+}
+type networkInspect struct {
+	Name       string                      `json:"Name"`
+	ID         string                      `json:"Id"`
+	Driver     string                      `json:"Driver"`
+	Internal   bool                        `json:"Internal"`
+	IPAM       IPAM                        `json:"IPAM"`
+	Containers map[string]NetworkContainer `json:"Containers"`
+	Options    map[string]string           `json:"Options"`
+	Labels     map[string]string           `json:"Labels"`
+}
+
+type volumeInspect struct {
+	Name       string            `json:"Name"`
+	Driver     string            `json:"Driver"`
+	Mountpoint string            `json:"Mountpoint"`
+	Labels     map[string]string `json:"Labels"`
+	Options    map[string]string `json:"Options"`
+	Scope      string            `json:"Scope"`
 }
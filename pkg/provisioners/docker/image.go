@@ -0,0 +1,124 @@
+package docker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/ctr2cloud/ctr2cloud/pkg/generic/compute"
+	"github.com/juju/zaputil/zapctx"
+	"go.uber.org/zap"
+)
+
+var ErrImageNotFound = errors.New("image not found")
+var ErrInvalidPullPolicy = errors.New("invalid pull policy")
+
+// PullPolicy decides when the image of a container is pulled
+type PullPolicy string
+
+const (
+	// PullIfNotPresent only pulls images which are missing locally, it is the default
+	PullIfNotPresent PullPolicy = "if-not-present"
+	// PullAlways pulls the image on every run so updated tags are picked up
+	PullAlways PullPolicy = "always"
+	// PullNever fails if the image is missing locally
+	PullNever PullPolicy = "never"
+)
+
+// Image is an image in the local image store
+type Image struct {
+	// ID is the sha256 content hash of the image configuration, containers reference images by it
+	ID          string   `json:"Id"`
+	RepoTags    []string `json:"RepoTags"`
+	RepoDigests []string `json:"RepoDigests"`
+	// Config holds the defaults containers inherit from the image, e.g. Env and Labels
+	Config Config `json:"Config"`
+}
+
+// Digest returns the registry digest of the image, or the ID for images which were never pushed or pulled
+func (i Image) Digest() string {
+	for _, repoDigest := range i.RepoDigests {
+		if _, digest, ok := strings.Cut(repoDigest, "@"); ok {
+			return digest
+		}
+	}
+	return i.ID
+}
+
+// needsPull decides whether an image has to be pulled
+func needsPull(policy PullPolicy, present bool) (bool, error) {
+	switch policy {
+	case PullAlways:
+		return true, nil
+	case PullIfNotPresent, "":
+		return !present, nil
+	case PullNever:
+		return false, nil
+	default:
+		return false, fmt.Errorf("%w: %s", ErrInvalidPullPolicy, policy)
+	}
+}
+
+// InspectImage returns the local image ref, which may be a name, tag or ID
+func (p *Provisioner) InspectImage(ctx context.Context, ref string) (Image, error) {
+	output, err := p.CommandExecutor.ExecString(ctx, fmt.Sprintf("docker image inspect -f \"{{ json . }}\" %s", compute.ShellQuote(ref)))
+	if err != nil {
+		if isNoSuchObject(output) {
+			return Image{}, fmt.Errorf("%w: %s", ErrImageNotFound, ref)
+		}
+		return Image{}, fmt.Errorf("docker image inspect: %s: %w", strings.TrimSpace(output), err)
+	}
+
+	var image Image
+	err = json.Unmarshal([]byte(output), &image)
+	if err != nil {
+		return Image{}, fmt.Errorf("unmarshal image inspect: %w", err)
+	}
+	return image, nil
+}
+
+// PullImage pulls ref from its registry
+func (p *Provisioner) PullImage(ctx context.Context, ref string) error {
+	output, err := p.CommandExecutor.ExecString(ctx, fmt.Sprintf("docker pull -q %s", compute.ShellQuote(ref)))
+	if err != nil {
+		return fmt.Errorf("docker pull %s: %s: %w", ref, strings.TrimSpace(output), err)
+	}
+	return nil
+}
+
+// EnsureImage makes ref available locally according to policy and returns the resolved image
+func (p *Provisioner) EnsureImage(ctx context.Context, ref string, policy PullPolicy) (Image, error) {
+	logger := zapctx.Logger(ctx)
+	image, err := p.InspectImage(ctx, ref)
+	present := err == nil
+	if err != nil && !errors.Is(err, ErrImageNotFound) {
+		return Image{}, err
+	}
+
+	pull, err := needsPull(policy, present)
+	if err != nil {
+		return Image{}, err
+	}
+	if !pull {
+		if !present {
+			return Image{}, fmt.Errorf("%w: %s with pull policy %s", ErrImageNotFound, ref, policy)
+		}
+		return image, nil
+	}
+
+	logger.Debug("pulling image", zap.String("image", ref), zap.String("policy", string(policy)))
+	err = p.PullImage(ctx, ref)
+	if err != nil {
+		return Image{}, err
+	}
+	pulled, err := p.InspectImage(ctx, ref)
+	if err != nil {
+		return Image{}, err
+	}
+	if present && pulled.ID != image.ID {
+		logger.Debug("pulled new image", zap.String("image", ref), zap.String("oldDigest", image.Digest()), zap.String("newDigest", pulled.Digest()))
+	}
+	return pulled, nil
+}
@@ -0,0 +1,38 @@
+package docker
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNeedsPull(t *testing.T) {
+	for _, tc := range []struct {
+		policy  PullPolicy
+		present bool
+		pull    bool
+	}{
+		{PullAlways, true, true},
+		{PullIfNotPresent, true, false},
+		{PullIfNotPresent, false, true},
+		{"", false, true},
+		{PullNever, false, false},
+	} {
+		pull, err := needsPull(tc.policy, tc.present)
+		require.NoError(t, err)
+		require.Equal(t, tc.pull, pull, tc.policy)
+	}
+
+	_, err := needsPull("sometimes", true)
+	require.ErrorIs(t, err, ErrInvalidPullPolicy)
+}
+
+func TestImageDigest(t *testing.T) {
+	image := Image{
+		ID:          "sha256:5ef79149e0ec84a7a9f9284c3f91aa3c20608f8391f5445eabe92ef07dbda03c",
+		RepoDigests: []string{"nginx@sha256:447a8665cc1dab95b1ca778e162215839ccbb9189104c79d7ec3a81e14577add"},
+	}
+	require.Equal(t, "sha256:447a8665cc1dab95b1ca778e162215839ccbb9189104c79d7ec3a81e14577add", image.Digest())
+	image.RepoDigests = nil
+	require.Equal(t, image.ID, image.Digest())
+}
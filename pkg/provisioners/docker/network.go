@@ -0,0 +1,193 @@
+package docker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"strings"
+
+	"github.com/ctr2cloud/ctr2cloud/pkg/generic/compute"
+	"github.com/ctr2cloud/ctr2cloud/pkg/pipeline"
+	"github.com/juju/zaputil/zapctx"
+	"go.uber.org/zap"
+)
+
+var ErrNetworkNotFound = errors.New("network not found")
+
+// isNoSuchObject returns true if the output of docker inspect reports a missing object
+func isNoSuchObject(output string) bool {
+	return strings.Contains(strings.ToLower(output), "no such")
+}
+
+// NetworkSpec is a user defined network, containers reference it by name in ContainerSpec.Networks
+type NetworkSpec struct {
+	Name string
+	// Driver defaults to bridge
+	Driver string
+	// Subnet and Gateway are chosen by docker if empty
+	Subnet  string
+	Gateway string
+	// Internal networks have no external connectivity
+	Internal bool
+	Labels   map[string]string
+}
+
+func (s NetworkSpec) driver() string {
+	if s.Driver == "" {
+		return "bridge"
+	}
+	return s.Driver
+}
+
+func (s NetworkSpec) GetCommand() string {
+	var cmd strings.Builder
+	cmd.WriteString(fmt.Sprintf("docker network create --driver %s", compute.ShellQuote(s.driver())))
+	if s.Subnet != "" {
+		cmd.WriteString(" --subnet " + compute.ShellQuote(s.Subnet))
+	}
+	if s.Gateway != "" {
+		cmd.WriteString(" --gateway " + compute.ShellQuote(s.Gateway))
+	}
+	if s.Internal {
+		cmd.WriteString(" --internal")
+	}
+	for _, label := range sortedKeyValues(s.Labels) {
+		cmd.WriteString(" --label " + compute.ShellQuote(label))
+	}
+	cmd.WriteString(" " + compute.ShellQuote(s.Name))
+	return cmd.String()
+}
+
+func (s NetworkSpec) matchesInspect(inspectRes networkInspect) bool {
+	if inspectRes.Driver != s.driver() || inspectRes.Internal != s.Internal || !maps.Equal(s.Labels, inspectRes.Labels) {
+		return false
+	}
+	if s.Subnet == "" && s.Gateway == "" {
+		return true
+	}
+	for _, config := range inspectRes.IPAM.Config {
+		if (s.Subnet == "" || s.Subnet == config.Subnet) && (s.Gateway == "" || s.Gateway == config.Gateway) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Provisioner) inspectNetwork(ctx context.Context, name string) (networkInspect, error) {
+	output, err := p.CommandExecutor.ExecString(ctx, fmt.Sprintf("docker network inspect -f \"{{ json . }}\" %s", compute.ShellQuote(name)))
+	if err != nil {
+		if isNoSuchObject(output) {
+			return networkInspect{}, fmt.Errorf("%w: %s", ErrNetworkNotFound, name)
+		}
+		return networkInspect{}, fmt.Errorf("docker network inspect: %s: %w", strings.TrimSpace(output), err)
+	}
+
+	var inspectRes networkInspect
+	err = json.Unmarshal([]byte(output), &inspectRes)
+	if err != nil {
+		return networkInspect{}, fmt.Errorf("unmarshal network inspect: %w", err)
+	}
+	return inspectRes, nil
+}
+
+// removeNetwork disconnects all containers from the network and removes it
+func (p *Provisioner) removeNetwork(ctx context.Context, inspectRes networkInspect) error {
+	for _, container := range inspectRes.Containers {
+		_, err := p.CommandExecutor.Exec(ctx, fmt.Sprintf("docker network disconnect -f %s %s", compute.ShellQuote(inspectRes.Name), compute.ShellQuote(container.Name)))
+		if err != nil {
+			return fmt.Errorf("disconnect %s from network %s: %w", container.Name, inspectRes.Name, err)
+		}
+	}
+	_, err := p.CommandExecutor.Exec(ctx, fmt.Sprintf("docker network rm %s", compute.ShellQuote(inspectRes.Name)))
+	if err != nil {
+		return fmt.Errorf("delete network: %w", err)
+	}
+	return nil
+}
+
+// EnsureNetwork ensures that a network matching spec exists.
+// A network which does not match is recreated, its containers are disconnected and
+// will be recreated by EnsureContainer because their network is missing.
+func (p *Provisioner) EnsureNetwork(ctx context.Context, spec NetworkSpec) (bool, error) {
+	logger := zapctx.Logger(ctx)
+	inspectRes, err := p.inspectNetwork(ctx, spec.Name)
+	switch {
+	case err == nil:
+		if spec.matchesInspect(inspectRes) {
+			logger.Debug("network already exists with correct config", zap.String("name", spec.Name))
+			return false, nil
+		}
+		logger.Debug("network exists but does not match spec, deleting", zap.String("name", spec.Name), zap.Int("containers", len(inspectRes.Containers)))
+		err = p.removeNetwork(ctx, inspectRes)
+		if err != nil {
+			return false, err
+		}
+	case !errors.Is(err, ErrNetworkNotFound):
+		return false, err
+	}
+
+	cmd := spec.GetCommand()
+	logger.Debug("creating network", zap.String("cmd", cmd))
+	_, err = p.CommandExecutor.Exec(ctx, cmd)
+	if err != nil {
+		return true, fmt.Errorf("create network: %w", err)
+	}
+	return true, nil
+}
+
+// EnsureNetworkP is the pipeline version of EnsureNetwork
+func (p *Provisioner) EnsureNetworkP(spec NetworkSpec) pipeline.FuncT {
+	return func(ctx *pipeline.Context) error {
+		changed, err := p.EnsureNetwork(ctx, spec)
+		if err != nil {
+			return err
+		}
+		ctx.SetResult(changed)
+		return nil
+	}
+}
+
+// ListNetworks returns the names of all networks which have all labels
+func (p *Provisioner) ListNetworks(ctx context.Context, labels map[string]string) ([]string, error) {
+	var cmd strings.Builder
+	cmd.WriteString("docker network ls --format '{{ .Name }}'")
+	for _, label := range sortedKeyValues(labels) {
+		cmd.WriteString(" --filter " + compute.ShellQuote("label="+label))
+	}
+	output, err := p.CommandExecutor.ExecString(ctx, cmd.String())
+	if err != nil {
+		return nil, fmt.Errorf("docker network ls: %s: %w", strings.TrimSpace(output), err)
+	}
+	return strings.Fields(output), nil
+}
+
+// EnsureNetworkAbsent ensures that the network name does not exist, connected containers are disconnected
+func (p *Provisioner) EnsureNetworkAbsent(ctx context.Context, name string) (bool, error) {
+	inspectRes, err := p.inspectNetwork(ctx, name)
+	if errors.Is(err, ErrNetworkNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	zapctx.Logger(ctx).Debug("deleting network", zap.String("name", name))
+	err = p.removeNetwork(ctx, inspectRes)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// EnsureNetworkAbsentP is the pipeline version of EnsureNetworkAbsent
+func (p *Provisioner) EnsureNetworkAbsentP(name string) pipeline.FuncT {
+	return func(ctx *pipeline.Context) error {
+		changed, err := p.EnsureNetworkAbsent(ctx, name)
+		if err != nil {
+			return err
+		}
+		ctx.SetResult(changed)
+		return nil
+	}
+}
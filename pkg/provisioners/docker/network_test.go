@@ -0,0 +1,38 @@
+package docker
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNetworkSpec(t *testing.T) {
+	spec := NetworkSpec{Name: "backend", Subnet: "172.30.0.0/24", Labels: map[string]string{"app": "shop"}}
+	require.Equal(t, "docker network create --driver bridge --subnet 172.30.0.0/24 --label app=shop backend", spec.GetCommand())
+
+	var inspect networkInspect
+	require.NoError(t, json.Unmarshal([]byte(`{"Name":"backend","Driver":"bridge","Internal":false,"IPAM":{"Driver":"default","Config":[{"Subnet":"172.30.0.0/24","Gateway":"172.30.0.1"}]},"Containers":{"a1":{"Name":"api"}},"Labels":{"app":"shop"}}`), &inspect))
+	require.True(t, spec.matchesInspect(inspect))
+
+	spec.Gateway = "172.30.0.254"
+	require.False(t, spec.matchesInspect(inspect))
+	spec.Gateway = ""
+	spec.Internal = true
+	require.False(t, spec.matchesInspect(inspect))
+	spec.Internal = false
+	spec.Labels = nil
+	require.False(t, spec.matchesInspect(inspect))
+}
+
+func TestVolumeSpec(t *testing.T) {
+	spec := VolumeSpec{Name: "nfs-data", Options: map[string]string{"type": "nfs", "o": "addr=10.0.0.2,rw", "device": ":/export"}}
+	require.Equal(t, "docker volume create --driver local --opt device=:/export --opt o=addr=10.0.0.2,rw --opt type=nfs nfs-data", spec.GetCommand())
+
+	var inspect volumeInspect
+	require.NoError(t, json.Unmarshal([]byte(`{"Driver":"local","Labels":null,"Mountpoint":"/var/lib/docker/volumes/nfs-data/_data","Name":"nfs-data","Options":{"device":":/export","o":"addr=10.0.0.2,rw","type":"nfs"},"Scope":"local"}`), &inspect))
+	require.True(t, spec.matchesInspect(inspect))
+
+	spec.Labels = map[string]string{"backup": "daily"}
+	require.False(t, spec.matchesInspect(inspect))
+}
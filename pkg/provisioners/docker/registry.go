@@ -0,0 +1,191 @@
+package docker
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/ctr2cloud/ctr2cloud/pkg/generic/compute"
+	"github.com/ctr2cloud/ctr2cloud/pkg/pipeline"
+	"github.com/ctr2cloud/ctr2cloud/pkg/provisioners/file"
+	"github.com/juju/zaputil/zapctx"
+	"go.uber.org/zap"
+)
+
+// DockerHubRegistry is the key docker uses for Docker Hub in config.json
+const DockerHubRegistry = "https://index.docker.io/v1/"
+
+const dockerConfigPath = "${DOCKER_CONFIG:-$HOME/.docker}/config.json"
+
+// RegistryCredentials are used to log in to a registry
+type RegistryCredentials struct {
+	// Registry is the host of the registry, e.g. ghcr.io. For containers it defaults to the
+	// registry of the image, otherwise to Docker Hub.
+	Registry string
+	Username string
+	// Password is the password or an access token
+	Password string
+}
+
+func (c RegistryCredentials) registry() string {
+	if c.Registry == "" {
+		return DockerHubRegistry
+	}
+	return c.Registry
+}
+
+// auth returns the value docker stores in the auths section of config.json
+func (c RegistryCredentials) auth() string {
+	return base64.StdEncoding.EncodeToString([]byte(c.Username + ":" + c.Password))
+}
+
+// ImageRegistry returns the registry of an image reference, DockerHubRegistry for images without a registry
+func ImageRegistry(ref string) string {
+	first, _, ok := strings.Cut(ref, "/")
+	// like docker, the first component is only a registry if it looks like a host name
+	if !ok || (!strings.ContainsAny(first, ".:") && first != "localhost") {
+		return DockerHubRegistry
+	}
+	return first
+}
+
+type dockerConfig struct {
+	Auths map[string]struct {
+		Auth string `json:"auth"`
+	} `json:"auths"`
+	CredsStore  string            `json:"credsStore"`
+	CredHelpers map[string]string `json:"credHelpers"`
+}
+
+// credentialHelper returns the helper which keeps the credentials of registry, it is empty if they are stored in config.json
+func (c dockerConfig) credentialHelper(registry string) string {
+	if helper, ok := c.CredHelpers[registry]; ok {
+		return helper
+	}
+	return c.CredsStore
+}
+
+// helperCredentials are returned by docker-credential-<helper> get
+type helperCredentials struct {
+	Username string `json:"Username"`
+	Secret   string `json:"Secret"`
+}
+
+// getHelperCredentials returns the credentials the credential helper keeps for registry
+func (p *Provisioner) getHelperCredentials(ctx context.Context, helper, registry string) (helperCredentials, error) {
+	// the helper reads the registry from stdin
+	output, err := p.CommandExecutor.ExecString(ctx, fmt.Sprintf("printf %%s %s | %s get",
+		compute.ShellQuote(registry),
+		compute.ShellQuote("docker-credential-"+helper),
+	))
+	if err != nil {
+		return helperCredentials{}, fmt.Errorf("docker-credential-%s get %s: %s: %w", helper, registry, strings.TrimSpace(output), err)
+	}
+	var creds helperCredentials
+	err = json.Unmarshal([]byte(output), &creds)
+	if err != nil {
+		return helperCredentials{}, fmt.Errorf("unmarshal credentials of docker-credential-%s: %w", helper, err)
+	}
+	return creds, nil
+}
+
+func (p *Provisioner) getDockerConfig(ctx context.Context) (dockerConfig, error) {
+	output, err := p.CommandExecutor.ExecString(ctx, fmt.Sprintf("cat \"%s\" 2>/dev/null || echo '{}'", dockerConfigPath))
+	if err != nil {
+		return dockerConfig{}, fmt.Errorf("read docker config: %w", err)
+	}
+	var config dockerConfig
+	err = json.Unmarshal([]byte(output), &config)
+	if err != nil {
+		return dockerConfig{}, fmt.Errorf("unmarshal docker config: %w", err)
+	}
+	return config, nil
+}
+
+// EnsureRegistryLogin ensures that docker is logged in to the registry with creds.
+// The password is written to a temporary file only the user of the executor can read and passed to
+// docker login on stdin, so it is not an argument of any process. It is still sent base64 encoded
+// through the shell session of the executor.
+// Credentials kept by a credential helper are compared with the credentials the helper returns.
+func (p *Provisioner) EnsureRegistryLogin(ctx context.Context, creds RegistryCredentials) (bool, error) {
+	logger := zapctx.Logger(ctx)
+	registry := creds.registry()
+
+	config, err := p.getDockerConfig(ctx)
+	if err != nil {
+		return false, err
+	}
+	if helper := config.credentialHelper(registry); helper != "" {
+		stored, err := p.getHelperCredentials(ctx, helper, registry)
+		if err != nil {
+			// helpers fail if they have no credentials for the registry
+			logger.Debug("credential helper returned no credentials", zap.String("registry", registry), zap.Error(err))
+		} else if stored.Username == creds.Username && stored.Secret == creds.Password {
+			logger.Debug("already logged in to registry", zap.String("registry", registry), zap.String("helper", helper))
+			return false, nil
+		}
+	} else if config.Auths[registry].Auth == creds.auth() {
+		logger.Debug("already logged in to registry", zap.String("registry", registry))
+		return false, nil
+	}
+
+	logger.Debug("logging in to registry", zap.String("registry", registry), zap.String("username", creds.Username))
+	// mktemp creates the file with mode 0600
+	output, err := p.CommandExecutor.ExecString(ctx, "mktemp")
+	if err != nil {
+		return false, fmt.Errorf("create password file: %s: %w", strings.TrimSpace(output), err)
+	}
+	passwordPath := strings.TrimSpace(output)
+	quotedPasswordPath := compute.ShellQuote(passwordPath)
+	fProvisioner := file.Provisioner{CommandExecutor: p.CommandExecutor}
+	err = fProvisioner.WriteChunks(ctx, passwordPath, strings.NewReader(creds.Password))
+	if err != nil {
+		_, _ = p.CommandExecutor.Exec(ctx, "rm -f "+quotedPasswordPath)
+		return false, fmt.Errorf("write password file: %w", err)
+	}
+	// the file is removed before the exit status of docker login is returned
+	cmd := fmt.Sprintf("docker login --username %s --password-stdin %s < %s 2>&1; status=$?; rm -f %s; [ $status -eq 0 ]",
+		compute.ShellQuote(creds.Username),
+		compute.ShellQuote(registry),
+		quotedPasswordPath,
+		quotedPasswordPath,
+	)
+	output, err = p.CommandExecutor.ExecString(ctx, cmd)
+	if err != nil {
+		return false, fmt.Errorf("docker login %s: %s: %w", registry, strings.TrimSpace(output), err)
+	}
+	return true, nil
+}
+
+// EnsureRegistryLoginP is the pipeline version of EnsureRegistryLogin
+func (p *Provisioner) EnsureRegistryLoginP(creds RegistryCredentials) pipeline.FuncT {
+	return func(ctx *pipeline.Context) error {
+		changed, err := p.EnsureRegistryLogin(ctx, creds)
+		if err != nil {
+			return err
+		}
+		ctx.SetResult(changed)
+		return nil
+	}
+}
+
+// EnsureRegistryLogout ensures that no credentials for registry are stored in config.json
+func (p *Provisioner) EnsureRegistryLogout(ctx context.Context, registry string) (bool, error) {
+	if registry == "" {
+		registry = DockerHubRegistry
+	}
+	config, err := p.getDockerConfig(ctx)
+	if err != nil {
+		return false, err
+	}
+	if _, ok := config.Auths[registry]; !ok {
+		return false, nil
+	}
+	output, err := p.CommandExecutor.ExecString(ctx, fmt.Sprintf("docker logout %s", compute.ShellQuote(registry)))
+	if err != nil {
+		return false, fmt.Errorf("docker logout %s: %s: %w", registry, strings.TrimSpace(output), err)
+	}
+	return true, nil
+}
@@ -0,0 +1,31 @@
+package docker
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestImageRegistry(t *testing.T) {
+	require.Equal(t, DockerHubRegistry, ImageRegistry("nginx"))
+	require.Equal(t, DockerHubRegistry, ImageRegistry("library/nginx:latest"))
+	require.Equal(t, "ghcr.io", ImageRegistry("ghcr.io/example/app:1.2.3"))
+	require.Equal(t, "registry.local:5000", ImageRegistry("registry.local:5000/app"))
+	require.Equal(t, "localhost", ImageRegistry("localhost/app"))
+}
+
+func TestRegistryCredentials(t *testing.T) {
+	creds := RegistryCredentials{Username: "user", Password: "secret"}
+	require.Equal(t, DockerHubRegistry, creds.registry())
+	require.Equal(t, "dXNlcjpzZWNyZXQ=", creds.auth())
+
+	var config dockerConfig
+	require.NoError(t, json.Unmarshal([]byte(`{"auths":{"ghcr.io":{"auth":"dXNlcjpzZWNyZXQ="},"quay.io":{}},"credHelpers":{"quay.io":"pass"}}`), &config))
+	require.Equal(t, creds.auth(), config.Auths["ghcr.io"].Auth)
+	require.Equal(t, "", config.credentialHelper("ghcr.io"))
+	require.Equal(t, "pass", config.credentialHelper("quay.io"))
+	config.CredsStore = "secretservice"
+	require.Equal(t, "secretservice", config.credentialHelper("ghcr.io"))
+	require.Equal(t, "pass", config.credentialHelper("quay.io"))
+}
@@ -0,0 +1,159 @@
+package docker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/ctr2cloud/ctr2cloud/pkg/generic/compute"
+	"github.com/juju/zaputil/zapctx"
+	"github.com/samber/lo"
+	"go.uber.org/zap"
+)
+
+var ErrInvalidReplaceStrategy = errors.New("invalid replace strategy")
+
+// ReplaceStrategy decides how a container which does not match its spec is replaced
+type ReplaceStrategy string
+
+const (
+	// ReplaceRecreate removes the old container before the new one is created, it is the default
+	ReplaceRecreate ReplaceStrategy = "recreate"
+	// ReplaceStartFirst starts the new container under a temporary name and waits until it is healthy
+	// before the old container is removed and the new one is renamed. If the new container does not
+	// become healthy it is removed and the old container keeps running. Containers with fixed host
+	// ports are stopped before their replacement starts, so they are not replaced without downtime.
+	ReplaceStartFirst ReplaceStrategy = "start-first"
+)
+
+const (
+	// nextNameSuffix is appended to the name of a container while it replaces the old one
+	nextNameSuffix = "-next"
+	// prevNameSuffix is appended to the name of the old container until the new one took its name
+	prevNameSuffix = "-prev"
+)
+
+// createContainer runs the container of spec and connects it to its additional networks
+func (p *Provisioner) createContainer(ctx context.Context, spec ContainerSpec) error {
+	logger := zapctx.Logger(ctx)
+	cmd := spec.GetCommand()
+	logger.Debug("creating container", zap.String("cmd", cmd))
+	_, err := p.CommandExecutor.Exec(ctx, cmd)
+	if err != nil {
+		return fmt.Errorf("create container: %w", err)
+	}
+	for _, cmd := range spec.getNetworkConnectCommands() {
+		logger.Debug("connecting container", zap.String("cmd", cmd))
+		_, err = p.CommandExecutor.Exec(ctx, cmd)
+		if err != nil {
+			return fmt.Errorf("connect container: %w", err)
+		}
+	}
+	return nil
+}
+
+// cleanupReplacement removes the leftovers of an interrupted ReplaceStartFirst replacement of spec.
+// A new container which was healthy but not renamed yet takes the declared name if it is free.
+func (p *Provisioner) cleanupReplacement(ctx context.Context, spec ContainerSpec) (bool, error) {
+	logger := zapctx.Logger(ctx)
+	nextName := spec.Name + nextNameSuffix
+	prevName := spec.Name + prevNameSuffix
+	names, err := p.ListContainers(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	changed := false
+	if slices.Contains(names, nextName) && !slices.Contains(names, spec.Name) {
+		logger.Info("renaming container of an interrupted replacement", zap.String("name", spec.Name))
+		_, err = p.CommandExecutor.Exec(ctx, fmt.Sprintf("docker rename %s %s", compute.ShellQuote(nextName), compute.ShellQuote(spec.Name)))
+		if err != nil {
+			return false, fmt.Errorf("rename new container: %w", err)
+		}
+		changed = true
+	}
+	for _, leftover := range []string{nextName, prevName} {
+		if !slices.Contains(names, leftover) || (leftover == nextName && changed) {
+			continue
+		}
+		logger.Debug("deleting container of an interrupted replacement", zap.String("name", leftover))
+		_, err = p.CommandExecutor.Exec(ctx, fmt.Sprintf("docker rm -f %s", compute.ShellQuote(leftover)))
+		if err != nil {
+			return changed, fmt.Errorf("delete container: %w", err)
+		}
+		changed = true
+	}
+	return changed, nil
+}
+
+// replaceStartFirst replaces the running container of spec with ReplaceStartFirst.
+// The old container is renamed aside before the new one takes its name and is only removed last,
+// so that every failure before can be rolled back. Fixed host ports can not be bound by both
+// containers, in that case the old container is stopped before the new one starts and started
+// again on rollback, which causes a downtime. The system is unchanged if the replacement was rolled back.
+// Leftovers of interrupted replacements have to be removed with cleanupReplacement before.
+func (p *Provisioner) replaceStartFirst(ctx context.Context, spec ContainerSpec) (bool, error) {
+	logger := zapctx.Logger(ctx)
+	quotedName := compute.ShellQuote(spec.Name)
+	next := spec
+	next.Name = spec.Name + nextNameSuffix
+	quotedNextName := compute.ShellQuote(next.Name)
+	prevName := spec.Name + prevNameSuffix
+	quotedPrevName := compute.ShellQuote(prevName)
+
+	stopOld := lo.ContainsBy(spec.Ports, func(m PortMapping) bool { return m.HostPort != 0 })
+	if stopOld {
+		logger.Info("stopping old container before its replacement starts to free its host ports", zap.String("name", spec.Name))
+		_, err := p.CommandExecutor.Exec(ctx, fmt.Sprintf("docker stop %s", quotedName))
+		if err != nil {
+			return false, fmt.Errorf("stop old container: %w", err)
+		}
+	}
+
+	oldRenamed := false
+	rollback := func(cause error) (bool, error) {
+		logger.Debug("rolling back container replacement", zap.String("name", spec.Name), zap.Error(cause))
+		_, err := p.CommandExecutor.Exec(ctx, fmt.Sprintf("docker rm -f %s", quotedNextName))
+		if err != nil {
+			return true, errors.Join(cause, fmt.Errorf("delete new container: %w", err))
+		}
+		if oldRenamed {
+			_, err = p.CommandExecutor.Exec(ctx, fmt.Sprintf("docker rename %s %s", quotedPrevName, quotedName))
+			if err != nil {
+				return true, errors.Join(cause, fmt.Errorf("rename old container back: %w", err))
+			}
+		}
+		if stopOld {
+			_, err = p.CommandExecutor.Exec(ctx, fmt.Sprintf("docker start %s", quotedName))
+			if err != nil {
+				return true, errors.Join(cause, fmt.Errorf("start old container: %w", err))
+			}
+		}
+		return false, fmt.Errorf("replacement rolled back: %w", cause)
+	}
+
+	err := p.createContainer(ctx, next)
+	if err != nil {
+		return rollback(err)
+	}
+	err = p.WaitContainerHealthy(ctx, next.Name, spec.HealthTimeout)
+	if err != nil {
+		return rollback(err)
+	}
+
+	logger.Debug("new container healthy, replacing old container", zap.String("name", spec.Name))
+	_, err = p.CommandExecutor.Exec(ctx, fmt.Sprintf("docker rename %s %s", quotedName, quotedPrevName))
+	if err != nil {
+		return rollback(fmt.Errorf("rename old container: %w", err))
+	}
+	oldRenamed = true
+	_, err = p.CommandExecutor.Exec(ctx, fmt.Sprintf("docker rename %s %s", quotedNextName, quotedName))
+	if err != nil {
+		return rollback(fmt.Errorf("rename new container: %w", err))
+	}
+	_, err = p.CommandExecutor.Exec(ctx, fmt.Sprintf("docker rm -f %s", quotedPrevName))
+	if err != nil {
+		return true, fmt.Errorf("delete old container: %w", err)
+	}
+	return true, nil
+}
@@ -0,0 +1,289 @@
+package docker
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/ctr2cloud/ctr2cloud/pkg/generic/compute"
+	"github.com/juju/zaputil/zapctx"
+	"github.com/samber/lo"
+	"go.uber.org/zap"
+)
+
+var ErrContainerUnhealthy = errors.New("container unhealthy")
+var ErrContainerNotRunning = errors.New("container not running")
+
+const (
+	DefaultHealthTimeout  = 60 * time.Second
+	DefaultHealthInterval = time.Second
+	DefaultLogLines       = 50
+	// StablePeriod is the time a container has to keep running to count as running,
+	// it also applies to the health of containers without a healthcheck
+	StablePeriod = 5 * time.Second
+	// StartupCheckDelay is the time after which EnsureContainer checks that a new container did not exit
+	StartupCheckDelay = 2 * time.Second
+)
+
+// ContainerStatus is the runtime state of a container
+type ContainerStatus struct {
+	Name string
+	ID   string
+	// ImageID is the ID of the image the container was created from
+	ImageID string
+	// Status is one of created, running, paused, restarting, removing, exited or dead
+	Status       string
+	Running      bool
+	Restarting   bool
+	OOMKilled    bool
+	ExitCode     int
+	RestartCount int
+	StartedAt    time.Time
+	FinishedAt   time.Time
+	// Health is empty for containers without a healthcheck, otherwise starting, healthy or unhealthy
+	Health string
+}
+
+func newContainerStatus(inspectRes dockerInspect) ContainerStatus {
+	status := ContainerStatus{
+		Name:         strings.TrimPrefix(inspectRes.Name, "/"),
+		ID:           inspectRes.ID,
+		ImageID:      inspectRes.Image,
+		Status:       inspectRes.State.Status,
+		Running:      inspectRes.State.Running,
+		Restarting:   inspectRes.State.Restarting,
+		OOMKilled:    inspectRes.State.OOMKilled,
+		ExitCode:     inspectRes.State.ExitCode,
+		RestartCount: inspectRes.RestartCount,
+		StartedAt:    inspectRes.State.StartedAt,
+		FinishedAt:   inspectRes.State.FinishedAt,
+	}
+	if inspectRes.State.Health != nil {
+		status.Health = inspectRes.State.Health.Status
+	}
+	return status
+}
+
+// GetContainerStatus returns the status of the container name, ErrContainerNotFound if it does not exist
+func (p *Provisioner) GetContainerStatus(ctx context.Context, name string) (ContainerStatus, error) {
+	inspectRes, err := p.inspectContainer(ctx, name)
+	if err != nil {
+		return ContainerStatus{}, err
+	}
+	return newContainerStatus(inspectRes), nil
+}
+
+// containerHealth evaluates the status of a container. failed is set if the container will not become healthy.
+func containerHealth(status ContainerStatus) (running, healthy, failed bool, reason string) {
+	switch {
+	case status.Status == "exited" || status.Status == "dead":
+		reason := fmt.Sprintf("container %s with exit code %d", status.Status, status.ExitCode)
+		if status.OOMKilled {
+			reason += " after running out of memory"
+		}
+		return false, false, true, reason
+	case status.Restarting:
+		return false, false, false, fmt.Sprintf("container is restarting after %d restarts", status.RestartCount)
+	case !status.Running:
+		return false, false, false, "container is " + status.Status
+	case status.Health == "":
+		return true, false, false, "container has no healthcheck"
+	case status.Health == "healthy":
+		return true, true, false, ""
+	case status.Health == "unhealthy":
+		return true, false, true, "healthcheck failed"
+	default:
+		return true, false, false, "health is " + status.Health
+	}
+}
+
+// waitContainer polls the container name until it is running, or healthy if requireHealthy is set.
+// Containers without a healthcheck and running containers have to keep running for StablePeriod.
+func (p *Provisioner) waitContainer(ctx context.Context, name string, timeout time.Duration, requireHealthy bool) error {
+	logger := zapctx.Logger(ctx)
+	if timeout <= 0 {
+		timeout = DefaultHealthTimeout
+	}
+	deadline := time.Now().Add(timeout)
+	sentinel := ErrContainerNotRunning
+	if requireHealthy {
+		sentinel = ErrContainerUnhealthy
+	}
+	failedError := func(reason string) error {
+		return fmt.Errorf("%w: %s: %s\n%s", sentinel, name, reason, p.GetContainerLogs(ctx, name, DefaultLogLines))
+	}
+
+	var runningSince time.Time
+	var startedAt time.Time
+	for {
+		status, err := p.GetContainerStatus(ctx, name)
+		if err != nil {
+			return failedError(err.Error())
+		}
+		running, healthy, failed, reason := containerHealth(status)
+		if requireHealthy && failed || !requireHealthy && !running && failed {
+			return failedError(reason)
+		}
+		if requireHealthy && healthy {
+			logger.Debug("container healthy", zap.String("name", name))
+			return nil
+		}
+		if running && (!requireHealthy || status.Health == "") {
+			// a restart resets the stable period
+			if runningSince.IsZero() || !status.StartedAt.Equal(startedAt) {
+				runningSince = time.Now()
+				startedAt = status.StartedAt
+			}
+			if time.Since(runningSince) >= StablePeriod {
+				logger.Debug("container running", zap.String("name", name))
+				return nil
+			}
+			reason = "container is running for less than " + StablePeriod.String()
+		}
+		logger.Debug("waiting for container", zap.String("name", name), zap.String("reason", reason))
+
+		if time.Now().Add(DefaultHealthInterval).After(deadline) {
+			return failedError(fmt.Sprintf("not ready after %s: %s", timeout, reason))
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(DefaultHealthInterval):
+		}
+	}
+}
+
+// WaitContainerRunning waits until the container name has been running without restarts for StablePeriod.
+// The error contains the logs of the container if it exits or does not keep running within the timeout.
+func (p *Provisioner) WaitContainerRunning(ctx context.Context, name string, timeout time.Duration) error {
+	return p.waitContainer(ctx, name, timeout, false)
+}
+
+// WaitContainerHealthy waits until the healthcheck of the container succeeds.
+// Containers without a healthcheck are healthy once they kept running for StablePeriod.
+// The error contains the logs of the container if it does not become healthy within the timeout.
+func (p *Provisioner) WaitContainerHealthy(ctx context.Context, name string, timeout time.Duration) error {
+	return p.waitContainer(ctx, name, timeout, true)
+}
+
+// checkStarted fails with the logs of the container if it exited with an error or restarted shortly after creation.
+// Containers which exit with code 0 are considered one-shot jobs.
+func (p *Provisioner) checkStarted(ctx context.Context, name string) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(StartupCheckDelay):
+	}
+	status, err := p.GetContainerStatus(ctx, name)
+	if err != nil {
+		return err
+	}
+	reason := ""
+	switch {
+	case status.OOMKilled:
+		reason = "container ran out of memory"
+	case !status.Running && status.ExitCode != 0:
+		reason = fmt.Sprintf("container %s with exit code %d", status.Status, status.ExitCode)
+	case status.RestartCount > 0:
+		reason = fmt.Sprintf("container restarted %d times", status.RestartCount)
+	default:
+		return nil
+	}
+	return fmt.Errorf("%w: %s: %s\n%s", ErrContainerNotRunning, name, reason, p.GetContainerLogs(ctx, name, DefaultLogLines))
+}
+
+type LogsOptions struct {
+	// Tail limits the output to the last lines, all lines are returned if it is zero
+	Tail int
+	// Since limits the output to lines written within this duration before now
+	Since      time.Duration
+	Timestamps bool
+	// FollowFor keeps streaming new lines for this duration, rounded up to whole seconds.
+	// The follow is bounded on the instance because cancelling the context does not stop
+	// docker logs, it would keep running in the shell session of the executor.
+	FollowFor time.Duration
+}
+
+// command returns the docker logs command for the container name
+func (o LogsOptions) command(name string) string {
+	var cmd strings.Builder
+	if o.FollowFor > 0 {
+		seconds := int64((o.FollowFor + time.Second - 1) / time.Second)
+		cmd.WriteString(fmt.Sprintf("timeout %d ", seconds))
+	}
+	cmd.WriteString("docker logs")
+	if o.Tail > 0 {
+		cmd.WriteString(fmt.Sprintf(" --tail %d", o.Tail))
+	}
+	if o.Since > 0 {
+		cmd.WriteString(" --since " + o.Since.String())
+	}
+	if o.Timestamps {
+		cmd.WriteString(" --timestamps")
+	}
+	if o.FollowFor > 0 {
+		cmd.WriteString(" --follow")
+	}
+	cmd.WriteString(" " + compute.ShellQuote(name) + " 2>&1")
+	return cmd.String()
+}
+
+// timeoutExitCode is returned by timeout if it stopped the command
+const timeoutExitCode = 124
+
+// StreamContainerLogs writes the stdout and stderr of the container name to w while they are read from the instance.
+// A follow can not be cancelled mid-stream, it ends after opts.FollowFor or when the container stops.
+func (p *Provisioner) StreamContainerLogs(ctx context.Context, name string, opts LogsOptions, w io.Writer) error {
+	var err error
+	for res := range p.CommandExecutor.ExecStream(ctx, opts.command(name)) {
+		// keep draining the channel so the executor can finish the command
+		if res.Error != nil {
+			err = res.Error
+		}
+		if res.Data != nil && err == nil {
+			_, err = w.Write(res.Data)
+		}
+	}
+	var cErr compute.CommandExecutorError
+	if opts.FollowFor > 0 && errors.As(err, &cErr) && cErr.Code == timeoutExitCode {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("docker logs %s: %w", name, err)
+	}
+	return nil
+}
+
+// ContainerLogs returns the stdout and stderr of the container name
+func (p *Provisioner) ContainerLogs(ctx context.Context, name string, opts LogsOptions) (string, error) {
+	var buf bytes.Buffer
+	err := p.StreamContainerLogs(ctx, name, opts, &buf)
+	return buf.String(), err
+}
+
+// GetContainerLogs returns the last lines of the output of a container.
+// Errors are included in the output, so that it can always be attached to an error.
+func (p *Provisioner) GetContainerLogs(ctx context.Context, name string, lines int) string {
+	if lines <= 0 {
+		lines = DefaultLogLines
+	}
+	output, err := p.ContainerLogs(ctx, name, LogsOptions{Tail: lines})
+	if err != nil {
+		output += "\n" + err.Error()
+	}
+	return fmt.Sprintf("--- docker logs %s ---\n%s", name, strings.TrimSpace(output))
+}
+
+// ExecInContainer runs args in the running container name and returns the combined output
+func (p *Provisioner) ExecInContainer(ctx context.Context, name string, args ...string) (string, error) {
+	quotedArgs := lo.Map(args, func(arg string, _ int) string { return compute.ShellQuote(arg) })
+	output, err := p.CommandExecutor.ExecString(ctx, fmt.Sprintf("docker exec %s %s 2>&1", compute.ShellQuote(name), strings.Join(quotedArgs, " ")))
+	if err != nil {
+		return output, fmt.Errorf("docker exec in %s: %s: %w", name, strings.TrimSpace(output), err)
+	}
+	return output, nil
+}
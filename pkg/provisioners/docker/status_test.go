@@ -0,0 +1,55 @@
+package docker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestContainerHealth(t *testing.T) {
+	for name, tc := range map[string]struct {
+		state                    State
+		running, healthy, failed bool
+	}{
+		"exited":     {State{Status: "exited", ExitCode: 1}, false, false, true},
+		"restarting": {State{Status: "restarting", Restarting: true}, false, false, false},
+		"created":    {State{Status: "created"}, false, false, false},
+		"no check":   {State{Status: "running", Running: true}, true, false, false},
+		"starting":   {State{Status: "running", Running: true, Health: &Health{Status: "starting"}}, true, false, false},
+		"healthy":    {State{Status: "running", Running: true, Health: &Health{Status: "healthy"}}, true, true, false},
+		"unhealthy":  {State{Status: "running", Running: true, Health: &Health{Status: "unhealthy", FailingStreak: 3}}, true, false, true},
+	} {
+		running, healthy, failed, _ := containerHealth(newContainerStatus(dockerInspect{State: tc.state}))
+		require.Equal(t, tc.running, running, name)
+		require.Equal(t, tc.healthy, healthy, name)
+		require.Equal(t, tc.failed, failed, name)
+	}
+}
+
+func TestNewContainerStatus(t *testing.T) {
+	startedAt := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	status := newContainerStatus(dockerInspect{
+		ID:           "abc",
+		Name:         "/web",
+		Image:        "sha256:def",
+		RestartCount: 2,
+		State:        State{Status: "running", Running: true, StartedAt: startedAt, Health: &Health{Status: "starting"}},
+	})
+	require.Equal(t, ContainerStatus{
+		Name:         "web",
+		ID:           "abc",
+		ImageID:      "sha256:def",
+		Status:       "running",
+		Running:      true,
+		RestartCount: 2,
+		StartedAt:    startedAt,
+		Health:       "starting",
+	}, status)
+}
+
+func TestLogsOptions(t *testing.T) {
+	require.Equal(t, "docker logs web 2>&1", LogsOptions{}.command("web"))
+	require.Equal(t, "timeout 2 docker logs --tail 20 --since 5m0s --timestamps --follow web 2>&1",
+		LogsOptions{Tail: 20, Since: 5 * time.Minute, Timestamps: true, FollowFor: 1500 * time.Millisecond}.command("web"))
+}
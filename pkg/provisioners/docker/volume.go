@@ -0,0 +1,143 @@
+package docker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"strings"
+
+	"github.com/ctr2cloud/ctr2cloud/pkg/generic/compute"
+	"github.com/ctr2cloud/ctr2cloud/pkg/pipeline"
+	"github.com/juju/zaputil/zapctx"
+	"go.uber.org/zap"
+)
+
+var ErrVolumeNotFound = errors.New("volume not found")
+var ErrVolumeMismatch = errors.New("volume does not match spec")
+
+// VolumeSpec is a named volume, containers reference it by name in ContainerSpec.Volumes
+type VolumeSpec struct {
+	Name string
+	// Driver defaults to local
+	Driver  string
+	Options map[string]string
+	Labels  map[string]string
+	// Recreate allows removing a volume which does not match the spec, all data in the volume is lost.
+	// Without it a mismatch is reported as ErrVolumeMismatch.
+	Recreate bool
+}
+
+func (s VolumeSpec) driver() string {
+	if s.Driver == "" {
+		return "local"
+	}
+	return s.Driver
+}
+
+func (s VolumeSpec) GetCommand() string {
+	var cmd strings.Builder
+	cmd.WriteString(fmt.Sprintf("docker volume create --driver %s", compute.ShellQuote(s.driver())))
+	for _, option := range sortedKeyValues(s.Options) {
+		cmd.WriteString(" --opt " + compute.ShellQuote(option))
+	}
+	for _, label := range sortedKeyValues(s.Labels) {
+		cmd.WriteString(" --label " + compute.ShellQuote(label))
+	}
+	cmd.WriteString(" " + compute.ShellQuote(s.Name))
+	return cmd.String()
+}
+
+func (s VolumeSpec) matchesInspect(inspectRes volumeInspect) bool {
+	return inspectRes.Driver == s.driver() && maps.Equal(s.Options, inspectRes.Options) && maps.Equal(s.Labels, inspectRes.Labels)
+}
+
+func (p *Provisioner) inspectVolume(ctx context.Context, name string) (volumeInspect, error) {
+	output, err := p.CommandExecutor.ExecString(ctx, fmt.Sprintf("docker volume inspect -f \"{{ json . }}\" %s", compute.ShellQuote(name)))
+	if err != nil {
+		if isNoSuchObject(output) {
+			return volumeInspect{}, fmt.Errorf("%w: %s", ErrVolumeNotFound, name)
+		}
+		return volumeInspect{}, fmt.Errorf("docker volume inspect: %s: %w", strings.TrimSpace(output), err)
+	}
+
+	var inspectRes volumeInspect
+	err = json.Unmarshal([]byte(output), &inspectRes)
+	if err != nil {
+		return volumeInspect{}, fmt.Errorf("unmarshal volume inspect: %w", err)
+	}
+	return inspectRes, nil
+}
+
+// EnsureVolume ensures that a volume matching spec exists
+func (p *Provisioner) EnsureVolume(ctx context.Context, spec VolumeSpec) (bool, error) {
+	logger := zapctx.Logger(ctx)
+	inspectRes, err := p.inspectVolume(ctx, spec.Name)
+	switch {
+	case err == nil:
+		if spec.matchesInspect(inspectRes) {
+			logger.Debug("volume already exists with correct config", zap.String("name", spec.Name))
+			return false, nil
+		}
+		if !spec.Recreate {
+			return false, fmt.Errorf("%w: %s", ErrVolumeMismatch, spec.Name)
+		}
+		logger.Debug("volume exists but does not match spec, deleting", zap.String("name", spec.Name))
+		_, err = p.CommandExecutor.Exec(ctx, fmt.Sprintf("docker volume rm %s", compute.ShellQuote(spec.Name)))
+		if err != nil {
+			return false, fmt.Errorf("delete volume: %w", err)
+		}
+	case !errors.Is(err, ErrVolumeNotFound):
+		return false, err
+	}
+
+	cmd := spec.GetCommand()
+	logger.Debug("creating volume", zap.String("cmd", cmd))
+	_, err = p.CommandExecutor.Exec(ctx, cmd)
+	if err != nil {
+		return true, fmt.Errorf("create volume: %w", err)
+	}
+	return true, nil
+}
+
+// EnsureVolumeP is the pipeline version of EnsureVolume
+func (p *Provisioner) EnsureVolumeP(spec VolumeSpec) pipeline.FuncT {
+	return func(ctx *pipeline.Context) error {
+		changed, err := p.EnsureVolume(ctx, spec)
+		if err != nil {
+			return err
+		}
+		ctx.SetResult(changed)
+		return nil
+	}
+}
+
+// EnsureVolumeAbsent ensures that the volume name does not exist, it fails if the volume is in use
+func (p *Provisioner) EnsureVolumeAbsent(ctx context.Context, name string) (bool, error) {
+	_, err := p.inspectVolume(ctx, name)
+	if errors.Is(err, ErrVolumeNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	zapctx.Logger(ctx).Debug("deleting volume", zap.String("name", name))
+	_, err = p.CommandExecutor.Exec(ctx, fmt.Sprintf("docker volume rm %s", compute.ShellQuote(name)))
+	if err != nil {
+		return false, fmt.Errorf("delete volume: %w", err)
+	}
+	return true, nil
+}
+
+// EnsureVolumeAbsentP is the pipeline version of EnsureVolumeAbsent
+func (p *Provisioner) EnsureVolumeAbsentP(name string) pipeline.FuncT {
+	return func(ctx *pipeline.Context) error {
+		changed, err := p.EnsureVolumeAbsent(ctx, name)
+		if err != nil {
+			return err
+		}
+		ctx.SetResult(changed)
+		return nil
+	}
+}
@@ -0,0 +1,290 @@
+package download
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/ctr2cloud/ctr2cloud/pkg/generic/compute"
+	"github.com/ctr2cloud/ctr2cloud/pkg/pipeline"
+	"github.com/ctr2cloud/ctr2cloud/pkg/provisioners/file"
+	"github.com/juju/zaputil/zapctx"
+	"go.uber.org/zap"
+)
+
+type Provisioner struct {
+	*compute.CommandExecutor
+}
+
+var ErrChecksumRequired = errors.New("a sha256 checksum is required")
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+var ErrUnsupportedFormat = errors.New("unsupported archive format")
+
+// FetchLocation determines where a URL is downloaded
+type FetchLocation int
+
+const (
+	// FetchOnInstance downloads the URL on the instance using curl or wget
+	FetchOnInstance FetchLocation = iota
+	// FetchOnController downloads the URL on the machine running ctr2cloud and pushes it to the instance
+	FetchOnController
+)
+
+type ArchiveFormat string
+
+const (
+	ArchiveFormatTarGz ArchiveFormat = "tar.gz"
+	ArchiveFormatTarXz ArchiveFormat = "tar.xz"
+	ArchiveFormatZip   ArchiveFormat = "zip"
+)
+
+// unpackedMarkerName is the name of the marker file written to the destination of an unpacked archive
+const unpackedMarkerName = ".ctr2cloud-unpacked"
+
+var sha256Regex = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+type EnsureDownloadedArgs struct {
+	URL string
+	// Path is the location of the downloaded file on the instance
+	Path string
+	// SHA256 is the hex encoded sha256 checksum of the file
+	SHA256 string
+	// FetchOn determines where the URL is downloaded
+	FetchOn FetchLocation
+	// HTTPClient is used for FetchOnController, defaults to http.DefaultClient
+	HTTPClient *http.Client
+}
+
+func (a EnsureDownloadedArgs) validate() error {
+	if !sha256Regex.MatchString(a.SHA256) {
+		return fmt.Errorf("%w: got %q", ErrChecksumRequired, a.SHA256)
+	}
+	return nil
+}
+
+// EnsureDownloaded ensures that the file at args.Path has the checksum args.SHA256,
+// downloading it from args.URL if it does not
+func (p *Provisioner) EnsureDownloaded(ctx context.Context, args EnsureDownloadedArgs) (bool, error) {
+	logger := zapctx.Logger(ctx)
+	err := args.validate()
+	if err != nil {
+		return false, err
+	}
+
+	fProvisioner := file.Provisioner{CommandExecutor: p.CommandExecutor}
+	currentSHA256, err := fProvisioner.GetSHA256Sum(ctx, args.Path)
+	if err == nil && currentSHA256 == args.SHA256 {
+		logger.Debug("file already downloaded", zap.String("path", args.Path), zap.String("sha256", currentSHA256))
+		return false, nil
+	}
+
+	_, err = p.CommandExecutor.Exec(ctx, "mkdir -p "+compute.ShellQuote(path.Dir(args.Path)))
+	if err != nil {
+		return false, fmt.Errorf("creating parent directory: %w", err)
+	}
+
+	logger.Debug("downloading file", zap.String("url", args.URL), zap.String("path", args.Path))
+	switch args.FetchOn {
+	case FetchOnInstance:
+		err = p.fetchOnInstance(ctx, args)
+	case FetchOnController:
+		err = p.fetchOnController(ctx, args)
+	default:
+		err = fmt.Errorf("unknown fetch location %d", args.FetchOn)
+	}
+	return true, err
+}
+
+// tmpPath returns the path a download is written to before its checksum is verified
+func tmpPath(args EnsureDownloadedArgs) string {
+	return args.Path + ".ctr2cloud-tmp"
+}
+
+// verifyAndMove checks the sha256 of the temporary download on the instance and moves it into place
+func (p *Provisioner) verifyAndMove(ctx context.Context, args EnsureDownloadedArgs) error {
+	quotedTmpPath := compute.ShellQuote(tmpPath(args))
+	fProvisioner := file.Provisioner{CommandExecutor: p.CommandExecutor}
+	downloadedSHA256, err := fProvisioner.GetSHA256Sum(ctx, tmpPath(args))
+	if err != nil {
+		return fmt.Errorf("getting sha256sum of download: %w", err)
+	}
+	if downloadedSHA256 != args.SHA256 {
+		_, _ = p.CommandExecutor.Exec(ctx, "rm -f "+quotedTmpPath)
+		return fmt.Errorf("%w: expected %s, got %s", ErrChecksumMismatch, args.SHA256, downloadedSHA256)
+	}
+
+	_, err = p.CommandExecutor.Exec(ctx, fmt.Sprintf("mv -f %s %s", quotedTmpPath, compute.ShellQuote(args.Path)))
+	if err != nil {
+		return fmt.Errorf("moving download into place: %w", err)
+	}
+	return nil
+}
+
+func (p *Provisioner) fetchOnInstance(ctx context.Context, args EnsureDownloadedArgs) error {
+	quotedTmpPath := compute.ShellQuote(tmpPath(args))
+	quotedURL := compute.ShellQuote(args.URL)
+	fetchCmd := fmt.Sprintf("if command -v curl >/dev/null; then curl -fsSL -o %s %s; else wget -q -O %s %s; fi", quotedTmpPath, quotedURL, quotedTmpPath, quotedURL)
+	output, err := p.CommandExecutor.ExecString(ctx, fetchCmd)
+	if err != nil {
+		_, _ = p.CommandExecutor.Exec(ctx, "rm -f "+quotedTmpPath)
+		return fmt.Errorf("fetching %s: %w: %s", args.URL, err, strings.TrimSpace(output))
+	}
+	return p.verifyAndMove(ctx, args)
+}
+
+// fetchOnController streams the response body to the instance without holding it in memory,
+// the checksum is verified on the instance before the file is moved into place
+func (p *Provisioner) fetchOnController(ctx context.Context, args EnsureDownloadedArgs) error {
+	client := args.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, args.URL, nil)
+	if err != nil {
+		return fmt.Errorf("creating request: %w", err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("fetching %s: %w", args.URL, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("fetching %s: unexpected status %s", args.URL, resp.Status)
+	}
+
+	fProvisioner := file.Provisioner{CommandExecutor: p.CommandExecutor}
+	err = fProvisioner.WriteChunks(ctx, tmpPath(args), resp.Body)
+	if err != nil {
+		_, _ = p.CommandExecutor.Exec(ctx, "rm -f "+compute.ShellQuote(tmpPath(args)))
+		return fmt.Errorf("pushing download: %w", err)
+	}
+	return p.verifyAndMove(ctx, args)
+}
+
+// EnsureDownloadedP is the pipeline version of EnsureDownloaded
+func (p *Provisioner) EnsureDownloadedP(args EnsureDownloadedArgs) pipeline.FuncT {
+	return func(ctx *pipeline.Context) error {
+		changed, err := p.EnsureDownloaded(ctx, args)
+		if err != nil {
+			return err
+		}
+		ctx.SetResult(changed)
+		return nil
+	}
+}
+
+type EnsureUnpackedArgs struct {
+	EnsureDownloadedArgs
+	// Destination is the directory the archive is unpacked into
+	Destination string
+	// Format of the archive, detected from the URL if empty
+	Format ArchiveFormat
+	// StripComponents removes the given number of leading path elements (tar only)
+	StripComponents int
+}
+
+// detectArchiveFormat guesses the archive format from the path of a URL
+func detectArchiveFormat(rawURL string) (ArchiveFormat, error) {
+	urlPath := rawURL
+	parsedURL, err := url.Parse(rawURL)
+	if err == nil {
+		urlPath = parsedURL.Path
+	}
+	urlPath = strings.ToLower(urlPath)
+	switch {
+	case strings.HasSuffix(urlPath, ".tar.gz"), strings.HasSuffix(urlPath, ".tgz"):
+		return ArchiveFormatTarGz, nil
+	case strings.HasSuffix(urlPath, ".tar.xz"), strings.HasSuffix(urlPath, ".txz"):
+		return ArchiveFormatTarXz, nil
+	case strings.HasSuffix(urlPath, ".zip"):
+		return ArchiveFormatZip, nil
+	}
+	return "", fmt.Errorf("%w: unable to detect format of %s", ErrUnsupportedFormat, rawURL)
+}
+
+// unpackCommand returns the shell command to unpack archivePath into destination
+func unpackCommand(format ArchiveFormat, archivePath, destination string, stripComponents int) (string, error) {
+	archivePath = compute.ShellQuote(archivePath)
+	destination = compute.ShellQuote(destination)
+	stripArg := ""
+	if stripComponents > 0 {
+		stripArg = fmt.Sprintf(" --strip-components=%d", stripComponents)
+	}
+	switch format {
+	case ArchiveFormatTarGz:
+		return fmt.Sprintf("tar -xzf %s -C %s%s", archivePath, destination, stripArg), nil
+	case ArchiveFormatTarXz:
+		return fmt.Sprintf("tar -xJf %s -C %s%s", archivePath, destination, stripArg), nil
+	case ArchiveFormatZip:
+		if stripComponents > 0 {
+			return "", fmt.Errorf("%w: zip does not support stripping components", ErrUnsupportedFormat)
+		}
+		return fmt.Sprintf("unzip -oq %s -d %s", archivePath, destination), nil
+	}
+	return "", fmt.Errorf("%w: %s", ErrUnsupportedFormat, format)
+}
+
+// EnsureUnpacked ensures that the archive described by args is downloaded and unpacked into args.Destination.
+// A marker file containing the checksum of the archive is written to the destination so that the archive
+// is only unpacked again if the checksum changes.
+func (p *Provisioner) EnsureUnpacked(ctx context.Context, args EnsureUnpackedArgs) (bool, error) {
+	logger := zapctx.Logger(ctx)
+	format := args.Format
+	if format == "" {
+		var err error
+		format, err = detectArchiveFormat(args.URL)
+		if err != nil {
+			return false, err
+		}
+	}
+	unpackCmd, err := unpackCommand(format, args.Path, args.Destination, args.StripComponents)
+	if err != nil {
+		return false, err
+	}
+
+	downloaded, err := p.EnsureDownloaded(ctx, args.EnsureDownloadedArgs)
+	if err != nil {
+		return downloaded, fmt.Errorf("ensuring archive downloaded: %w", err)
+	}
+
+	fProvisioner := file.Provisioner{CommandExecutor: p.CommandExecutor}
+	markerPath := path.Join(args.Destination, unpackedMarkerName)
+	markerContents := fmt.Sprintf("%s %d\n", args.SHA256, args.StripComponents)
+	currentMarker, err := fProvisioner.GetFileContents(ctx, markerPath)
+	if err == nil && string(currentMarker) == markerContents {
+		logger.Debug("archive already unpacked", zap.String("destination", args.Destination))
+		return downloaded, nil
+	}
+
+	_, err = p.CommandExecutor.Exec(ctx, "mkdir -p "+compute.ShellQuote(args.Destination))
+	if err != nil {
+		return true, fmt.Errorf("creating destination: %w", err)
+	}
+	logger.Debug("unpacking archive", zap.String("cmd", unpackCmd))
+	output, err := p.CommandExecutor.ExecString(ctx, unpackCmd)
+	if err != nil {
+		return true, fmt.Errorf("unpacking archive: %w: %s", err, strings.TrimSpace(output))
+	}
+	_, err = fProvisioner.EnsureFileContentsString(ctx, markerPath, markerContents)
+	if err != nil {
+		return true, fmt.Errorf("writing unpack marker: %w", err)
+	}
+	return true, nil
+}
+
+// EnsureUnpackedP is the pipeline version of EnsureUnpacked
+func (p *Provisioner) EnsureUnpackedP(args EnsureUnpackedArgs) pipeline.FuncT {
+	return func(ctx *pipeline.Context) error {
+		changed, err := p.EnsureUnpacked(ctx, args)
+		if err != nil {
+			return err
+		}
+		ctx.SetResult(changed)
+		return nil
+	}
+}
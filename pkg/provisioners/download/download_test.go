@@ -0,0 +1,136 @@
+package download
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ctr2cloud/ctr2cloud/internal/test"
+	"github.com/ctr2cloud/ctr2cloud/pkg/provisioners/file"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDetectArchiveFormat(t *testing.T) {
+	cases := map[string]ArchiveFormat{
+		"https://example.com/tool-1.0-linux-amd64.tar.gz":         ArchiveFormatTarGz,
+		"https://example.com/tool.tgz?token=abc":                  ArchiveFormatTarGz,
+		"https://example.com/tool-1.0.TAR.XZ":                     ArchiveFormatTarXz,
+		"https://example.com/releases/download/v1/tool_linux.zip": ArchiveFormatZip,
+	}
+	for rawURL, expected := range cases {
+		t.Run(rawURL, func(t *testing.T) {
+			format, err := detectArchiveFormat(rawURL)
+			require.NoError(t, err)
+			require.Equal(t, expected, format)
+		})
+	}
+
+	_, err := detectArchiveFormat("https://example.com/tool")
+	require.ErrorIs(t, err, ErrUnsupportedFormat)
+}
+
+func TestUnpackCommand(t *testing.T) {
+	r := require.New(t)
+	cmd, err := unpackCommand(ArchiveFormatTarXz, "/tmp/a.tar.xz", "/opt/my tool", 1)
+	r.NoError(err)
+	r.Equal("tar -xJf /tmp/a.tar.xz -C '/opt/my tool' --strip-components=1", cmd)
+
+	_, err = unpackCommand(ArchiveFormatZip, "/tmp/a.zip", "/opt/tool", 1)
+	r.ErrorIs(err, ErrUnsupportedFormat)
+}
+
+func buildTarGz(t *testing.T, files map[string]string) []byte {
+	buf := new(bytes.Buffer)
+	gzWriter := gzip.NewWriter(buf)
+	tarWriter := tar.NewWriter(gzWriter)
+	for name, contents := range files {
+		err := tarWriter.WriteHeader(&tar.Header{
+			Name: name,
+			Mode: 0755,
+			Size: int64(len(contents)),
+		})
+		require.NoError(t, err)
+		_, err = tarWriter.Write([]byte(contents))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tarWriter.Close())
+	require.NoError(t, gzWriter.Close())
+	return buf.Bytes()
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+const testEnsureUnpackedInstanceName = "test-ensure-unpacked"
+
+func TestEnsureUnpacked(t *testing.T) {
+	executor, err := test.GetLXDExecutorFactory(t, testEnsureUnpackedInstanceName)()
+	require.NoError(t, err)
+	ctx, r := test.DefaultPreamble(t, time.Second*30)
+
+	archive := buildTarGz(t, map[string]string{
+		"tool-1.0/bin/tool": "#!/bin/sh\necho tool 1.0\n",
+		"tool-1.0/README":   "readme\n",
+	})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, _ = w.Write(archive)
+	}))
+	t.Cleanup(server.Close)
+
+	provisioner := Provisioner{CommandExecutor: executor}
+	args := EnsureUnpackedArgs{
+		EnsureDownloadedArgs: EnsureDownloadedArgs{
+			URL:        server.URL + "/tool-1.0.tar.gz",
+			Path:       "/var/cache/ctr2cloud/tool-1.0.tar.gz",
+			SHA256:     sha256Hex(archive),
+			FetchOn:    FetchOnController,
+			HTTPClient: server.Client(),
+		},
+		Destination:     "/opt/tool",
+		StripComponents: 1,
+	}
+
+	test.RequireIdempotence(r, func() (bool, error) {
+		return provisioner.EnsureUnpacked(ctx, args)
+	})
+
+	fProvisioner := file.Provisioner{CommandExecutor: executor}
+	contents, err := fProvisioner.GetFileContents(ctx, "/opt/tool/bin/tool")
+	r.NoError(err)
+	r.Equal("#!/bin/sh\necho tool 1.0\n", string(contents))
+
+	// larger files are pushed in several chunks
+	large := bytes.Repeat([]byte("0123456789abcdef"), file.WriteChunkSize/4+3)
+	largeServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, _ = w.Write(large)
+	}))
+	t.Cleanup(largeServer.Close)
+	largeArgs := EnsureDownloadedArgs{
+		URL:        largeServer.URL + "/large.bin",
+		Path:       "/var/cache/ctr2cloud/large.bin",
+		SHA256:     sha256Hex(large),
+		FetchOn:    FetchOnController,
+		HTTPClient: largeServer.Client(),
+	}
+	test.RequireIdempotence(r, func() (bool, error) {
+		return provisioner.EnsureDownloaded(ctx, largeArgs)
+	})
+
+	badArgs := args.EnsureDownloadedArgs
+	badArgs.Path = "/var/cache/ctr2cloud/bad.tar.gz"
+	badArgs.SHA256 = sha256Hex([]byte("something else"))
+	_, err = provisioner.EnsureDownloaded(ctx, badArgs)
+	r.ErrorIs(err, ErrChecksumMismatch)
+
+	badArgs.SHA256 = ""
+	_, err = provisioner.EnsureDownloaded(ctx, badArgs)
+	r.ErrorIs(err, ErrChecksumRequired)
+}
@@ -1,12 +1,16 @@
 package file
 
 import (
+	"bytes"
 	"context"
 	"crypto/md5"
+	"crypto/sha256"
 	"encoding/base64"
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
+	"regexp"
 	"strings"
 
 	"github.com/ctr2cloud/ctr2cloud/pkg/generic/compute"
@@ -24,26 +28,53 @@ var ErrPermissionDenied = errors.New("permission denied")
 
 // GetMD5Sum returns the hex encoded md5sum of a file
 func (p *Provisioner) GetMD5Sum(ctx context.Context, path string) (string, error) {
-	res, err := p.CommandExecutor.ExecString(ctx, "md5sum "+path)
+	return p.getChecksum(ctx, "md5sum", md5.Size, path)
+}
+
+// GetSHA256Sum returns the hex encoded sha256sum of a file
+func (p *Provisioner) GetSHA256Sum(ctx context.Context, path string) (string, error) {
+	return p.getChecksum(ctx, "sha256sum", sha256.Size, path)
+}
+
+// checksumLineRegex matches a line of coreutils or busybox checksum output.
+// coreutils prefixes the line with a backslash if the file name contains special characters.
+var checksumLineRegex = regexp.MustCompile(`^\\?([0-9a-f]+)\s`)
+
+// parseChecksumOutput extracts a checksum of size bytes from the output of a checksum tool.
+// Lines which are not checksums, e.g. warnings of the shell, are skipped.
+func parseChecksumOutput(output string, size int) (string, error) {
+	for _, line := range strings.Split(output, "\n") {
+		match := checksumLineRegex.FindStringSubmatch(line)
+		if match != nil && len(match[1]) == 2*size {
+			return match[1], nil
+		}
+	}
+	return "", fmt.Errorf("unexpected checksum output: %s", strings.TrimSpace(output))
+}
+
+// getChecksum runs a coreutils or busybox style checksum tool on path and returns the checksum
+func (p *Provisioner) getChecksum(ctx context.Context, tool string, size int, path string) (string, error) {
+	res, err := p.CommandExecutor.ExecString(ctx, tool+" "+compute.ShellQuote(path))
 	if err != nil {
 		var cErr compute.CommandExecutorError
 		if !errors.As(err, &cErr) {
-			return "", fmt.Errorf("md5sum: %w", err)
+			return "", fmt.Errorf("%s: %w", tool, err)
 		}
+		// coreutils: "md5sum: /x: No such file or directory"
+		// busybox: "md5sum: can't open '/x': No such file or directory"
 		if strings.Contains(res, "No such file or directory") {
 			return "", ErrFileNotFound
 		}
 		if strings.Contains(res, "Permission denied") {
 			return "", ErrPermissionDenied
 		}
-		return "", fmt.Errorf("md5sum: %w", err)
+		return "", fmt.Errorf("%s: %s: %w", tool, strings.TrimSpace(res), err)
 	}
-	res = strings.Trim(res, "\n")
-	lines := strings.Split(res, "\n")
-	if len(lines) != 1 {
-		return "", fmt.Errorf("unexpected md5sum output: %s", res)
+	checksum, err := parseChecksumOutput(res, size)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", tool, err)
 	}
-	return strings.Split(lines[0], " ")[0], nil
+	return checksum, nil
 }
 
 func (p *Provisioner) EnsureFileContents(ctx context.Context, path string, contents []byte) (bool, error) {
@@ -57,23 +88,57 @@ func (p *Provisioner) EnsureFileContents(ctx context.Context, path string, conte
 		return false, nil
 	}
 
-	b64Contents := base64.StdEncoding.EncodeToString(contents)
-
-	writeCmd := fmt.Sprintf("echo %s | base64 -d > %s", b64Contents, path)
 	logger.Debug("writing file", zap.String("path", path), zap.String("md5", targetMD5))
-	_, err = p.CommandExecutor.Exec(ctx, writeCmd)
+	return true, p.writeFile(ctx, path, bytes.NewReader(contents), targetMD5)
+}
+
+// WriteChunkSize is the number of bytes appended to a file per command, it keeps the
+// base64 encoded command line well below the argument limits of the instance
+const WriteChunkSize = 64 << 10
+
+// WriteChunks truncates the file at path and appends the contents of r in chunks of WriteChunkSize,
+// so that large files are neither held in memory nor passed as a single command line.
+// The mode of an existing file is kept.
+func (p *Provisioner) WriteChunks(ctx context.Context, path string, r io.Reader) error {
+	quotedPath := compute.ShellQuote(path)
+	_, err := p.CommandExecutor.Exec(ctx, ": > "+quotedPath)
 	if err != nil {
-		return true, fmt.Errorf("writing file: %w", err)
+		return fmt.Errorf("truncating %s: %w", path, err)
+	}
+	buf := make([]byte, WriteChunkSize)
+	for {
+		n, readErr := io.ReadFull(r, buf)
+		if n > 0 {
+			chunk := base64.StdEncoding.EncodeToString(buf[:n])
+			_, err = p.CommandExecutor.Exec(ctx, fmt.Sprintf("printf %%s %s | base64 -d >> %s", chunk, quotedPath))
+			if err != nil {
+				return fmt.Errorf("appending to %s: %w", path, err)
+			}
+		}
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if readErr != nil {
+			return fmt.Errorf("reading contents of %s: %w", path, readErr)
+		}
+	}
+}
+
+// writeFile unconditionally writes the contents of r to path and verifies the result against targetMD5
+func (p *Provisioner) writeFile(ctx context.Context, path string, r io.Reader, targetMD5 string) error {
+	err := p.WriteChunks(ctx, path, r)
+	if err != nil {
+		return fmt.Errorf("writing file: %w", err)
 	}
 
 	finalMD5, err := p.GetMD5Sum(ctx, path)
 	if err != nil {
-		return true, fmt.Errorf("getting final md5sum: %w", err)
+		return fmt.Errorf("getting final md5sum: %w", err)
 	}
 	if finalMD5 != targetMD5 {
-		return true, fmt.Errorf("final md5sum mismatch: expected %s, got %s", targetMD5, finalMD5)
+		return fmt.Errorf("final md5sum mismatch: expected %s, got %s", targetMD5, finalMD5)
 	}
-	return true, nil
+	return nil
 }
 
 // EnsureFileContentsP is the pipeline version of EnsureFileContents
@@ -109,7 +174,8 @@ func (p *Provisioner) GetFileContents(ctx context.Context, path string) ([]byte,
 	if err != nil {
 		return nil, fmt.Errorf("getting md5sum: %w", err)
 	}
-	contentsCmd := fmt.Sprintf("cat %s | base64 -w 0 ", path)
+	// busybox base64 does not support -w on older releases, the line breaks are skipped when decoding
+	contentsCmd := fmt.Sprintf("base64 < %s", compute.ShellQuote(path))
 	encodedContents, err := p.CommandExecutor.Exec(ctx, contentsCmd)
 	if err != nil {
 		return nil, fmt.Errorf("cat: %w", err)
@@ -129,3 +195,32 @@ func (p *Provisioner) GetFileContents(ctx context.Context, path string) ([]byte,
 
 	return contents, nil
 }
+
+// EnsureFileAbsent ensures that the file at path does not exist
+func (p *Provisioner) EnsureFileAbsent(ctx context.Context, path string) (bool, error) {
+	quotedPath := compute.ShellQuote(path)
+	res, err := p.CommandExecutor.ExecString(ctx, fmt.Sprintf("if [ -e %s ]; then rm -f %s && echo removed; fi", quotedPath, quotedPath))
+	if err != nil {
+		if strings.Contains(res, "Permission denied") {
+			return false, ErrPermissionDenied
+		}
+		return false, fmt.Errorf("removing file: %w", err)
+	}
+	removed := strings.TrimSpace(res) == "removed"
+	if removed {
+		zapctx.Logger(ctx).Debug("removed file", zap.String("path", path))
+	}
+	return removed, nil
+}
+
+// EnsureFileAbsentP is the pipeline version of EnsureFileAbsent
+func (p *Provisioner) EnsureFileAbsentP(path string) pipeline.FuncT {
+	return func(ctx *pipeline.Context) error {
+		changed, err := p.EnsureFileAbsent(ctx, path)
+		if err != nil {
+			return err
+		}
+		ctx.SetResult(changed)
+		return nil
+	}
+}
@@ -89,3 +89,22 @@ func TestGetFileContents(t *testing.T) {
 	}
 
 }
+
+func TestParseChecksumOutput(t *testing.T) {
+	// coreutils and busybox
+	checksum, err := parseChecksumOutput("d41d8cd98f00b204e9800998ecf8427e  /tmp/empty\n", 16)
+	require.NoError(t, err)
+	require.Equal(t, "d41d8cd98f00b204e9800998ecf8427e", checksum)
+
+	// coreutils escapes file names with special characters
+	checksum, err = parseChecksumOutput("\\d41d8cd98f00b204e9800998ecf8427e  /tmp/with\\nnewline\n", 16)
+	require.NoError(t, err)
+	require.Equal(t, "d41d8cd98f00b204e9800998ecf8427e", checksum)
+
+	// the checksum length must match the tool
+	_, err = parseChecksumOutput("d41d8cd98f00b204e9800998ecf8427e  /tmp/empty\n", 32)
+	require.Error(t, err)
+
+	_, err = parseChecksumOutput("sh: md5sum: not found\n", 16)
+	require.Error(t, err)
+}
@@ -0,0 +1,307 @@
+package file
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/ctr2cloud/ctr2cloud/pkg/generic/compute"
+	"github.com/ctr2cloud/ctr2cloud/pkg/pipeline"
+	"github.com/juju/zaputil/zapctx"
+	"go.uber.org/zap"
+)
+
+type SyncFileStatus string
+
+const (
+	SyncFileUnchanged   SyncFileStatus = "unchanged"
+	SyncFileCreated     SyncFileStatus = "created"
+	SyncFileUpdated     SyncFileStatus = "updated"
+	SyncFileModeChanged SyncFileStatus = "mode-changed"
+	SyncFileDeleted     SyncFileStatus = "deleted"
+)
+
+type SyncDirectoryOptions struct {
+	// Delete removes remote files which do not exist locally.
+	// Files excluded by Include/Exclude are never deleted.
+	Delete bool
+	// Include limits the sync to files matching at least one of the globs.
+	// Globs use path.Match syntax and are matched against the slash separated relative path.
+	Include []string
+	// Exclude skips files matching any of the globs
+	Exclude []string
+	// PreserveMode applies the permission bits of the local files to the remote files
+	PreserveMode bool
+}
+
+// included returns true if the relative path relPath should be synced
+func (o SyncDirectoryOptions) included(relPath string) bool {
+	matchAny := func(patterns []string) bool {
+		return slices.ContainsFunc(patterns, func(pattern string) bool {
+			matched, _ := path.Match(pattern, relPath)
+			return matched
+		})
+	}
+	if len(o.Include) > 0 && !matchAny(o.Include) {
+		return false
+	}
+	return !matchAny(o.Exclude)
+}
+
+type SyncFileResult struct {
+	// Path relative to the synced directory
+	Path   string
+	Status SyncFileStatus
+}
+
+type SyncDirectoryResult struct {
+	// Changed is true if any remote file was created, updated or deleted
+	Changed bool
+	Files   []SyncFileResult
+}
+
+type syncLocalFile struct {
+	md5  string
+	mode fs.FileMode
+}
+
+// md5SumLineRegex matches a single line of md5sum output
+var md5SumLineRegex = regexp.MustCompile(`^\\?([0-9a-f]{32})\s+\*?(.+)$`)
+
+// parseMD5SumListing parses the output of md5sum for files below root into a map of relative path to md5sum
+func parseMD5SumListing(output, root string) (map[string]string, error) {
+	res := make(map[string]string)
+	prefix := strings.TrimSuffix(root, "/") + "/"
+	for _, line := range strings.Split(strings.Trim(output, "\n"), "\n") {
+		if line == "" {
+			continue
+		}
+		match := md5SumLineRegex.FindStringSubmatch(line)
+		if match == nil {
+			return nil, fmt.Errorf("unexpected md5sum output: %s", line)
+		}
+		relPath, ok := strings.CutPrefix(match[2], prefix)
+		if !ok {
+			return nil, fmt.Errorf("md5sum path %s not below %s", match[2], root)
+		}
+		res[relPath] = match[1]
+	}
+	return res, nil
+}
+
+// statModeLineRegex matches a single line of `stat -c '%a %n'` output
+var statModeLineRegex = regexp.MustCompile(`^([0-7]+) (.+)$`)
+
+// parseStatModeListing parses the output of `stat -c '%a %n'` for files below root into a map of relative path to mode
+func parseStatModeListing(output, root string) (map[string]fs.FileMode, error) {
+	res := make(map[string]fs.FileMode)
+	prefix := strings.TrimSuffix(root, "/") + "/"
+	for _, line := range strings.Split(strings.Trim(output, "\n"), "\n") {
+		if line == "" {
+			continue
+		}
+		match := statModeLineRegex.FindStringSubmatch(line)
+		if match == nil {
+			return nil, fmt.Errorf("unexpected stat output: %s", line)
+		}
+		mode, err := strconv.ParseUint(match[1], 8, 32)
+		if err != nil {
+			return nil, fmt.Errorf("parsing mode %s: %w", match[1], err)
+		}
+		relPath, ok := strings.CutPrefix(match[2], prefix)
+		if !ok {
+			return nil, fmt.Errorf("stat path %s not below %s", match[2], root)
+		}
+		res[relPath] = fs.FileMode(mode).Perm()
+	}
+	return res, nil
+}
+
+func (p *Provisioner) getRemoteMD5Sums(ctx context.Context, remotePath string) (map[string]string, error) {
+	quotedPath := compute.ShellQuote(remotePath)
+	cmd := fmt.Sprintf("if [ -d %s ]; then find %s -type f -exec md5sum {} +; fi", quotedPath, quotedPath)
+	res, err := p.CommandExecutor.ExecString(ctx, cmd)
+	if err != nil {
+		return nil, fmt.Errorf("listing remote files: %w", err)
+	}
+	return parseMD5SumListing(res, remotePath)
+}
+
+func (p *Provisioner) getRemoteModes(ctx context.Context, remotePath string) (map[string]fs.FileMode, error) {
+	quotedPath := compute.ShellQuote(remotePath)
+	cmd := fmt.Sprintf("if [ -d %s ]; then find %s -type f -exec stat -c '%%a %%n' {} +; fi", quotedPath, quotedPath)
+	res, err := p.CommandExecutor.ExecString(ctx, cmd)
+	if err != nil {
+		return nil, fmt.Errorf("listing remote file modes: %w", err)
+	}
+	return parseStatModeListing(res, remotePath)
+}
+
+func getLocalFiles(fsys fs.FS, opts SyncDirectoryOptions) (map[string]syncLocalFile, error) {
+	res := make(map[string]syncLocalFile)
+	err := fs.WalkDir(fsys, ".", func(relPath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() || !opts.included(relPath) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		// the contents are only hashed here and read again if the file has to be written
+		f, err := fsys.Open(relPath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		h := md5.New()
+		_, err = io.Copy(h, f)
+		if err != nil {
+			return err
+		}
+		res[relPath] = syncLocalFile{
+			md5:  hex.EncodeToString(h.Sum(nil)),
+			mode: info.Mode().Perm(),
+		}
+		return nil
+	})
+	return res, err
+}
+
+// syncFile streams relPath of fsys to targetPath, the md5 check fails if the local file changed since it was hashed
+func (p *Provisioner) syncFile(ctx context.Context, fsys fs.FS, relPath, targetPath, targetMD5 string) error {
+	f, err := fsys.Open(relPath)
+	if err != nil {
+		return fmt.Errorf("reading local file: %w", err)
+	}
+	defer f.Close()
+	return p.writeFile(ctx, targetPath, f, targetMD5)
+}
+
+// SyncDirectory ensures that remotePath contains the files of fsys.
+// Both sides are hashed and only files which differ are transferred.
+func (p *Provisioner) SyncDirectory(ctx context.Context, fsys fs.FS, remotePath string, opts SyncDirectoryOptions) (SyncDirectoryResult, error) {
+	logger := zapctx.Logger(ctx)
+	result := SyncDirectoryResult{}
+
+	localFiles, err := getLocalFiles(fsys, opts)
+	if err != nil {
+		return result, fmt.Errorf("reading local files: %w", err)
+	}
+	remoteMD5Sums, err := p.getRemoteMD5Sums(ctx, remotePath)
+	if err != nil {
+		return result, err
+	}
+	var remoteModes map[string]fs.FileMode
+	if opts.PreserveMode {
+		remoteModes, err = p.getRemoteModes(ctx, remotePath)
+		if err != nil {
+			return result, err
+		}
+	}
+
+	relPaths := make([]string, 0, len(localFiles))
+	for relPath := range localFiles {
+		relPaths = append(relPaths, relPath)
+	}
+	slices.Sort(relPaths)
+
+	createdDirs := make(map[string]bool)
+	for _, relPath := range relPaths {
+		localFile := localFiles[relPath]
+		targetPath := path.Join(remotePath, relPath)
+		remoteMD5, exists := remoteMD5Sums[relPath]
+
+		status := SyncFileUnchanged
+		if !exists || remoteMD5 != localFile.md5 {
+			dir := path.Dir(targetPath)
+			if !createdDirs[dir] {
+				_, err = p.CommandExecutor.Exec(ctx, "mkdir -p "+compute.ShellQuote(dir))
+				if err != nil {
+					return result, fmt.Errorf("creating directory %s: %w", dir, err)
+				}
+				createdDirs[dir] = true
+			}
+			logger.Debug("writing file", zap.String("path", targetPath), zap.String("md5", localFile.md5))
+			err = p.syncFile(ctx, fsys, relPath, targetPath, localFile.md5)
+			if err != nil {
+				return result, fmt.Errorf("syncing %s: %w", relPath, err)
+			}
+			status = SyncFileUpdated
+			if !exists {
+				status = SyncFileCreated
+			}
+		}
+
+		if opts.PreserveMode && (status != SyncFileUnchanged || remoteModes[relPath] != localFile.mode) {
+			if status == SyncFileUnchanged {
+				status = SyncFileModeChanged
+			}
+			chmodCmd := fmt.Sprintf("chmod %o %s", localFile.mode, compute.ShellQuote(targetPath))
+			_, err = p.CommandExecutor.Exec(ctx, chmodCmd)
+			if err != nil {
+				return result, fmt.Errorf("setting mode of %s: %w", relPath, err)
+			}
+		}
+
+		result.Files = append(result.Files, SyncFileResult{Path: relPath, Status: status})
+		result.Changed = result.Changed || status != SyncFileUnchanged
+	}
+
+	if !opts.Delete {
+		return result, nil
+	}
+
+	extraneous := make([]string, 0)
+	for relPath := range remoteMD5Sums {
+		if _, ok := localFiles[relPath]; !ok && opts.included(relPath) {
+			extraneous = append(extraneous, relPath)
+		}
+	}
+	slices.Sort(extraneous)
+	for _, relPath := range extraneous {
+		targetPath := path.Join(remotePath, relPath)
+		logger.Debug("deleting extraneous file", zap.String("path", targetPath))
+		_, err = p.CommandExecutor.Exec(ctx, "rm -f "+compute.ShellQuote(targetPath))
+		if err != nil {
+			return result, fmt.Errorf("deleting %s: %w", relPath, err)
+		}
+		result.Files = append(result.Files, SyncFileResult{Path: relPath, Status: SyncFileDeleted})
+		result.Changed = true
+	}
+
+	return result, nil
+}
+
+// SyncDirectoryP is the pipeline version of SyncDirectory
+func (p *Provisioner) SyncDirectoryP(fsys fs.FS, remotePath string, opts SyncDirectoryOptions) pipeline.FuncT {
+	return func(ctx *pipeline.Context) error {
+		res, err := p.SyncDirectory(ctx, fsys, remotePath, opts)
+		if err != nil {
+			return err
+		}
+		ctx.SetResult(res.Changed)
+		return nil
+	}
+}
+
+// SyncLocalDirectory is SyncDirectory for a directory on the local filesystem
+func (p *Provisioner) SyncLocalDirectory(ctx context.Context, localPath, remotePath string, opts SyncDirectoryOptions) (SyncDirectoryResult, error) {
+	return p.SyncDirectory(ctx, os.DirFS(localPath), remotePath, opts)
+}
+
+// SyncLocalDirectoryP is the pipeline version of SyncLocalDirectory
+func (p *Provisioner) SyncLocalDirectoryP(localPath, remotePath string, opts SyncDirectoryOptions) pipeline.FuncT {
+	return p.SyncDirectoryP(os.DirFS(localPath), remotePath, opts)
+}
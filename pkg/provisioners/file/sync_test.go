@@ -0,0 +1,114 @@
+package file
+
+import (
+	"bytes"
+	"io/fs"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/ctr2cloud/ctr2cloud/internal/test"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseMD5SumListing(t *testing.T) {
+	output := `d41d8cd98f00b204e9800998ecf8427e  /srv/site/empty
+5d41402abc4b2a76b9719d911017c592  /srv/site/sub dir/hello.txt
+`
+	res, err := parseMD5SumListing(output, "/srv/site/")
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{
+		"empty":             "d41d8cd98f00b204e9800998ecf8427e",
+		"sub dir/hello.txt": "5d41402abc4b2a76b9719d911017c592",
+	}, res)
+
+	res, err = parseMD5SumListing("", "/srv/site")
+	require.NoError(t, err)
+	require.Empty(t, res)
+
+	_, err = parseMD5SumListing("find: '/srv/site/x': Permission denied", "/srv/site")
+	require.Error(t, err)
+}
+
+func TestParseStatModeListing(t *testing.T) {
+	output := "644 /srv/site/index.html\n755 /srv/site/bin/run.sh\n"
+	res, err := parseStatModeListing(output, "/srv/site")
+	require.NoError(t, err)
+	require.Equal(t, map[string]fs.FileMode{
+		"index.html": 0644,
+		"bin/run.sh": 0755,
+	}, res)
+}
+
+func TestSyncDirectoryOptionsIncluded(t *testing.T) {
+	opts := SyncDirectoryOptions{
+		Include: []string{"*.conf", "sites/*"},
+		Exclude: []string{"sites/*.bak"},
+	}
+	r := require.New(t)
+	r.True(opts.included("nginx.conf"))
+	r.True(opts.included("sites/default"))
+	r.False(opts.included("sites/default.bak"))
+	r.False(opts.included("README.md"))
+	r.True(SyncDirectoryOptions{}.included("any/path"))
+}
+
+const testSyncDirectoryInstanceName = "test-sync-directory"
+
+func TestSyncDirectory(t *testing.T) {
+	executor, err := test.GetLXDExecutorFactory(t, testSyncDirectoryInstanceName)()
+	require.NoError(t, err)
+	ctx, r := test.DefaultPreamble(t, time.Second*30)
+
+	provisioner := Provisioner{CommandExecutor: executor}
+	remotePath := "/tmp/sync-test"
+
+	fsys := fstest.MapFS{
+		"nginx.conf":              {Data: []byte("worker_processes 1;\n"), Mode: 0644},
+		"sites/default":           {Data: []byte("server {}\n"), Mode: 0644},
+		"sites/with space":        {Data: []byte("server { listen 81; }\n"), Mode: 0600},
+		"bin/reload.sh":           {Data: []byte("#!/bin/sh\nnginx -s reload\n"), Mode: 0755},
+		"sites/ignored.bak":       {Data: []byte("old\n"), Mode: 0644},
+		"deeply/nested/dir/file":  {Data: []byte("nested\n"), Mode: 0644},
+		"deeply/nested/dir/file2": {Data: []byte("nested2\n"), Mode: 0644},
+		// written in several chunks
+		"static/bundle.js": {Data: bytes.Repeat([]byte("console.log(1);\n"), WriteChunkSize/8), Mode: 0644},
+	}
+	opts := SyncDirectoryOptions{
+		Delete:       true,
+		Exclude:      []string{"*.bak", "sites/*.bak"},
+		PreserveMode: true,
+	}
+
+	test.RequireIdempotence(r, func() (bool, error) {
+		res, err := provisioner.SyncDirectory(ctx, fsys, remotePath, opts)
+		return res.Changed, err
+	})
+
+	_, err = provisioner.GetMD5Sum(ctx, remotePath+"/sites/ignored.bak")
+	r.ErrorIs(err, ErrFileNotFound)
+
+	// change a single file and remove another
+	fsys["sites/default"] = &fstest.MapFile{Data: []byte("server { listen 80; }\n"), Mode: 0644}
+	delete(fsys, "deeply/nested/dir/file2")
+	res, err := provisioner.SyncDirectory(ctx, fsys, remotePath, opts)
+	r.NoError(err)
+	r.True(res.Changed)
+	statuses := make(map[string]SyncFileStatus)
+	for _, f := range res.Files {
+		statuses[f.Path] = f.Status
+	}
+	r.Equal(SyncFileUpdated, statuses["sites/default"])
+	r.Equal(SyncFileDeleted, statuses["deeply/nested/dir/file2"])
+	r.Equal(SyncFileUnchanged, statuses["nginx.conf"])
+
+	// change only the mode of a file
+	fsys["nginx.conf"] = &fstest.MapFile{Data: fsys["nginx.conf"].Data, Mode: 0600}
+	res, err = provisioner.SyncDirectory(ctx, fsys, remotePath, opts)
+	r.NoError(err)
+	r.True(res.Changed)
+
+	res, err = provisioner.SyncDirectory(ctx, fsys, remotePath, opts)
+	r.NoError(err)
+	r.False(res.Changed)
+}
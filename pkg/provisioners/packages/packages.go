@@ -0,0 +1,239 @@
+package packages
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/ctr2cloud/ctr2cloud/pkg/generic/compute"
+	"github.com/ctr2cloud/ctr2cloud/pkg/generic/pkgmgr"
+	"github.com/ctr2cloud/ctr2cloud/pkg/pipeline"
+	"github.com/ctr2cloud/ctr2cloud/pkg/provisioners/apk"
+	"github.com/ctr2cloud/ctr2cloud/pkg/provisioners/apt"
+	"github.com/ctr2cloud/ctr2cloud/pkg/provisioners/dnf"
+	"github.com/ctr2cloud/ctr2cloud/pkg/provisioners/systemd"
+	"github.com/juju/zaputil/zapctx"
+	"github.com/samber/lo"
+	"go.uber.org/zap"
+)
+
+var ErrUnsupportedDistribution = errors.New("unsupported distribution")
+
+type PackageSpec = pkgmgr.PackageSpec
+type RemoveOptions = pkgmgr.RemoveOptions
+
+// Family groups distributions which share a package manager and package names
+type Family string
+
+const (
+	FamilyDebian Family = "debian"
+	FamilyRHEL   Family = "rhel"
+	FamilyAlpine Family = "alpine"
+)
+
+// familyIDs maps os-release IDs to their family, ID_LIKE is used for derivatives not listed here
+var familyIDs = map[string]Family{
+	"debian":    FamilyDebian,
+	"ubuntu":    FamilyDebian,
+	"rhel":      FamilyRHEL,
+	"fedora":    FamilyRHEL,
+	"centos":    FamilyRHEL,
+	"rocky":     FamilyRHEL,
+	"almalinux": FamilyRHEL,
+	"alpine":    FamilyAlpine,
+}
+
+// NameMappings maps the package names used by callers to the names used by a distribution family.
+// Callers use the Debian names, names without a mapping are used as is.
+type NameMappings map[Family]map[string]string
+
+// DefaultNameMappings contains the common packages whose names differ between families
+var DefaultNameMappings = NameMappings{
+	FamilyRHEL: {
+		"apache2":        "httpd",
+		"cron":           "cronie",
+		"dnsutils":       "bind-utils",
+		"docker.io":      "moby-engine",
+		"iputils-ping":   "iputils",
+		"openssh-client": "openssh-clients",
+		"procps":         "procps-ng",
+		"xz-utils":       "xz",
+	},
+	FamilyAlpine: {
+		"dnsutils":       "bind-tools",
+		"docker.io":      "docker",
+		"iputils-ping":   "iputils",
+		"openssh-server": "openssh",
+		"xz-utils":       "xz",
+	},
+}
+
+// Map returns the name of packageName in family
+func (m NameMappings) Map(family Family, packageName string) string {
+	if name, ok := m[family][packageName]; ok {
+		return name
+	}
+	return packageName
+}
+
+// FamilyFromOSRelease determines the family from the ID and ID_LIKE fields of os-release
+func FamilyFromOSRelease(osRelease map[string]string) (Family, error) {
+	ids := append([]string{osRelease["ID"]}, strings.Fields(osRelease["ID_LIKE"])...)
+	for _, id := range ids {
+		if family, ok := familyIDs[id]; ok {
+			return family, nil
+		}
+	}
+	return "", fmt.Errorf("%w: ID=%s ID_LIKE=%s", ErrUnsupportedDistribution, osRelease["ID"], osRelease["ID_LIKE"])
+}
+
+type familyCacheKey struct{}
+
+// DetectFamily returns the distribution family of the instance.
+// The result is cached for the lifetime of executor.
+func DetectFamily(ctx context.Context, executor *compute.CommandExecutor) (Family, error) {
+	family, err := executor.Cached(familyCacheKey{}, func() (any, error) {
+		sProvisioner := systemd.Provisioner{CommandExecutor: executor}
+		osRelease, err := sProvisioner.GetOSRelease(ctx)
+		if err != nil {
+			return nil, err
+		}
+		family, err := FamilyFromOSRelease(osRelease)
+		if err != nil {
+			return nil, err
+		}
+		zapctx.Logger(ctx).Debug("detected distribution family", zap.String("family", string(family)))
+		return family, nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return family.(Family), nil
+}
+
+// Provisioner installs packages with the package manager of the instance's distribution
+type Provisioner struct {
+	*compute.CommandExecutor
+
+	// NameMappings are used instead of DefaultNameMappings if set
+	NameMappings NameMappings
+}
+
+func (p *Provisioner) nameMappings() NameMappings {
+	if p.NameMappings != nil {
+		return p.NameMappings
+	}
+	return DefaultNameMappings
+}
+
+// GetPackageManager returns the package manager of the instance together with its family
+func (p *Provisioner) GetPackageManager(ctx context.Context) (pkgmgr.PackageManager, Family, error) {
+	family, err := DetectFamily(ctx, p.CommandExecutor)
+	if err != nil {
+		return nil, "", err
+	}
+	switch family {
+	case FamilyDebian:
+		return &apt.Provisioner{CommandExecutor: p.CommandExecutor}, family, nil
+	case FamilyRHEL:
+		return &dnf.Provisioner{CommandExecutor: p.CommandExecutor}, family, nil
+	case FamilyAlpine:
+		return &apk.Provisioner{CommandExecutor: p.CommandExecutor}, family, nil
+	default:
+		return nil, "", fmt.Errorf("%w: %s", ErrUnsupportedDistribution, family)
+	}
+}
+
+// GetPackageVersions returns the installed versions of packageNames keyed by the requested names.
+// Packages that are not installed are omitted from the result.
+func (p *Provisioner) GetPackageVersions(ctx context.Context, packageNames ...string) (map[string]string, error) {
+	manager, family, err := p.GetPackageManager(ctx)
+	if err != nil {
+		return nil, err
+	}
+	mappings := p.nameMappings()
+	versions, err := manager.GetPackageVersions(ctx, lo.Map(packageNames, func(name string, _ int) string { return mappings.Map(family, name) })...)
+	if err != nil {
+		return nil, err
+	}
+	res := make(map[string]string)
+	for _, name := range packageNames {
+		if version, ok := versions[mappings.Map(family, name)]; ok {
+			res[name] = version
+		}
+	}
+	return res, nil
+}
+
+// EnsurePackageSpecsInstalled ensures that all packages are installed at the requested version.
+// Versions are distribution specific and should only be used together with a known family.
+func (p *Provisioner) EnsurePackageSpecsInstalled(ctx context.Context, specs []PackageSpec) (bool, error) {
+	manager, family, err := p.GetPackageManager(ctx)
+	if err != nil {
+		return false, err
+	}
+	mappings := p.nameMappings()
+	mapped := make([]PackageSpec, 0, len(specs))
+	for _, spec := range specs {
+		spec.Name = mappings.Map(family, spec.Name)
+		// several generic packages may map to the same distribution package
+		if !slices.ContainsFunc(mapped, func(other PackageSpec) bool { return other.Name == spec.Name }) {
+			mapped = append(mapped, spec)
+		}
+	}
+	return manager.EnsurePackagesInstalled(ctx, mapped)
+}
+
+// EnsurePackageSpecsInstalledP is the pipeline version of EnsurePackageSpecsInstalled
+func (p *Provisioner) EnsurePackageSpecsInstalledP(specs ...PackageSpec) pipeline.FuncT {
+	return func(ctx *pipeline.Context) error {
+		updated, err := p.EnsurePackageSpecsInstalled(ctx, specs)
+		if err != nil {
+			return err
+		}
+		ctx.SetResult(updated)
+		return nil
+	}
+}
+
+// EnsurePackagesInstalled ensures that all packages are installed, any installed version is accepted
+func (p *Provisioner) EnsurePackagesInstalled(ctx context.Context, packageNames ...string) (bool, error) {
+	return p.EnsurePackageSpecsInstalled(ctx, lo.Map(packageNames, func(name string, _ int) PackageSpec { return PackageSpec{Name: name} }))
+}
+
+// EnsurePackagesInstalledP is the pipeline version of EnsurePackagesInstalled
+func (p *Provisioner) EnsurePackagesInstalledP(packageNames ...string) pipeline.FuncT {
+	return func(ctx *pipeline.Context) error {
+		updated, err := p.EnsurePackagesInstalled(ctx, packageNames...)
+		if err != nil {
+			return err
+		}
+		ctx.SetResult(updated)
+		return nil
+	}
+}
+
+// EnsurePackagesAbsent ensures that none of the packages are installed
+func (p *Provisioner) EnsurePackagesAbsent(ctx context.Context, packageNames []string, opts RemoveOptions) (bool, error) {
+	manager, family, err := p.GetPackageManager(ctx)
+	if err != nil {
+		return false, err
+	}
+	mappings := p.nameMappings()
+	mapped := lo.Uniq(lo.Map(packageNames, func(name string, _ int) string { return mappings.Map(family, name) }))
+	return manager.EnsurePackagesAbsent(ctx, mapped, opts)
+}
+
+// EnsurePackagesAbsentP is the pipeline version of EnsurePackagesAbsent
+func (p *Provisioner) EnsurePackagesAbsentP(packageNames []string, opts RemoveOptions) pipeline.FuncT {
+	return func(ctx *pipeline.Context) error {
+		updated, err := p.EnsurePackagesAbsent(ctx, packageNames, opts)
+		if err != nil {
+			return err
+		}
+		ctx.SetResult(updated)
+		return nil
+	}
+}
@@ -0,0 +1,64 @@
+package packages
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ctr2cloud/ctr2cloud/internal/test"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFamilyFromOSRelease(t *testing.T) {
+	cases := []struct {
+		osRelease map[string]string
+		expected  Family
+	}{
+		{map[string]string{"ID": "debian"}, FamilyDebian},
+		{map[string]string{"ID": "ubuntu", "ID_LIKE": "debian"}, FamilyDebian},
+		{map[string]string{"ID": "linuxmint", "ID_LIKE": "ubuntu debian"}, FamilyDebian},
+		{map[string]string{"ID": "rocky", "ID_LIKE": "rhel centos fedora"}, FamilyRHEL},
+		{map[string]string{"ID": "fedora"}, FamilyRHEL},
+		{map[string]string{"ID": "ol", "ID_LIKE": "fedora"}, FamilyRHEL},
+		{map[string]string{"ID": "alpine"}, FamilyAlpine},
+	}
+	for _, c := range cases {
+		family, err := FamilyFromOSRelease(c.osRelease)
+		require.NoError(t, err)
+		require.Equal(t, c.expected, family, c.osRelease)
+	}
+
+	_, err := FamilyFromOSRelease(map[string]string{"ID": "arch"})
+	require.True(t, errors.Is(err, ErrUnsupportedDistribution))
+}
+
+func TestNameMappings(t *testing.T) {
+	require.Equal(t, "openssh-server", DefaultNameMappings.Map(FamilyDebian, "openssh-server"))
+	require.Equal(t, "openssh", DefaultNameMappings.Map(FamilyAlpine, "openssh-server"))
+	require.Equal(t, "bind-utils", DefaultNameMappings.Map(FamilyRHEL, "dnsutils"))
+	require.Equal(t, "curl", DefaultNameMappings.Map(FamilyRHEL, "curl"))
+}
+
+const testEnsurePackagesInstalledInstanceName = "test-packages-ensure-installed"
+
+func TestEnsurePackagesInstalled(t *testing.T) {
+	executor, err := test.GetLXDExecutorFactory(t, testEnsurePackagesInstalledInstanceName)()
+	ctx, r := test.DefaultPreamble(t, 2*time.Minute)
+	r.NoError(err)
+	pProvisioner := Provisioner{CommandExecutor: executor}
+
+	family, err := DetectFamily(ctx, executor)
+	r.NoError(err)
+	r.Equal(FamilyDebian, family)
+
+	test.RequireIdempotence(r, func() (bool, error) {
+		return pProvisioner.EnsurePackagesInstalled(ctx, "curl", "jq", "dnsutils")
+	})
+	versions, err := pProvisioner.GetPackageVersions(ctx, "curl", "jq", "dnsutils")
+	r.NoError(err)
+	r.Len(versions, 3)
+
+	test.RequireIdempotence(r, func() (bool, error) {
+		return pProvisioner.EnsurePackagesAbsent(ctx, []string{"jq"}, RemoveOptions{})
+	})
+}
@@ -0,0 +1,249 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/ctr2cloud/ctr2cloud/pkg/facts"
+	"github.com/ctr2cloud/ctr2cloud/pkg/generic/compute"
+	"github.com/juju/zaputil/zapctx"
+	"go.uber.org/zap"
+)
+
+type action string
+
+const (
+	actionStart   action = "start"
+	actionStop    action = "stop"
+	actionRestart action = "restart"
+	actionReload  action = "reload"
+	actionEnable  action = "enable"
+	actionDisable action = "disable"
+)
+
+// scriptBackend provides the shell commands of an init system managed with scripts
+type scriptBackend interface {
+	initSystem() facts.InitSystem
+	// statusCmd must print exists=yes|no, running=yes|no and enabled=yes|no on separate lines
+	statusCmd(quotedName string) string
+	actionCmd(a action, quotedName string) string
+}
+
+// yesNo returns a shell snippet printing key=yes if condition succeeds and key=no otherwise
+func yesNo(key, condition string) string {
+	return fmt.Sprintf("if %s; then echo %s=yes; else echo %s=no; fi", condition, key, key)
+}
+
+type openrcBackend struct{}
+
+func (openrcBackend) initSystem() facts.InitSystem {
+	return facts.InitOpenRC
+}
+
+func (openrcBackend) statusCmd(name string) string {
+	return strings.Join([]string{
+		yesNo("exists", "[ -x /etc/init.d/"+name+" ]"),
+		yesNo("running", "rc-service "+name+" status >/dev/null 2>&1"),
+		yesNo("enabled", "[ -e /etc/runlevels/default/"+name+" ]"),
+	}, "; ")
+}
+
+func (openrcBackend) actionCmd(a action, name string) string {
+	switch a {
+	case actionEnable:
+		return "rc-update add " + name + " default"
+	case actionDisable:
+		return "rc-update del " + name + " default"
+	default:
+		return fmt.Sprintf("rc-service %s %s", name, a)
+	}
+}
+
+type sysvinitBackend struct{}
+
+func (sysvinitBackend) initSystem() facts.InitSystem {
+	return facts.InitSysVinit
+}
+
+func (sysvinitBackend) statusCmd(name string) string {
+	return strings.Join([]string{
+		yesNo("exists", "[ -x /etc/init.d/"+name+" ]"),
+		// LSB init scripts exit with 0 if the service is running
+		yesNo("running", "service "+name+" status >/dev/null 2>&1"),
+		yesNo("enabled", "ls /etc/rc[2345].d/S*"+name+" >/dev/null 2>&1"),
+	}, "; ")
+}
+
+func (sysvinitBackend) actionCmd(a action, name string) string {
+	switch a {
+	case actionEnable:
+		// update-rc.d on Debian, chkconfig on RHEL
+		return fmt.Sprintf("if command -v update-rc.d >/dev/null; then update-rc.d %s defaults && update-rc.d %s enable; else chkconfig %s on; fi", name, name, name)
+	case actionDisable:
+		return fmt.Sprintf("if command -v update-rc.d >/dev/null; then update-rc.d %s disable; else chkconfig %s off; fi", name, name)
+	default:
+		return fmt.Sprintf("service %s %s", name, a)
+	}
+}
+
+type runitBackend struct{}
+
+func (runitBackend) initSystem() facts.InitSystem {
+	return facts.InitRunit
+}
+
+// runitServiceDir is /var/service on Void Linux and /etc/service on Debian
+const runitServiceDir = "$([ -d /var/service ] && echo /var/service || echo /etc/service)"
+
+func (runitBackend) statusCmd(name string) string {
+	return strings.Join([]string{
+		yesNo("exists", "[ -d /etc/sv/"+name+" ]"),
+		yesNo("running", "sv status "+name+" 2>/dev/null | grep -q '^run:'"),
+		yesNo("enabled", "[ -e "+runitServiceDir+"/"+name+" ]"),
+	}, "; ")
+}
+
+func (runitBackend) actionCmd(a action, name string) string {
+	switch a {
+	case actionEnable:
+		return fmt.Sprintf("ln -s /etc/sv/%s %s/", name, runitServiceDir)
+	case actionDisable:
+		return fmt.Sprintf("rm %s/%s", runitServiceDir, name)
+	case actionStart:
+		return "sv up " + name
+	case actionStop:
+		return "sv down " + name
+	case actionReload:
+		return "sv reload " + name
+	default:
+		return fmt.Sprintf("sv %s %s", a, name)
+	}
+}
+
+type scriptStatus struct {
+	exists  bool
+	running bool
+	enabled bool
+}
+
+// parseScriptStatus parses the output of scriptBackend.statusCmd
+func parseScriptStatus(output string) (scriptStatus, error) {
+	values := make(map[string]string)
+	for _, line := range strings.Split(output, "\n") {
+		if key, value, ok := strings.Cut(strings.TrimSpace(line), "="); ok {
+			values[key] = value
+		}
+	}
+	for _, key := range []string{"exists", "running", "enabled"} {
+		if values[key] != "yes" && values[key] != "no" {
+			return scriptStatus{}, fmt.Errorf("unexpected service status output: %s", output)
+		}
+	}
+	return scriptStatus{
+		exists:  values["exists"] == "yes",
+		running: values["running"] == "yes",
+		enabled: values["enabled"] == "yes",
+	}, nil
+}
+
+// scriptActions returns the actions needed to move from status to desired
+func scriptActions(status scriptStatus, desired State) ([]action, error) {
+	actions := make([]action, 0)
+	switch desired.Enablement {
+	case EnablementUnchanged:
+	case EnablementEnabled:
+		if !status.enabled {
+			actions = append(actions, actionEnable)
+		}
+	case EnablementDisabled:
+		if status.enabled {
+			actions = append(actions, actionDisable)
+		}
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedState, desired.Enablement)
+	}
+
+	switch desired.Active {
+	case ActiveStateUnchanged:
+	case ActiveStateStarted:
+		if !status.running {
+			actions = append(actions, actionStart)
+		}
+	case ActiveStateStopped:
+		if status.running {
+			actions = append(actions, actionStop)
+		}
+	case ActiveStateRestarted:
+		if status.running {
+			actions = append(actions, actionRestart)
+		} else {
+			actions = append(actions, actionStart)
+		}
+	case ActiveStateReloaded:
+		if status.running {
+			actions = append(actions, actionReload)
+		} else {
+			actions = append(actions, actionStart)
+		}
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedState, desired.Active)
+	}
+	return actions, nil
+}
+
+// scriptManager implements Manager for init systems without a service manager daemon
+type scriptManager struct {
+	*compute.CommandExecutor
+	backend scriptBackend
+}
+
+func (m *scriptManager) InitSystem() facts.InitSystem {
+	return m.backend.initSystem()
+}
+
+// EnsureServiceState implements Manager. The .service suffix of systemd unit names is stripped.
+func (m *scriptManager) EnsureServiceState(ctx context.Context, name string, desired State) (bool, error) {
+	logger := zapctx.Logger(ctx)
+	name = strings.TrimSuffix(name, ".service")
+	quotedName := compute.ShellQuote(name)
+
+	output, err := m.CommandExecutor.ExecString(ctx, m.backend.statusCmd(quotedName))
+	if err != nil {
+		return false, fmt.Errorf("getting status of %s: %w", name, err)
+	}
+	status, err := parseScriptStatus(output)
+	if err != nil {
+		return false, err
+	}
+	logger.Debug("service status", zap.String("service", name), zap.Bool("exists", status.exists), zap.Bool("running", status.running), zap.Bool("enabled", status.enabled))
+
+	actions, err := scriptActions(status, desired)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", name, err)
+	}
+	if len(actions) == 0 {
+		return false, nil
+	}
+	if !status.exists {
+		return false, fmt.Errorf("%w: %s", ErrServiceNotFound, name)
+	}
+	for _, a := range actions {
+		cmd := m.backend.actionCmd(a, quotedName)
+		logger.Debug("changing service state", zap.String("service", name), zap.String("cmd", cmd))
+		output, err := m.CommandExecutor.ExecString(ctx, cmd)
+		if err != nil {
+			return true, fmt.Errorf("%s %s: %s: %w", a, name, strings.TrimSpace(output), err)
+		}
+	}
+	return true, nil
+}
+
+// EnsureServiceEnabledNow implements Manager
+func (m *scriptManager) EnsureServiceEnabledNow(ctx context.Context, name string, forceRestart bool) (bool, error) {
+	desired := State{Active: ActiveStateStarted, Enablement: EnablementEnabled}
+	if forceRestart {
+		desired.Active = ActiveStateRestarted
+	}
+	return m.EnsureServiceState(ctx, name, desired)
+}
@@ -0,0 +1,126 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/ctr2cloud/ctr2cloud/pkg/facts"
+	"github.com/ctr2cloud/ctr2cloud/pkg/generic/compute"
+	"github.com/ctr2cloud/ctr2cloud/pkg/pipeline"
+	"github.com/ctr2cloud/ctr2cloud/pkg/provisioners/systemd"
+)
+
+var ErrUnsupportedInitSystem = errors.New("unsupported init system")
+var ErrUnsupportedState = errors.New("state not supported by init system")
+var ErrServiceNotFound = errors.New("service not found")
+
+// The desired states are shared with the systemd provisioner, other init systems
+// only support a subset of them.
+type (
+	ActiveState = systemd.ActiveState
+	Enablement  = systemd.Enablement
+	State       = systemd.ServiceState
+)
+
+const (
+	ActiveStateUnchanged = systemd.ActiveStateUnchanged
+	ActiveStateStarted   = systemd.ActiveStateStarted
+	ActiveStateStopped   = systemd.ActiveStateStopped
+	ActiveStateRestarted = systemd.ActiveStateRestarted
+	ActiveStateReloaded  = systemd.ActiveStateReloaded
+
+	EnablementUnchanged = systemd.EnablementUnchanged
+	EnablementEnabled   = systemd.EnablementEnabled
+	EnablementDisabled  = systemd.EnablementDisabled
+	// EnablementMasked and EnablementStatic are only supported by systemd
+	EnablementMasked = systemd.EnablementMasked
+	EnablementStatic = systemd.EnablementStatic
+)
+
+// Manager manages services with the init system of an instance
+type Manager interface {
+	InitSystem() facts.InitSystem
+	// EnsureServiceState moves a service to the desired active state and enablement
+	EnsureServiceState(ctx context.Context, name string, desired State) (bool, error)
+	// EnsureServiceEnabledNow ensures that a service is enabled and running,
+	// forceRestart restarts it even if it is already running
+	EnsureServiceEnabledNow(ctx context.Context, name string, forceRestart bool) (bool, error)
+}
+
+type systemdManager struct {
+	systemd.Provisioner
+}
+
+func (m *systemdManager) InitSystem() facts.InitSystem {
+	return facts.InitSystemd
+}
+
+// Provisioner manages services independently of the init system of the instance
+type Provisioner struct {
+	*compute.CommandExecutor
+}
+
+// GetManager returns the manager for the init system of the instance
+func (p *Provisioner) GetManager(ctx context.Context) (Manager, error) {
+	f, err := facts.Get(ctx, p.CommandExecutor)
+	if err != nil {
+		return nil, err
+	}
+	switch f.InitSystem {
+	case facts.InitSystemd:
+		return &systemdManager{systemd.Provisioner{CommandExecutor: p.CommandExecutor}}, nil
+	case facts.InitOpenRC:
+		return &scriptManager{CommandExecutor: p.CommandExecutor, backend: openrcBackend{}}, nil
+	case facts.InitSysVinit:
+		return &scriptManager{CommandExecutor: p.CommandExecutor, backend: sysvinitBackend{}}, nil
+	case facts.InitRunit:
+		return &scriptManager{CommandExecutor: p.CommandExecutor, backend: runitBackend{}}, nil
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedInitSystem, f.InitSystem)
+	}
+}
+
+// EnsureServiceState moves the service name to the desired state with the init system of the instance
+func (p *Provisioner) EnsureServiceState(ctx context.Context, name string, desired State) (bool, error) {
+	manager, err := p.GetManager(ctx)
+	if err != nil {
+		return false, err
+	}
+	return manager.EnsureServiceState(ctx, name, desired)
+}
+
+// EnsureServiceStateP is the pipeline version of EnsureServiceState
+func (p *Provisioner) EnsureServiceStateP(name string, desired State) pipeline.FuncT {
+	return func(ctx *pipeline.Context) error {
+		changed, err := p.EnsureServiceState(ctx, name, desired)
+		if err != nil {
+			return err
+		}
+		ctx.SetResult(changed)
+		return nil
+	}
+}
+
+// EnsureServiceEnabledNow ensures that the service name is enabled and running
+//
+// forceRestart should only be used if dependencies have changed
+func (p *Provisioner) EnsureServiceEnabledNow(ctx context.Context, name string, forceRestart bool) (bool, error) {
+	manager, err := p.GetManager(ctx)
+	if err != nil {
+		return false, err
+	}
+	return manager.EnsureServiceEnabledNow(ctx, name, forceRestart)
+}
+
+// EnsureServiceEnabledP is the pipeline version of EnsureServiceEnabledNow, it restarts the service if the previous step changed
+func (p *Provisioner) EnsureServiceEnabledP(name string) pipeline.FuncT {
+	return func(ctx *pipeline.Context) error {
+		changed, err := p.EnsureServiceEnabledNow(ctx, name, ctx.PreviousHasChanges())
+		if err != nil {
+			return err
+		}
+		ctx.SetResult(changed)
+		return nil
+	}
+}
@@ -0,0 +1,75 @@
+package service
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ctr2cloud/ctr2cloud/internal/test"
+	"github.com/ctr2cloud/ctr2cloud/pkg/facts"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseScriptStatus(t *testing.T) {
+	status, err := parseScriptStatus("exists=yes\nrunning=no\nenabled=yes\n")
+	require.NoError(t, err)
+	require.Equal(t, scriptStatus{exists: true, enabled: true}, status)
+
+	_, err = parseScriptStatus("exists=yes\n")
+	require.Error(t, err)
+}
+
+func TestScriptActions(t *testing.T) {
+	stopped := scriptStatus{exists: true}
+	running := scriptStatus{exists: true, running: true, enabled: true}
+
+	actions, err := scriptActions(stopped, State{Active: ActiveStateStarted, Enablement: EnablementEnabled})
+	require.NoError(t, err)
+	require.Equal(t, []action{actionEnable, actionStart}, actions)
+
+	actions, err = scriptActions(running, State{Active: ActiveStateStarted, Enablement: EnablementEnabled})
+	require.NoError(t, err)
+	require.Empty(t, actions)
+
+	actions, err = scriptActions(running, State{Active: ActiveStateStopped, Enablement: EnablementDisabled})
+	require.NoError(t, err)
+	require.Equal(t, []action{actionDisable, actionStop}, actions)
+
+	actions, err = scriptActions(running, State{Active: ActiveStateRestarted})
+	require.NoError(t, err)
+	require.Equal(t, []action{actionRestart}, actions)
+
+	_, err = scriptActions(running, State{Enablement: EnablementMasked})
+	require.True(t, errors.Is(err, ErrUnsupportedState))
+}
+
+func TestBackendCommands(t *testing.T) {
+	require.Equal(t, "rc-update add docker default", openrcBackend{}.actionCmd(actionEnable, "docker"))
+	require.Equal(t, "rc-service docker restart", openrcBackend{}.actionCmd(actionRestart, "docker"))
+	require.Equal(t, "service docker start", sysvinitBackend{}.actionCmd(actionStart, "docker"))
+	require.Equal(t, "sv up docker", runitBackend{}.actionCmd(actionStart, "docker"))
+	for _, backend := range []scriptBackend{openrcBackend{}, sysvinitBackend{}, runitBackend{}} {
+		require.Contains(t, backend.statusCmd("docker"), "echo running=yes")
+	}
+}
+
+const testEnsureServiceStateInstanceName = "test-service-ensure-state"
+
+func TestEnsureServiceState(t *testing.T) {
+	executor, err := test.GetLXDExecutorFactory(t, testEnsureServiceStateInstanceName)()
+	ctx, r := test.DefaultPreamble(t, time.Minute)
+	r.NoError(err)
+	sProvisioner := Provisioner{CommandExecutor: executor}
+
+	manager, err := sProvisioner.GetManager(ctx)
+	r.NoError(err)
+	r.Equal(facts.InitSystemd, manager.InitSystem())
+
+	// cron is enabled and running on the test image
+	test.RequireIdempotence(r, func() (bool, error) {
+		return sProvisioner.EnsureServiceState(ctx, "cron.service", State{Active: ActiveStateStopped, Enablement: EnablementDisabled})
+	})
+	test.RequireIdempotence(r, func() (bool, error) {
+		return sProvisioner.EnsureServiceEnabledNow(ctx, "cron.service", false)
+	})
+}
@@ -0,0 +1,175 @@
+package systemd
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/ctr2cloud/ctr2cloud/pkg/generic/compute"
+	"github.com/ctr2cloud/ctr2cloud/pkg/pipeline"
+	"github.com/ctr2cloud/ctr2cloud/pkg/provisioners/file"
+	"github.com/juju/zaputil/zapctx"
+	"go.uber.org/zap"
+)
+
+type DropInOptions struct {
+	// RemoveUnmanaged removes all other drop-ins of the unit in UnitDir
+	RemoveUnmanaged bool
+	// Restart restarts the unit if it is running and a drop-in changed.
+	// In a pipeline, EnsureServiceEnabledP can be used instead as it restarts on previous changes.
+	Restart bool
+}
+
+// DropInDir returns the directory holding the drop-ins of unit
+func DropInDir(unit string) string {
+	return path.Join(UnitDir, unit+".d")
+}
+
+func dropInPath(unit, name string) string {
+	return path.Join(DropInDir(unit), name+".conf")
+}
+
+// parseDropInListing returns the drop-in names from a listing of .conf files
+func parseDropInListing(output string) []string {
+	names := make([]string, 0)
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasSuffix(line, ".conf") {
+			continue
+		}
+		names = append(names, strings.TrimSuffix(path.Base(line), ".conf"))
+	}
+	slices.Sort(names)
+	return names
+}
+
+// GetDropIns returns the names of the drop-ins of unit in UnitDir, without the .conf suffix
+func (p *Provisioner) GetDropIns(ctx context.Context, unit string) ([]string, error) {
+	quotedDir := compute.ShellQuote(DropInDir(unit))
+	cmd := fmt.Sprintf("if [ -d %s ]; then find %s -maxdepth 1 -type f -name '*.conf'; fi", quotedDir, quotedDir)
+	output, err := p.CommandExecutor.ExecString(ctx, cmd)
+	if err != nil {
+		return nil, fmt.Errorf("listing drop-ins of %s: %w", unit, err)
+	}
+	return parseDropInListing(output), nil
+}
+
+// applyUnitChange reloads systemd and optionally restarts unit after its definition changed
+func (p *Provisioner) applyUnitChange(ctx context.Context, unit string, restart bool) error {
+	err := p.DaemonReload(ctx)
+	if err != nil {
+		return err
+	}
+	if !restart {
+		return nil
+	}
+	output, err := p.CommandExecutor.ExecString(ctx, "systemctl try-restart "+compute.ShellQuote(unit))
+	if err != nil {
+		return fmt.Errorf("restarting %s: %s: %w", unit, strings.TrimSpace(output), err)
+	}
+	return nil
+}
+
+// EnsureDropIns ensures that unit has the drop-ins in dropIns, keyed by name without the .conf suffix.
+// systemd is only reloaded if a drop-in was written or removed.
+func (p *Provisioner) EnsureDropIns(ctx context.Context, unit string, dropIns map[string]string, opts DropInOptions) (bool, error) {
+	logger := zapctx.Logger(ctx)
+	fProvisioner := file.Provisioner{CommandExecutor: p.CommandExecutor}
+	changed := false
+
+	if len(dropIns) > 0 {
+		_, err := p.CommandExecutor.Exec(ctx, "mkdir -p "+compute.ShellQuote(DropInDir(unit)))
+		if err != nil {
+			return false, fmt.Errorf("creating drop-in directory of %s: %w", unit, err)
+		}
+	}
+	names := make([]string, 0, len(dropIns))
+	for name := range dropIns {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		updated, err := fProvisioner.EnsureFileContentsString(ctx, dropInPath(unit, name), dropIns[name])
+		if err != nil {
+			return changed, fmt.Errorf("writing drop-in %s of %s: %w", name, unit, err)
+		}
+		if updated {
+			logger.Debug("drop-in changed", zap.String("unit", unit), zap.String("name", name))
+		}
+		changed = changed || updated
+	}
+
+	if opts.RemoveUnmanaged {
+		existing, err := p.GetDropIns(ctx, unit)
+		if err != nil {
+			return changed, err
+		}
+		for _, name := range existing {
+			if _, ok := dropIns[name]; ok {
+				continue
+			}
+			logger.Debug("removing unmanaged drop-in", zap.String("unit", unit), zap.String("name", name))
+			_, err = fProvisioner.EnsureFileAbsent(ctx, dropInPath(unit, name))
+			if err != nil {
+				return changed, fmt.Errorf("removing drop-in %s of %s: %w", name, unit, err)
+			}
+			changed = true
+		}
+	}
+
+	if !changed {
+		return false, nil
+	}
+	return true, p.applyUnitChange(ctx, unit, opts.Restart)
+}
+
+// EnsureDropInsP is the pipeline version of EnsureDropIns
+func (p *Provisioner) EnsureDropInsP(unit string, dropIns map[string]string, opts DropInOptions) pipeline.FuncT {
+	return func(ctx *pipeline.Context) error {
+		changed, err := p.EnsureDropIns(ctx, unit, dropIns, opts)
+		if err != nil {
+			return err
+		}
+		ctx.SetResult(changed)
+		return nil
+	}
+}
+
+// EnsureDropIn ensures that /etc/systemd/system/<unit>.d/<name>.conf has content.
+// Other drop-ins of the unit are left alone.
+func (p *Provisioner) EnsureDropIn(ctx context.Context, unit, name, content string, restart bool) (bool, error) {
+	return p.EnsureDropIns(ctx, unit, map[string]string{name: content}, DropInOptions{Restart: restart})
+}
+
+// EnsureDropInP is the pipeline version of EnsureDropIn, it does not restart the unit.
+// Follow it with EnsureServiceEnabledP to restart the unit if the drop-in changed.
+func (p *Provisioner) EnsureDropInP(unit, name, content string) pipeline.FuncT {
+	return p.EnsureDropInsP(unit, map[string]string{name: content}, DropInOptions{})
+}
+
+// EnsureDropInAbsent removes the drop-in name of unit
+func (p *Provisioner) EnsureDropInAbsent(ctx context.Context, unit, name string, restart bool) (bool, error) {
+	fProvisioner := file.Provisioner{CommandExecutor: p.CommandExecutor}
+	removed, err := fProvisioner.EnsureFileAbsent(ctx, dropInPath(unit, name))
+	if err != nil {
+		return false, fmt.Errorf("removing drop-in %s of %s: %w", name, unit, err)
+	}
+	if !removed {
+		return false, nil
+	}
+	return true, p.applyUnitChange(ctx, unit, restart)
+}
+
+// EnsureDropInAbsentP is the pipeline version of EnsureDropInAbsent, it does not restart the unit
+func (p *Provisioner) EnsureDropInAbsentP(unit, name string) pipeline.FuncT {
+	return func(ctx *pipeline.Context) error {
+		changed, err := p.EnsureDropInAbsent(ctx, unit, name, false)
+		if err != nil {
+			return err
+		}
+		ctx.SetResult(changed)
+		return nil
+	}
+}
@@ -0,0 +1,68 @@
+package systemd
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ctr2cloud/ctr2cloud/internal/test"
+	"github.com/ctr2cloud/ctr2cloud/pkg/pipeline"
+	"github.com/ctr2cloud/ctr2cloud/pkg/provisioners/file"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseDropInListing(t *testing.T) {
+	output := "/etc/systemd/system/docker.service.d/limits.conf\n/etc/systemd/system/docker.service.d/10-env.conf\n"
+	require.Equal(t, []string{"10-env", "limits"}, parseDropInListing(output))
+	require.Empty(t, parseDropInListing(""))
+}
+
+const testEnsureDropInInstanceName = "test-ensure-drop-in"
+
+func TestEnsureDropIn(t *testing.T) {
+	executor, err := test.GetLXDExecutorFactory(t, testEnsureDropInInstanceName)()
+	ctx, r := test.DefaultPreamble(t, time.Minute)
+	r.NoError(err)
+	sProvisioner := Provisioner{CommandExecutor: executor}
+	fProvisioner := file.Provisioner{CommandExecutor: executor}
+
+	serviceName := fmt.Sprintf("%s.service", testEnsureDropInInstanceName)
+	_, err = sProvisioner.EnsureUnit(ctx, UnitSpec{
+		Name:    serviceName,
+		Service: &ServiceSection{ExecStart: []string{"/bin/sleep 1000"}},
+		Install: InstallSection{WantedBy: []string{"multi-user.target"}},
+	})
+	r.NoError(err)
+
+	// an unmanaged drop-in which is removed below
+	_, err = executor.Exec(ctx, "mkdir -p "+DropInDir(serviceName))
+	r.NoError(err)
+	_, err = fProvisioner.EnsureFileContentsString(ctx, dropInPath(serviceName, "stale"), "[Service]\nNice=5\n")
+	r.NoError(err)
+
+	limits := "[Service]\nLimitNOFILE=4096\n"
+	p := pipeline.NewPipeline(ctx, []pipeline.FuncT{
+		sProvisioner.EnsureDropInP(serviceName, "limits", limits),
+		sProvisioner.EnsureServiceEnabledP(serviceName),
+	})
+	r.NoError(p.Run())
+
+	limit, err := executor.ExecString(ctx, "systemctl show -p LimitNOFILE --value "+serviceName)
+	r.NoError(err)
+	r.Equal("4096", strings.TrimSpace(limit))
+
+	dropIns := map[string]string{"limits": limits}
+	test.RequireIdempotence(r, func() (bool, error) {
+		return sProvisioner.EnsureDropIns(ctx, serviceName, dropIns, DropInOptions{RemoveUnmanaged: true, Restart: true})
+	})
+	names, err := sProvisioner.GetDropIns(ctx, serviceName)
+	r.NoError(err)
+	r.Equal([]string{"limits"}, names)
+
+	test.RequireIdempotence(r, func() (bool, error) {
+		return sProvisioner.EnsureDropInAbsent(ctx, serviceName, "limits", true)
+	})
+	_, err = sProvisioner.EnsureUnitAbsent(ctx, serviceName)
+	r.NoError(err)
+}
@@ -0,0 +1,259 @@
+package systemd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/ctr2cloud/ctr2cloud/pkg/generic/compute"
+	"github.com/ctr2cloud/ctr2cloud/pkg/pipeline"
+	"github.com/juju/zaputil/zapctx"
+	"go.uber.org/zap"
+)
+
+var ErrInvalidServiceState = errors.New("invalid service state")
+var ErrUnitNotFound = errors.New("unit not found")
+
+// ActiveState is the desired runtime state of a unit
+type ActiveState string
+
+const (
+	// ActiveStateUnchanged leaves the runtime state alone
+	ActiveStateUnchanged ActiveState = ""
+	ActiveStateStarted   ActiveState = "started"
+	ActiveStateStopped   ActiveState = "stopped"
+	// ActiveStateRestarted restarts a running unit or starts a stopped one, so it always changes the system
+	ActiveStateRestarted ActiveState = "restarted"
+	// ActiveStateReloaded reloads a running unit or starts a stopped one, so it always changes the system.
+	// Units without ExecReload are restarted instead.
+	ActiveStateReloaded ActiveState = "reloaded"
+)
+
+// Enablement is the desired unit file state of a unit
+type Enablement string
+
+const (
+	// EnablementUnchanged leaves the unit file state alone
+	EnablementUnchanged Enablement = ""
+	EnablementEnabled   Enablement = "enabled"
+	EnablementDisabled  Enablement = "disabled"
+	EnablementMasked    Enablement = "masked"
+	// EnablementStatic asserts that the unit has no install section, it is unmasked if needed
+	EnablementStatic Enablement = "static"
+)
+
+type ServiceState struct {
+	Active     ActiveState
+	Enablement Enablement
+}
+
+// ServiceStatus is the current state of a unit as reported by systemctl
+type ServiceStatus struct {
+	// ActiveState is the output of systemctl is-active, e.g. active, inactive or failed
+	ActiveState string
+	// UnitFileState is the output of systemctl is-enabled, e.g. enabled, disabled, static or masked.
+	// It is not-found for units which do not exist.
+	UnitFileState string
+}
+
+// Running returns true if the unit is running or about to run
+func (s ServiceStatus) Running() bool {
+	return slices.Contains([]string{"active", "activating", "reloading", "refreshing"}, s.ActiveState)
+}
+
+// Enabled returns true if the unit is enabled or is started by other means and can not be enabled,
+// e.g. static units without an install section and units generated from sysv scripts
+func (s ServiceStatus) Enabled() bool {
+	return slices.Contains([]string{"enabled", "enabled-runtime", "alias", "static", "indirect", "generated", "transient"}, s.UnitFileState)
+}
+
+// Masked returns true if the unit is masked permanently or at runtime
+func (s ServiceStatus) Masked() bool {
+	return s.UnitFileState == "masked" || s.UnitFileState == "masked-runtime"
+}
+
+// serviceStatusCmd probes the active and the unit file state separately, both commands
+// print the state even if they exit with an error
+func serviceStatusCmd(quotedUnit string) string {
+	return fmt.Sprintf("echo is-active=$(systemctl is-active %s); echo is-enabled=$(systemctl is-enabled %s 2>&1)", quotedUnit, quotedUnit)
+}
+
+// parseServiceStatus parses the output of serviceStatusCmd
+func parseServiceStatus(output string) (ServiceStatus, error) {
+	var status ServiceStatus
+	var hasActive, hasEnabled bool
+	for _, line := range strings.Split(output, "\n") {
+		key, value, ok := strings.Cut(strings.TrimSpace(line), "=")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "is-active":
+			status.ActiveState, hasActive = value, true
+		case "is-enabled":
+			// older systemd versions print an error instead of not-found, e.g.
+			// Failed to get unit file state for foo.service: No such file or directory
+			if strings.Contains(value, "No such file or directory") || value == "" {
+				value = "not-found"
+			}
+			status.UnitFileState, hasEnabled = value, true
+		}
+	}
+	if !hasActive || !hasEnabled {
+		return status, fmt.Errorf("unexpected service status output: %s", output)
+	}
+	return status, nil
+}
+
+// GetServiceStatus returns the active and unit file state of unit
+func (p *Provisioner) GetServiceStatus(ctx context.Context, unit string) (ServiceStatus, error) {
+	output, err := p.CommandExecutor.ExecString(ctx, serviceStatusCmd(compute.ShellQuote(unit)))
+	if err != nil {
+		return ServiceStatus{}, fmt.Errorf("getting status of %s: %w", unit, err)
+	}
+	return parseServiceStatus(output)
+}
+
+// enablementCommands returns the systemctl commands needed to move from status to desired
+func enablementCommands(status ServiceStatus, desired Enablement) ([]string, error) {
+	switch desired {
+	case EnablementUnchanged:
+		return nil, nil
+	case EnablementMasked:
+		if status.UnitFileState == "masked" {
+			return nil, nil
+		}
+		return []string{"mask"}, nil
+	}
+
+	commands := make([]string, 0)
+	state := status.UnitFileState
+	if status.Masked() {
+		commands = append(commands, "unmask")
+		// the state behind the mask is unknown, enabling and disabling are idempotent
+		state = ""
+	}
+	switch desired {
+	case EnablementEnabled:
+		switch state {
+		case "enabled", "enabled-runtime", "alias":
+		case "static", "indirect", "generated", "transient":
+			return nil, fmt.Errorf("%w: %s units can not be enabled", ErrInvalidServiceState, state)
+		default:
+			commands = append(commands, "enable")
+		}
+	case EnablementDisabled:
+		switch state {
+		case "enabled", "enabled-runtime", "linked", "linked-runtime", "":
+			commands = append(commands, "disable")
+		}
+	case EnablementStatic:
+		if state != "static" && state != "" {
+			return nil, fmt.Errorf("%w: unit is %s, not static", ErrInvalidServiceState, state)
+		}
+	default:
+		return nil, fmt.Errorf("%w: unknown enablement %s", ErrInvalidServiceState, desired)
+	}
+	return commands, nil
+}
+
+// activeCommands returns the systemctl commands needed to move from status to desired
+func activeCommands(status ServiceStatus, desired ActiveState) ([]string, error) {
+	switch desired {
+	case ActiveStateUnchanged:
+		return nil, nil
+	case ActiveStateStarted:
+		if status.Running() {
+			return nil, nil
+		}
+		// a unit which hit its start limit can not be started before resetting it
+		return []string{"reset-failed", "start"}, nil
+	case ActiveStateStopped:
+		if !status.Running() {
+			return nil, nil
+		}
+		return []string{"stop"}, nil
+	case ActiveStateRestarted:
+		if !status.Running() {
+			return []string{"reset-failed", "start"}, nil
+		}
+		return []string{"restart"}, nil
+	case ActiveStateReloaded:
+		if !status.Running() {
+			return []string{"reset-failed", "start"}, nil
+		}
+		return []string{"reload-or-restart"}, nil
+	default:
+		return nil, fmt.Errorf("%w: unknown active state %s", ErrInvalidServiceState, desired)
+	}
+}
+
+// EnsureServiceState moves unit to the desired active state and enablement independently.
+// The unit file state is changed before the active state, so that e.g. a masked unit is stopped afterwards.
+func (p *Provisioner) EnsureServiceState(ctx context.Context, unit string, desired ServiceState) (bool, error) {
+	logger := zapctx.Logger(ctx)
+	if desired.Enablement == EnablementMasked && desired.Active != ActiveStateUnchanged && desired.Active != ActiveStateStopped {
+		return false, fmt.Errorf("%w: masked units can not be %s", ErrInvalidServiceState, desired.Active)
+	}
+	status, err := p.GetServiceStatus(ctx, unit)
+	if err != nil {
+		return false, err
+	}
+	logger.Debug("service status", zap.String("unit", unit), zap.String("active", status.ActiveState), zap.String("enabled", status.UnitFileState))
+	if status.UnitFileState == "not-found" {
+		switch {
+		case desired.Enablement == EnablementMasked:
+			// units which do not exist can still be masked
+		case (desired.Active == ActiveStateUnchanged || desired.Active == ActiveStateStopped) &&
+			(desired.Enablement == EnablementUnchanged || desired.Enablement == EnablementDisabled):
+			logger.Debug("service does not exist", zap.String("unit", unit))
+			return false, nil
+		default:
+			return false, fmt.Errorf("%w: %s", ErrUnitNotFound, unit)
+		}
+	}
+
+	commands, err := enablementCommands(status, desired.Enablement)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", unit, err)
+	}
+	activeCmds, err := activeCommands(status, desired.Active)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", unit, err)
+	}
+	commands = append(commands, activeCmds...)
+	if len(commands) == 0 {
+		logger.Debug("service already in desired state", zap.String("unit", unit))
+		return false, nil
+	}
+
+	quotedUnit := compute.ShellQuote(unit)
+	for _, command := range commands {
+		cmd := fmt.Sprintf("systemctl %s %s", command, quotedUnit)
+		logger.Debug("changing service state", zap.String("unit", unit), zap.String("cmd", cmd))
+		output, err := p.CommandExecutor.ExecString(ctx, cmd)
+		// reset-failed fails for units which are not loaded, e.g. after unmasking
+		if err != nil && command != "reset-failed" {
+			err = fmt.Errorf("systemctl %s %s: %s: %w", command, unit, strings.TrimSpace(output), err)
+			if slices.Contains([]string{"start", "restart", "reload-or-restart"}, command) {
+				err = fmt.Errorf("%w\n%s", err, p.GetDiagnostics(ctx, unit, DefaultJournalLines))
+			}
+			return true, err
+		}
+	}
+	return true, nil
+}
+
+// EnsureServiceStateP is the pipeline version of EnsureServiceState
+func (p *Provisioner) EnsureServiceStateP(unit string, desired ServiceState) pipeline.FuncT {
+	return func(ctx *pipeline.Context) error {
+		changed, err := p.EnsureServiceState(ctx, unit, desired)
+		if err != nil {
+			return err
+		}
+		ctx.SetResult(changed)
+		return nil
+	}
+}
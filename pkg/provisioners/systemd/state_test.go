@@ -0,0 +1,136 @@
+package systemd
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/ctr2cloud/ctr2cloud/internal/test"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseServiceStatus(t *testing.T) {
+	status, err := parseServiceStatus("is-active=active\nis-enabled=enabled\n")
+	require.NoError(t, err)
+	require.Equal(t, ServiceStatus{ActiveState: "active", UnitFileState: "enabled"}, status)
+	require.True(t, status.Running())
+
+	status, err = parseServiceStatus("is-active=inactive\nis-enabled=Failed to get unit file state for foo.service: No such file or directory\n")
+	require.NoError(t, err)
+	require.Equal(t, "not-found", status.UnitFileState)
+	require.False(t, status.Running())
+
+	status, err = parseServiceStatus("is-active=inactive\nis-enabled=masked-runtime\n")
+	require.NoError(t, err)
+	require.True(t, status.Masked())
+
+	_, err = parseServiceStatus("is-active=active\n")
+	require.Error(t, err)
+}
+
+func TestServiceStatusEnabled(t *testing.T) {
+	for _, state := range []string{"enabled", "enabled-runtime", "alias", "static", "indirect", "generated", "transient"} {
+		require.True(t, ServiceStatus{UnitFileState: state}.Enabled(), state)
+	}
+	for _, state := range []string{"disabled", "masked", "linked", "not-found"} {
+		require.False(t, ServiceStatus{UnitFileState: state}.Enabled(), state)
+	}
+}
+
+func TestEnablementCommands(t *testing.T) {
+	cases := []struct {
+		state    string
+		desired  Enablement
+		expected []string
+	}{
+		{"enabled", EnablementEnabled, []string{}},
+		{"disabled", EnablementEnabled, []string{"enable"}},
+		{"masked", EnablementEnabled, []string{"unmask", "enable"}},
+		{"enabled", EnablementDisabled, []string{"disable"}},
+		{"static", EnablementDisabled, []string{}},
+		{"masked", EnablementDisabled, []string{"unmask", "disable"}},
+		{"enabled", EnablementMasked, []string{"mask"}},
+		{"masked", EnablementMasked, nil},
+		{"static", EnablementStatic, []string{}},
+		{"masked", EnablementStatic, []string{"unmask"}},
+		{"enabled", EnablementUnchanged, nil},
+	}
+	for _, c := range cases {
+		commands, err := enablementCommands(ServiceStatus{UnitFileState: c.state}, c.desired)
+		require.NoError(t, err)
+		require.Equal(t, c.expected, commands, "%s -> %s", c.state, c.desired)
+	}
+
+	_, err := enablementCommands(ServiceStatus{UnitFileState: "static"}, EnablementEnabled)
+	require.True(t, errors.Is(err, ErrInvalidServiceState))
+	_, err = enablementCommands(ServiceStatus{UnitFileState: "enabled"}, EnablementStatic)
+	require.True(t, errors.Is(err, ErrInvalidServiceState))
+}
+
+func TestActiveCommands(t *testing.T) {
+	running := ServiceStatus{ActiveState: "active"}
+	failed := ServiceStatus{ActiveState: "failed"}
+	cases := []struct {
+		status   ServiceStatus
+		desired  ActiveState
+		expected []string
+	}{
+		{running, ActiveStateStarted, nil},
+		{failed, ActiveStateStarted, []string{"reset-failed", "start"}},
+		{running, ActiveStateStopped, []string{"stop"}},
+		{failed, ActiveStateStopped, nil},
+		{running, ActiveStateRestarted, []string{"restart"}},
+		{running, ActiveStateReloaded, []string{"reload-or-restart"}},
+		{failed, ActiveStateReloaded, []string{"reset-failed", "start"}},
+	}
+	for _, c := range cases {
+		commands, err := activeCommands(c.status, c.desired)
+		require.NoError(t, err)
+		require.Equal(t, c.expected, commands, "%s -> %s", c.status.ActiveState, c.desired)
+	}
+}
+
+const testEnsureServiceStateInstanceName = "test-ensure-service-state"
+
+func TestEnsureServiceState(t *testing.T) {
+	executor, err := test.GetLXDExecutorFactory(t, testEnsureServiceStateInstanceName)()
+	ctx, r := test.DefaultPreamble(t, time.Minute)
+	r.NoError(err)
+	sProvisioner := Provisioner{CommandExecutor: executor}
+
+	serviceName := fmt.Sprintf("%s.service", testEnsureServiceStateInstanceName)
+	_, err = sProvisioner.EnsureUnit(ctx, UnitSpec{
+		Name:    serviceName,
+		Service: &ServiceSection{ExecStart: []string{"/bin/sleep 1000"}},
+		Install: InstallSection{WantedBy: []string{"multi-user.target"}},
+	})
+	r.NoError(err)
+
+	states := []ServiceState{
+		{Active: ActiveStateStarted, Enablement: EnablementEnabled},
+		{Active: ActiveStateStopped, Enablement: EnablementDisabled},
+		{Active: ActiveStateStopped, Enablement: EnablementMasked},
+		{Active: ActiveStateStarted, Enablement: EnablementEnabled},
+	}
+	for _, state := range states {
+		test.RequireIdempotence(r, func() (bool, error) {
+			return sProvisioner.EnsureServiceState(ctx, serviceName, state)
+		})
+	}
+
+	test.RequireNonIdempotence(r, func() (bool, error) {
+		return sProvisioner.EnsureServiceState(ctx, serviceName, ServiceState{Active: ActiveStateRestarted})
+	})
+
+	_, err = sProvisioner.EnsureServiceState(ctx, serviceName, ServiceState{Active: ActiveStateStarted, Enablement: EnablementMasked})
+	r.True(errors.Is(err, ErrInvalidServiceState))
+	_, err = sProvisioner.EnsureServiceState(ctx, "does-not-exist.service", ServiceState{Active: ActiveStateStarted})
+	r.True(errors.Is(err, ErrUnitNotFound))
+	changed, err := sProvisioner.EnsureServiceState(ctx, "does-not-exist.service", ServiceState{Active: ActiveStateStopped})
+	r.NoError(err)
+	r.False(changed)
+
+	_, err = sProvisioner.EnsureUnitAbsent(ctx, serviceName)
+	r.NoError(err)
+}
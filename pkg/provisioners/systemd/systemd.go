@@ -15,38 +15,40 @@ type Provisioner struct {
 	*compute.CommandExecutor
 }
 
-// EnsureServiceEnabledNow ensures that that a service is in the desired state
+// EnsureServiceEnabledNow ensures that that a service is enabled and running.
+// systemd is reloaded before changing the service in case its unit file was written directly.
 //
 // forceRestart should only be used if dependencies have changed
 func (p *Provisioner) EnsureServiceEnabledNow(ctx context.Context, service string, forceRestart bool) (bool, error) {
 	logger := zapctx.Logger(ctx)
-	checkCmd := fmt.Sprintf("systemctl is-active is-enabled %s", service)
-	isEnabledOutput, err := p.CommandExecutor.Exec(ctx, checkCmd)
-	isEnabledNow := err == nil
-	if isEnabledNow {
+	status, err := p.GetServiceStatus(ctx, service)
+	if err != nil {
+		return false, err
+	}
+	if status.Running() && status.Enabled() && !forceRestart {
 		logger.Debug("service already enabled and running", zap.String("service", service))
-		if !forceRestart {
-			return false, nil
-		}
-	} else {
-		logger.Debug("service not enabled or running", zap.String("service", service), zap.ByteString("output", isEnabledOutput))
+		return false, nil
 	}
+	logger.Debug("service not enabled or running", zap.String("service", service), zap.String("active", status.ActiveState), zap.String("enabled", status.UnitFileState))
 
-	enableCmdBase := "systemctl daemon-reload"
-	enableCmdPart := ""
-	if isEnabledNow && forceRestart {
-		enableCmdPart = fmt.Sprintf("systemctl restart %s", service)
-	} else {
-		enableCmdPart = fmt.Sprintf("systemctl reset-failed %s; systemctl enable --now %s", service, service)
+	err = p.DaemonReload(ctx)
+	if err != nil {
+		return false, err
+	}
+	desired := ServiceState{Active: ActiveStateStarted, Enablement: EnablementEnabled}
+	if status.Enabled() {
+		// static and generated units can not be enabled, they only have to be started
+		desired.Enablement = EnablementUnchanged
+	}
+	if forceRestart {
+		desired.Active = ActiveStateRestarted
 	}
-	enableCmd := fmt.Sprintf("%s; %s", enableCmdBase, enableCmdPart)
-	logger.Debug("enabling service", zap.String("service", service), zap.String("cmd", enableCmd))
-	enableOutput, err := p.CommandExecutor.Exec(ctx, enableCmd)
+	changed, err := p.EnsureServiceState(ctx, service, desired)
 	if err != nil {
-		logger.Info("failed to enable service", zap.String("service", service), zap.ByteString("output", enableOutput), zap.Error(err))
-		return true, fmt.Errorf("enabling service: %w", err)
+		logger.Info("failed to enable service", zap.String("service", service), zap.Error(err))
+		return changed, fmt.Errorf("enabling service: %w", err)
 	}
-	return true, nil
+	return changed, nil
 }
 
 func (p *Provisioner) EnsureServiceEnabledP(service string) pipeline.FuncT {
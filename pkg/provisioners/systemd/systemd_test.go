@@ -47,6 +47,18 @@ WantedBy=multi-user.target
 	test.RequireNonIdempotence(r, func() (bool, error) {
 		return sProvisioner.EnsureServiceEnabledNow(ctx, serviceName, true)
 	})
+
+	// units without an install section are static and only have to be started
+	staticName := fmt.Sprintf("%s-static.service", testEnsureServiceEnabledNowInstanceName)
+	_, err = fProvisioner.EnsureFileContentsString(ctx, filepath.Join("/etc/systemd/system", staticName), "[Service]\nExecStart=/bin/sleep 1000\n")
+	r.NoError(err)
+	test.RequireIdempotence(r, func() (bool, error) {
+		return sProvisioner.EnsureServiceEnabledNow(ctx, staticName, false)
+	})
+	status, err := sProvisioner.GetServiceStatus(ctx, staticName)
+	r.NoError(err)
+	r.Equal("static", status.UnitFileState)
+	r.True(status.Running())
 }
 
 func TestOSRelease(t *testing.T) {
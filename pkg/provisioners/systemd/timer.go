@@ -0,0 +1,291 @@
+package systemd
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/ctr2cloud/ctr2cloud/pkg/generic/compute"
+	"github.com/ctr2cloud/ctr2cloud/pkg/pipeline"
+	"github.com/juju/zaputil/zapctx"
+	"go.uber.org/zap"
+)
+
+// scheduledJobMarker is set in the [Unit] section of timers created by EnsureScheduledJob,
+// systemd ignores keys starting with X-
+const scheduledJobMarker = "X-Ctr2cloud-Scheduled-Job"
+
+// ScheduledJob is a command which is run periodically by a timer and its oneshot service
+type ScheduledJob struct {
+	// Name is used for the .service and .timer units
+	Name        string
+	Description string
+	// Command is run with /bin/sh -c
+	Command string
+	// OnCalendar is a systemd calendar expression, e.g. daily or *-*-* 03:00:00
+	OnCalendar string
+	// User defaults to root
+	User            string
+	RandomizedDelay time.Duration
+	// Persistent runs the job on boot if a run was missed while the instance was off
+	Persistent bool
+}
+
+// execQuote quotes s as a single argument of ExecStart. $ and % are escaped,
+// so that systemd does not expand variables or specifiers.
+func execQuote(s string) string {
+	s = strings.ReplaceAll(s, "$", "$$")
+	s = strings.ReplaceAll(s, "%", "%%")
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	return `"` + s + `"`
+}
+
+// units returns the service and timer unit of the job
+func (j ScheduledJob) units() []UnitSpec {
+	description := j.Description
+	if description == "" {
+		description = j.Name
+	}
+	service := UnitSpec{
+		Name: j.Name + ".service",
+		Unit: UnitSection{Description: description},
+		Service: &ServiceSection{
+			Type:      "oneshot",
+			ExecStart: []string{"/bin/sh -c " + execQuote(j.Command)},
+			User:      j.User,
+		},
+	}
+	timer := UnitSpec{
+		Name: j.Name + ".timer",
+		Unit: UnitSection{
+			Description: description,
+			Extra:       []Directive{{Key: scheduledJobMarker, Value: "true"}},
+		},
+		Timer: &TimerSection{
+			OnCalendar:         []string{j.OnCalendar},
+			RandomizedDelaySec: j.RandomizedDelay,
+			Persistent:         j.Persistent,
+		},
+		Install: InstallSection{WantedBy: []string{"timers.target"}},
+	}
+	return []UnitSpec{service, timer}
+}
+
+// EnsureScheduledJob ensures that the service and timer units of job exist and the timer is enabled and running
+func (p *Provisioner) EnsureScheduledJob(ctx context.Context, job ScheduledJob) (bool, error) {
+	if job.Name == "" || job.Command == "" || job.OnCalendar == "" {
+		return false, fmt.Errorf("%w: scheduled job needs a name, command and calendar", ErrInvalidUnit)
+	}
+	changed, err := p.EnsureUnits(ctx, job.units())
+	if err != nil {
+		return changed, fmt.Errorf("scheduled job %s: %w", job.Name, err)
+	}
+	enabled, err := p.EnsureServiceState(ctx, job.Name+".timer", ServiceState{Active: ActiveStateStarted, Enablement: EnablementEnabled})
+	if err != nil {
+		return changed || enabled, fmt.Errorf("scheduled job %s: %w", job.Name, err)
+	}
+	return changed || enabled, nil
+}
+
+// EnsureScheduledJobP is the pipeline version of EnsureScheduledJob
+func (p *Provisioner) EnsureScheduledJobP(job ScheduledJob) pipeline.FuncT {
+	return func(ctx *pipeline.Context) error {
+		changed, err := p.EnsureScheduledJob(ctx, job)
+		if err != nil {
+			return err
+		}
+		ctx.SetResult(changed)
+		return nil
+	}
+}
+
+// GetScheduledJobs returns the names of all jobs created by EnsureScheduledJob
+func (p *Provisioner) GetScheduledJobs(ctx context.Context) ([]string, error) {
+	cmd := fmt.Sprintf("grep -l '^%s=' %s/*.timer 2>/dev/null; true", scheduledJobMarker, UnitDir)
+	output, err := p.CommandExecutor.ExecString(ctx, cmd)
+	if err != nil {
+		return nil, fmt.Errorf("listing scheduled jobs: %w", err)
+	}
+	names := make([]string, 0)
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasSuffix(line, ".timer") {
+			names = append(names, strings.TrimSuffix(line[strings.LastIndex(line, "/")+1:], ".timer"))
+		}
+	}
+	slices.Sort(names)
+	return names, nil
+}
+
+// EnsureScheduledJobAbsent stops the job and removes its units
+func (p *Provisioner) EnsureScheduledJobAbsent(ctx context.Context, name string) (bool, error) {
+	timerRemoved, err := p.EnsureUnitAbsent(ctx, name+".timer")
+	if err != nil {
+		return timerRemoved, fmt.Errorf("scheduled job %s: %w", name, err)
+	}
+	serviceRemoved, err := p.EnsureUnitAbsent(ctx, name+".service")
+	if err != nil {
+		return true, fmt.Errorf("scheduled job %s: %w", name, err)
+	}
+	return timerRemoved || serviceRemoved, nil
+}
+
+// EnsureScheduledJobs ensures that exactly jobs are scheduled.
+// Jobs created by EnsureScheduledJob which are not in jobs are removed.
+func (p *Provisioner) EnsureScheduledJobs(ctx context.Context, jobs []ScheduledJob) (bool, error) {
+	logger := zapctx.Logger(ctx)
+	changed := false
+	for _, job := range jobs {
+		jobChanged, err := p.EnsureScheduledJob(ctx, job)
+		changed = changed || jobChanged
+		if err != nil {
+			return changed, err
+		}
+	}
+	existing, err := p.GetScheduledJobs(ctx)
+	if err != nil {
+		return changed, err
+	}
+	for _, name := range existing {
+		if slices.ContainsFunc(jobs, func(job ScheduledJob) bool { return job.Name == name }) {
+			continue
+		}
+		logger.Debug("removing stale scheduled job", zap.String("job", name))
+		removed, err := p.EnsureScheduledJobAbsent(ctx, name)
+		changed = changed || removed
+		if err != nil {
+			return changed, err
+		}
+	}
+	return changed, nil
+}
+
+// EnsureScheduledJobsP is the pipeline version of EnsureScheduledJobs
+func (p *Provisioner) EnsureScheduledJobsP(jobs ...ScheduledJob) pipeline.FuncT {
+	return func(ctx *pipeline.Context) error {
+		changed, err := p.EnsureScheduledJobs(ctx, jobs)
+		if err != nil {
+			return err
+		}
+		ctx.SetResult(changed)
+		return nil
+	}
+}
+
+// TimerStatus is a single line of systemctl list-timers
+type TimerStatus struct {
+	Unit      string
+	Activates string
+	// Next is the zero time if the timer will not elapse again
+	Next time.Time
+	// Last is the zero time if the timer never elapsed
+	Last time.Time
+}
+
+// listTimersTimeLayout is the timestamp format of systemctl list-timers with TZ=UTC
+const listTimersTimeLayout = "Mon 2006-01-02 15:04:05 MST"
+
+// parseTimestampField parses a timestamp starting at fields[0] and returns the number of fields used
+func parseTimestampField(fields []string) (time.Time, int, error) {
+	if len(fields) == 0 {
+		return time.Time{}, 0, fmt.Errorf("missing timestamp")
+	}
+	if fields[0] == "-" || fields[0] == "n/a" {
+		return time.Time{}, 1, nil
+	}
+	if len(fields) < 4 {
+		return time.Time{}, 0, fmt.Errorf("truncated timestamp: %s", strings.Join(fields, " "))
+	}
+	t, err := time.Parse(listTimersTimeLayout, strings.Join(fields[:4], " "))
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+	return t, 4, nil
+}
+
+// skipRelativeField returns the number of fields of a relative time such as "5h 3min left", which ends with suffix
+func skipRelativeField(fields []string, suffix string) (int, error) {
+	if len(fields) > 0 && (fields[0] == "-" || fields[0] == "n/a") {
+		return 1, nil
+	}
+	idx := slices.Index(fields, suffix)
+	if idx == -1 {
+		return 0, fmt.Errorf("missing %q", suffix)
+	}
+	return idx + 1, nil
+}
+
+// parseListTimersOutput parses the output of systemctl list-timers --all --no-legend in UTC, e.g.
+// Tue 2024-01-02 00:00:00 UTC 5h 3min left Mon 2024-01-01 00:00:01 UTC 18h ago logrotate.timer logrotate.service
+func parseListTimersOutput(output string) ([]TimerStatus, error) {
+	timers := make([]TimerStatus, 0)
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		var status TimerStatus
+		var n int
+		var err error
+		status.Next, n, err = parseTimestampField(fields)
+		if err != nil {
+			return nil, fmt.Errorf("parsing next elapse of %s: %w", line, err)
+		}
+		fields = fields[n:]
+		n, err = skipRelativeField(fields, "left")
+		if err != nil {
+			return nil, fmt.Errorf("parsing %s: %w", line, err)
+		}
+		fields = fields[n:]
+		status.Last, n, err = parseTimestampField(fields)
+		if err != nil {
+			return nil, fmt.Errorf("parsing last trigger of %s: %w", line, err)
+		}
+		fields = fields[n:]
+		n, err = skipRelativeField(fields, "ago")
+		if err != nil {
+			return nil, fmt.Errorf("parsing %s: %w", line, err)
+		}
+		fields = fields[n:]
+		if len(fields) < 1 {
+			return nil, fmt.Errorf("missing unit in %s", line)
+		}
+		status.Unit = fields[0]
+		if len(fields) > 1 {
+			status.Activates = fields[1]
+		}
+		timers = append(timers, status)
+	}
+	return timers, nil
+}
+
+// GetTimers returns the status of all timers, or of the timers matching patterns
+func (p *Provisioner) GetTimers(ctx context.Context, patterns ...string) ([]TimerStatus, error) {
+	quotedPatterns := make([]string, 0, len(patterns))
+	for _, pattern := range patterns {
+		quotedPatterns = append(quotedPatterns, compute.ShellQuote(pattern))
+	}
+	cmd := "TZ=UTC systemctl list-timers --all --no-legend --no-pager " + strings.Join(quotedPatterns, " ")
+	output, err := p.CommandExecutor.ExecString(ctx, cmd)
+	if err != nil {
+		return nil, fmt.Errorf("systemctl list-timers: %s: %w", strings.TrimSpace(output), err)
+	}
+	return parseListTimersOutput(output)
+}
+
+// GetScheduledJobNextRun returns the next time the job name runs, or the zero time if it is not scheduled
+func (p *Provisioner) GetScheduledJobNextRun(ctx context.Context, name string) (time.Time, error) {
+	timers, err := p.GetTimers(ctx, name+".timer")
+	if err != nil {
+		return time.Time{}, err
+	}
+	for _, timer := range timers {
+		if timer.Unit == name+".timer" {
+			return timer.Next, nil
+		}
+	}
+	return time.Time{}, nil
+}
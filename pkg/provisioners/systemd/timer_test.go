@@ -0,0 +1,111 @@
+package systemd
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ctr2cloud/ctr2cloud/internal/test"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExecQuote(t *testing.T) {
+	require.Equal(t, `"tar czf /backup/$$(date +%%F).tgz \"/srv/my data\""`, execQuote(`tar czf /backup/$(date +%F).tgz "/srv/my data"`))
+}
+
+func TestRenderScheduledJob(t *testing.T) {
+	units := ScheduledJob{
+		Name:            "backup",
+		Command:         "/usr/local/bin/backup",
+		OnCalendar:      "*-*-* 03:00:00",
+		User:            "backup",
+		RandomizedDelay: 10 * time.Minute,
+	}.units()
+	require.Len(t, units, 2)
+
+	service, err := units[0].Render()
+	require.NoError(t, err)
+	require.Equal(t, `[Unit]
+Description=backup
+
+[Service]
+Type=oneshot
+ExecStart=/bin/sh -c "/usr/local/bin/backup"
+User=backup
+`, service)
+
+	timer, err := units[1].Render()
+	require.NoError(t, err)
+	require.Equal(t, `[Unit]
+Description=backup
+X-Ctr2cloud-Scheduled-Job=true
+
+[Timer]
+OnCalendar=*-*-* 03:00:00
+RandomizedDelaySec=600s
+
+[Install]
+WantedBy=timers.target
+`, timer)
+}
+
+func TestParseListTimersOutput(t *testing.T) {
+	output := `Tue 2024-01-02 00:00:00 UTC 5h 3min left Mon 2024-01-01 00:00:01 UTC 18h ago logrotate.timer              logrotate.service
+Tue 2024-01-02 03:04:00 UTC 8h left      -                               -       backup.timer                 backup.service
+-                           -            Mon 2024-01-01 12:00:00 UTC 6h ago  oneshot.timer                oneshot.service
+`
+	timers, err := parseListTimersOutput(output)
+	require.NoError(t, err)
+	require.Equal(t, []TimerStatus{
+		{
+			Unit:      "logrotate.timer",
+			Activates: "logrotate.service",
+			Next:      time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC),
+			Last:      time.Date(2024, 1, 1, 0, 0, 1, 0, time.UTC),
+		},
+		{
+			Unit:      "backup.timer",
+			Activates: "backup.service",
+			Next:      time.Date(2024, 1, 2, 3, 4, 0, 0, time.UTC),
+		},
+		{
+			Unit:      "oneshot.timer",
+			Activates: "oneshot.service",
+			Last:      time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC),
+		},
+	}, timers)
+
+	_, err = parseListTimersOutput("Tue 2024-01-02 garbage\n")
+	require.Error(t, err)
+}
+
+const testEnsureScheduledJobInstanceName = "test-ensure-scheduled-job"
+
+func TestEnsureScheduledJob(t *testing.T) {
+	executor, err := test.GetLXDExecutorFactory(t, testEnsureScheduledJobInstanceName)()
+	ctx, r := test.DefaultPreamble(t, time.Minute)
+	r.NoError(err)
+	sProvisioner := Provisioner{CommandExecutor: executor}
+
+	jobs := []ScheduledJob{
+		{Name: "test-job-a", Command: "echo a >> /tmp/test-job-a", OnCalendar: "hourly"},
+		{Name: "test-job-b", Command: "echo b >> /tmp/test-job-b", OnCalendar: "daily", RandomizedDelay: time.Minute},
+	}
+	test.RequireIdempotence(r, func() (bool, error) {
+		return sProvisioner.EnsureScheduledJobs(ctx, jobs)
+	})
+	next, err := sProvisioner.GetScheduledJobNextRun(ctx, "test-job-a")
+	r.NoError(err)
+	r.True(next.After(time.Now()))
+
+	// test-job-b is no longer declared and removed
+	test.RequireIdempotence(r, func() (bool, error) {
+		return sProvisioner.EnsureScheduledJobs(ctx, jobs[:1])
+	})
+	names, err := sProvisioner.GetScheduledJobs(ctx)
+	r.NoError(err)
+	r.Equal([]string{"test-job-a"}, names)
+
+	test.RequireIdempotence(r, func() (bool, error) {
+		return sProvisioner.EnsureScheduledJobs(ctx, nil)
+	})
+}
@@ -0,0 +1,346 @@
+package systemd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ctr2cloud/ctr2cloud/pkg/generic/compute"
+	"github.com/ctr2cloud/ctr2cloud/pkg/pipeline"
+	"github.com/ctr2cloud/ctr2cloud/pkg/provisioners/file"
+	"github.com/juju/zaputil/zapctx"
+	"go.uber.org/zap"
+)
+
+// UnitDir is where units defined by EnsureUnit are written to
+const UnitDir = "/etc/systemd/system"
+
+var ErrInvalidUnit = errors.New("invalid unit")
+
+// Directive is a single Key=Value line for directives without a typed field
+type Directive struct {
+	Key   string
+	Value string
+}
+
+type UnitSection struct {
+	Description   string
+	Documentation []string
+	After         []string
+	Before        []string
+	Wants         []string
+	Requires      []string
+	Extra         []Directive
+}
+
+type ServiceSection struct {
+	// Type defaults to simple
+	Type         string
+	ExecStartPre []string
+	ExecStart    []string
+	ExecStop     []string
+	ExecReload   []string
+	// Restart is one of no, on-success, on-failure, on-abnormal, on-watchdog, on-abort or always
+	Restart    string
+	RestartSec time.Duration
+	// Environment variables are quoted and escaped as needed
+	Environment      map[string]string
+	EnvironmentFile  []string
+	User             string
+	Group            string
+	WorkingDirectory string
+	Extra            []Directive
+}
+
+type TimerSection struct {
+	OnCalendar         []string
+	OnBootSec          time.Duration
+	OnUnitActiveSec    time.Duration
+	RandomizedDelaySec time.Duration
+	Persistent         bool
+	// Unit defaults to the service with the same name as the timer
+	Unit  string
+	Extra []Directive
+}
+
+type SocketSection struct {
+	ListenStream   []string
+	ListenDatagram []string
+	Accept         bool
+	// Service defaults to the service with the same name as the socket
+	Service string
+	Extra   []Directive
+}
+
+type InstallSection struct {
+	WantedBy   []string
+	RequiredBy []string
+	Also       []string
+}
+
+// UnitSpec describes a unit file. Only the sections matching the unit type are rendered.
+type UnitSpec struct {
+	// Name of the unit including its type suffix, e.g. myapp.service
+	Name    string
+	Unit    UnitSection
+	Service *ServiceSection
+	Timer   *TimerSection
+	Socket  *SocketSection
+	Install InstallSection
+	// Raw is written as is instead of rendering the sections if set
+	Raw string
+}
+
+// UnitPath returns the path of the unit file for the unit name
+func UnitPath(name string) string {
+	return path.Join(UnitDir, name)
+}
+
+// formatDuration formats d as a systemd time span in seconds
+func formatDuration(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'f', -1, 64) + "s"
+}
+
+// quoteValue quotes s for use in a directive which supports C-style quoting, e.g. Environment
+func quoteValue(s string) string {
+	s = strings.ReplaceAll(s, "%", "%%")
+	if !strings.ContainsAny(s, " \t\"'\\") {
+		return s
+	}
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	return `"` + s + `"`
+}
+
+type unitWriter struct {
+	sb strings.Builder
+}
+
+func (w *unitWriter) section(name string) {
+	if w.sb.Len() > 0 {
+		w.sb.WriteString("\n")
+	}
+	w.sb.WriteString("[" + name + "]\n")
+}
+
+func (w *unitWriter) directive(key, value string) {
+	if value != "" {
+		w.sb.WriteString(key + "=" + value + "\n")
+	}
+}
+
+// list writes one directive per value, so that values may contain spaces
+func (w *unitWriter) list(key string, values []string) {
+	for _, value := range values {
+		w.directive(key, value)
+	}
+}
+
+func (w *unitWriter) duration(key string, d time.Duration) {
+	if d > 0 {
+		w.directive(key, formatDuration(d))
+	}
+}
+
+func (w *unitWriter) extra(directives []Directive) {
+	for _, d := range directives {
+		w.directive(d.Key, d.Value)
+	}
+}
+
+// Render returns the contents of the unit file
+func (s UnitSpec) Render() (string, error) {
+	if s.Raw != "" {
+		return s.Raw, nil
+	}
+	unitType := path.Ext(s.Name)
+	w := &unitWriter{}
+
+	w.section("Unit")
+	w.directive("Description", s.Unit.Description)
+	w.list("Documentation", s.Unit.Documentation)
+	w.directive("After", strings.Join(s.Unit.After, " "))
+	w.directive("Before", strings.Join(s.Unit.Before, " "))
+	w.directive("Wants", strings.Join(s.Unit.Wants, " "))
+	w.directive("Requires", strings.Join(s.Unit.Requires, " "))
+	w.extra(s.Unit.Extra)
+
+	switch unitType {
+	case ".service":
+		if s.Service == nil {
+			return "", fmt.Errorf("%w: %s has no service section", ErrInvalidUnit, s.Name)
+		}
+		w.section("Service")
+		w.directive("Type", s.Service.Type)
+		w.list("ExecStartPre", s.Service.ExecStartPre)
+		w.list("ExecStart", s.Service.ExecStart)
+		w.list("ExecStop", s.Service.ExecStop)
+		w.list("ExecReload", s.Service.ExecReload)
+		w.directive("Restart", s.Service.Restart)
+		w.duration("RestartSec", s.Service.RestartSec)
+		envKeys := make([]string, 0, len(s.Service.Environment))
+		for key := range s.Service.Environment {
+			envKeys = append(envKeys, key)
+		}
+		slices.Sort(envKeys)
+		for _, key := range envKeys {
+			w.directive("Environment", quoteValue(key+"="+s.Service.Environment[key]))
+		}
+		w.list("EnvironmentFile", s.Service.EnvironmentFile)
+		w.directive("User", s.Service.User)
+		w.directive("Group", s.Service.Group)
+		w.directive("WorkingDirectory", s.Service.WorkingDirectory)
+		w.extra(s.Service.Extra)
+	case ".timer":
+		if s.Timer == nil {
+			return "", fmt.Errorf("%w: %s has no timer section", ErrInvalidUnit, s.Name)
+		}
+		w.section("Timer")
+		w.list("OnCalendar", s.Timer.OnCalendar)
+		w.duration("OnBootSec", s.Timer.OnBootSec)
+		w.duration("OnUnitActiveSec", s.Timer.OnUnitActiveSec)
+		w.duration("RandomizedDelaySec", s.Timer.RandomizedDelaySec)
+		if s.Timer.Persistent {
+			w.directive("Persistent", "true")
+		}
+		w.directive("Unit", s.Timer.Unit)
+		w.extra(s.Timer.Extra)
+	case ".socket":
+		if s.Socket == nil {
+			return "", fmt.Errorf("%w: %s has no socket section", ErrInvalidUnit, s.Name)
+		}
+		w.section("Socket")
+		w.list("ListenStream", s.Socket.ListenStream)
+		w.list("ListenDatagram", s.Socket.ListenDatagram)
+		if s.Socket.Accept {
+			w.directive("Accept", "yes")
+		}
+		w.directive("Service", s.Socket.Service)
+		w.extra(s.Socket.Extra)
+	case ".target", ".path", ".mount":
+		// these only use the common sections or Extra
+	default:
+		return "", fmt.Errorf("%w: unsupported unit type of %s", ErrInvalidUnit, s.Name)
+	}
+
+	if len(s.Install.WantedBy)+len(s.Install.RequiredBy)+len(s.Install.Also) > 0 {
+		w.section("Install")
+		w.directive("WantedBy", strings.Join(s.Install.WantedBy, " "))
+		w.directive("RequiredBy", strings.Join(s.Install.RequiredBy, " "))
+		w.directive("Also", strings.Join(s.Install.Also, " "))
+	}
+	return w.sb.String(), nil
+}
+
+// DaemonReload makes systemd pick up changed unit files
+func (p *Provisioner) DaemonReload(ctx context.Context) error {
+	output, err := p.CommandExecutor.ExecString(ctx, "systemctl daemon-reload")
+	if err != nil {
+		return fmt.Errorf("systemctl daemon-reload: %s: %w", strings.TrimSpace(output), err)
+	}
+	return nil
+}
+
+// EnsureUnits writes the unit files of specs to UnitDir. If any unit changed, systemd is reloaded
+// once and the changed units which are running are restarted to apply the new definition.
+func (p *Provisioner) EnsureUnits(ctx context.Context, specs []UnitSpec) (bool, error) {
+	logger := zapctx.Logger(ctx)
+	fProvisioner := file.Provisioner{CommandExecutor: p.CommandExecutor}
+	changedUnits := make([]string, 0)
+	for _, spec := range specs {
+		contents, err := spec.Render()
+		if err != nil {
+			return len(changedUnits) > 0, err
+		}
+		changed, err := fProvisioner.EnsureFileContentsString(ctx, UnitPath(spec.Name), contents)
+		if err != nil {
+			return len(changedUnits) > 0, fmt.Errorf("writing unit %s: %w", spec.Name, err)
+		}
+		if changed {
+			logger.Debug("unit changed", zap.String("unit", spec.Name))
+			changedUnits = append(changedUnits, compute.ShellQuote(spec.Name))
+		}
+	}
+	if len(changedUnits) == 0 {
+		return false, nil
+	}
+
+	err := p.DaemonReload(ctx)
+	if err != nil {
+		return true, err
+	}
+	// try-restart leaves units alone which are not running
+	cmd := "systemctl try-restart " + strings.Join(changedUnits, " ")
+	output, err := p.CommandExecutor.ExecString(ctx, cmd)
+	if err != nil {
+		return true, fmt.Errorf("restarting changed units: %s: %w", strings.TrimSpace(output), err)
+	}
+	return true, nil
+}
+
+// EnsureUnitsP is the pipeline version of EnsureUnits
+func (p *Provisioner) EnsureUnitsP(specs ...UnitSpec) pipeline.FuncT {
+	return func(ctx *pipeline.Context) error {
+		changed, err := p.EnsureUnits(ctx, specs)
+		if err != nil {
+			return err
+		}
+		ctx.SetResult(changed)
+		return nil
+	}
+}
+
+// EnsureUnit writes a single unit file, see EnsureUnits
+func (p *Provisioner) EnsureUnit(ctx context.Context, spec UnitSpec) (bool, error) {
+	return p.EnsureUnits(ctx, []UnitSpec{spec})
+}
+
+// EnsureUnitP is the pipeline version of EnsureUnit
+func (p *Provisioner) EnsureUnitP(spec UnitSpec) pipeline.FuncT {
+	return p.EnsureUnitsP(spec)
+}
+
+// EnsureUnitAbsent stops and disables the unit name and removes its unit file from UnitDir
+func (p *Provisioner) EnsureUnitAbsent(ctx context.Context, name string) (bool, error) {
+	fProvisioner := file.Provisioner{CommandExecutor: p.CommandExecutor}
+	unitPath := UnitPath(name)
+	_, err := fProvisioner.GetMD5Sum(ctx, unitPath)
+	if errors.Is(err, file.ErrFileNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("checking unit %s: %w", name, err)
+	}
+
+	quotedName := compute.ShellQuote(name)
+	output, err := p.CommandExecutor.ExecString(ctx, fmt.Sprintf("systemctl disable --now %s", quotedName))
+	if err != nil {
+		return false, fmt.Errorf("disabling unit %s: %s: %w", name, strings.TrimSpace(output), err)
+	}
+	_, err = fProvisioner.EnsureFileAbsent(ctx, unitPath)
+	if err != nil {
+		return true, fmt.Errorf("removing unit %s: %w", name, err)
+	}
+	err = p.DaemonReload(ctx)
+	if err != nil {
+		return true, err
+	}
+	return true, nil
+}
+
+// EnsureUnitAbsentP is the pipeline version of EnsureUnitAbsent
+func (p *Provisioner) EnsureUnitAbsentP(name string) pipeline.FuncT {
+	return func(ctx *pipeline.Context) error {
+		changed, err := p.EnsureUnitAbsent(ctx, name)
+		if err != nil {
+			return err
+		}
+		ctx.SetResult(changed)
+		return nil
+	}
+}
@@ -0,0 +1,123 @@
+package systemd
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ctr2cloud/ctr2cloud/internal/test"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRenderService(t *testing.T) {
+	spec := UnitSpec{
+		Name: "myapp.service",
+		Unit: UnitSection{
+			Description: "My App",
+			After:       []string{"network-online.target"},
+			Wants:       []string{"network-online.target"},
+		},
+		Service: &ServiceSection{
+			ExecStart:  []string{"/usr/local/bin/myapp --port 8080"},
+			Restart:    "on-failure",
+			RestartSec: 1500 * time.Millisecond,
+			Environment: map[string]string{
+				"MESSAGE":  `say "hi" 100%`,
+				"LOG_MODE": "json",
+			},
+			User:  "myapp",
+			Extra: []Directive{{Key: "LimitNOFILE", Value: "65536"}},
+		},
+		Install: InstallSection{WantedBy: []string{"multi-user.target"}},
+	}
+	contents, err := spec.Render()
+	require.NoError(t, err)
+	require.Equal(t, `[Unit]
+Description=My App
+After=network-online.target
+Wants=network-online.target
+
+[Service]
+ExecStart=/usr/local/bin/myapp --port 8080
+Restart=on-failure
+RestartSec=1.5s
+Environment=LOG_MODE=json
+Environment="MESSAGE=say \"hi\" 100%%"
+User=myapp
+LimitNOFILE=65536
+
+[Install]
+WantedBy=multi-user.target
+`, contents)
+}
+
+func TestRenderTimerAndSocket(t *testing.T) {
+	contents, err := UnitSpec{
+		Name:    "backup.timer",
+		Timer:   &TimerSection{OnCalendar: []string{"daily"}, Persistent: true},
+		Install: InstallSection{WantedBy: []string{"timers.target"}},
+	}.Render()
+	require.NoError(t, err)
+	require.Equal(t, "[Unit]\n\n[Timer]\nOnCalendar=daily\nPersistent=true\n\n[Install]\nWantedBy=timers.target\n", contents)
+
+	contents, err = UnitSpec{
+		Name:   "echo.socket",
+		Socket: &SocketSection{ListenStream: []string{"127.0.0.1:7777"}, Accept: true},
+	}.Render()
+	require.NoError(t, err)
+	require.Equal(t, "[Unit]\n\n[Socket]\nListenStream=127.0.0.1:7777\nAccept=yes\n", contents)
+
+	raw := "[Unit]\nDescription=raw\n"
+	contents, err = UnitSpec{Name: "raw.service", Raw: raw}.Render()
+	require.NoError(t, err)
+	require.Equal(t, raw, contents)
+
+	_, err = UnitSpec{Name: "missing.service"}.Render()
+	require.True(t, errors.Is(err, ErrInvalidUnit))
+	_, err = UnitSpec{Name: "unknown.foo"}.Render()
+	require.True(t, errors.Is(err, ErrInvalidUnit))
+}
+
+const testEnsureUnitInstanceName = "test-ensure-unit"
+
+func TestEnsureUnit(t *testing.T) {
+	executor, err := test.GetLXDExecutorFactory(t, testEnsureUnitInstanceName)()
+	ctx, r := test.DefaultPreamble(t, time.Minute)
+	r.NoError(err)
+	sProvisioner := Provisioner{CommandExecutor: executor}
+
+	serviceName := fmt.Sprintf("%s.service", testEnsureUnitInstanceName)
+	spec := UnitSpec{
+		Name: serviceName,
+		Unit: UnitSection{Description: "Test Unit"},
+		Service: &ServiceSection{
+			ExecStart:   []string{"/bin/sh -c 'echo $GREETING; exec sleep 1000'"},
+			Restart:     "always",
+			Environment: map[string]string{"GREETING": "hello"},
+		},
+		Install: InstallSection{WantedBy: []string{"multi-user.target"}},
+	}
+	test.RequireIdempotence(r, func() (bool, error) {
+		return sProvisioner.EnsureUnit(ctx, spec)
+	})
+	test.RequireIdempotence(r, func() (bool, error) {
+		return sProvisioner.EnsureServiceEnabledNow(ctx, serviceName, false)
+	})
+	pid, err := executor.ExecString(ctx, "systemctl show -p MainPID --value "+serviceName)
+	r.NoError(err)
+
+	// changing the unit restarts the running service
+	spec.Service.Environment["GREETING"] = "bye"
+	test.RequireIdempotence(r, func() (bool, error) {
+		return sProvisioner.EnsureUnit(ctx, spec)
+	})
+	newPid, err := executor.ExecString(ctx, "systemctl show -p MainPID --value "+serviceName)
+	r.NoError(err)
+	r.NotEqual(strings.TrimSpace(pid), strings.TrimSpace(newPid))
+
+	test.RequireIdempotence(r, func() (bool, error) {
+		return sProvisioner.EnsureUnitAbsent(ctx, serviceName)
+	})
+}
@@ -0,0 +1,138 @@
+package systemd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ctr2cloud/ctr2cloud/pkg/generic/compute"
+	"github.com/ctr2cloud/ctr2cloud/pkg/pipeline"
+	"github.com/juju/zaputil/zapctx"
+	"go.uber.org/zap"
+)
+
+var ErrServiceUnhealthy = errors.New("service unhealthy")
+
+const (
+	DefaultVerifyTimeout  = 30 * time.Second
+	DefaultVerifyInterval = time.Second
+	DefaultJournalLines   = 50
+)
+
+// HealthCheck is run on the instance after the unit is active, all set checks must succeed
+type HealthCheck struct {
+	// Command is healthy if it exits with 0
+	Command string
+	// TCPPort is healthy if a socket listens on it
+	TCPPort int
+	// HTTPURL is healthy if it returns a 2xx status code
+	HTTPURL string
+}
+
+type VerifyOptions struct {
+	// Timeout defaults to DefaultVerifyTimeout
+	Timeout time.Duration
+	// Interval between probes, defaults to DefaultVerifyInterval
+	Interval    time.Duration
+	HealthCheck HealthCheck
+	// JournalLines is the number of journal lines included in the error, defaults to DefaultJournalLines
+	JournalLines int
+}
+
+// commands returns the shell commands of the health check
+func (h HealthCheck) commands() []string {
+	commands := make([]string, 0)
+	if h.Command != "" {
+		commands = append(commands, h.Command)
+	}
+	if h.TCPPort != 0 {
+		// busybox provides netstat but not ss
+		commands = append(commands, fmt.Sprintf("(ss -ltn 2>/dev/null || netstat -ltn 2>/dev/null) | grep -qE ':%d[[:space:]]'", h.TCPPort))
+	}
+	if h.HTTPURL != "" {
+		quotedURL := compute.ShellQuote(h.HTTPURL)
+		commands = append(commands, fmt.Sprintf("if command -v curl >/dev/null; then curl -fsS -o /dev/null --max-time 5 %s; else wget -q -O /dev/null -T 5 %s; fi", quotedURL, quotedURL))
+	}
+	return commands
+}
+
+// GetDiagnostics returns the output of systemctl status and the last lines of the journal of unit.
+// Errors are included in the output, so that it can always be attached to an error.
+func (p *Provisioner) GetDiagnostics(ctx context.Context, unit string, journalLines int) string {
+	if journalLines <= 0 {
+		journalLines = DefaultJournalLines
+	}
+	quotedUnit := compute.ShellQuote(unit)
+	// both commands exit with an error for failed units, the output is still useful
+	status, _ := p.CommandExecutor.ExecString(ctx, fmt.Sprintf("systemctl status --no-pager -l %s", quotedUnit))
+	journal, _ := p.CommandExecutor.ExecString(ctx, fmt.Sprintf("journalctl --no-pager -u %s -n %d", quotedUnit, journalLines))
+	return fmt.Sprintf("--- systemctl status %s ---\n%s\n--- journalctl -u %s ---\n%s", unit, strings.TrimSpace(status), unit, strings.TrimSpace(journal))
+}
+
+// unhealthyError wraps ErrServiceUnhealthy with reason and the diagnostics of unit
+func (p *Provisioner) unhealthyError(ctx context.Context, unit, reason string, journalLines int) error {
+	return fmt.Errorf("%w: %s: %s\n%s", ErrServiceUnhealthy, unit, reason, p.GetDiagnostics(ctx, unit, journalLines))
+}
+
+// VerifyService waits until unit is active and its health check succeeds.
+// The error contains the status and journal of the unit if it does not become healthy within the timeout.
+func (p *Provisioner) VerifyService(ctx context.Context, unit string, opts VerifyOptions) error {
+	logger := zapctx.Logger(ctx)
+	timeout := opts.Timeout
+	if timeout <= 0 {
+		timeout = DefaultVerifyTimeout
+	}
+	interval := opts.Interval
+	if interval <= 0 {
+		interval = DefaultVerifyInterval
+	}
+	deadline := time.Now().Add(timeout)
+	checks := opts.HealthCheck.commands()
+
+	reason := ""
+	for {
+		status, err := p.GetServiceStatus(ctx, unit)
+		switch {
+		case err != nil:
+			reason = err.Error()
+		case status.ActiveState == "failed":
+			// the unit will not recover on its own
+			return p.unhealthyError(ctx, unit, "unit failed", opts.JournalLines)
+		case status.ActiveState != "active":
+			reason = "unit is " + status.ActiveState
+		default:
+			reason = ""
+			for _, check := range checks {
+				output, err := p.CommandExecutor.ExecString(ctx, check)
+				if err != nil {
+					reason = fmt.Sprintf("health check %q failed: %s", check, strings.TrimSpace(output))
+					break
+				}
+			}
+			if reason == "" {
+				logger.Debug("service healthy", zap.String("unit", unit))
+				return nil
+			}
+		}
+		logger.Debug("service not healthy yet", zap.String("unit", unit), zap.String("reason", reason))
+
+		if time.Now().Add(interval).After(deadline) {
+			return p.unhealthyError(ctx, unit, fmt.Sprintf("not healthy after %s: %s", timeout, reason), opts.JournalLines)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+}
+
+// VerifyServiceP is the pipeline version of VerifyService.
+// It does not record a result, so the changes of the previous step are passed on.
+func (p *Provisioner) VerifyServiceP(unit string, opts VerifyOptions) pipeline.FuncT {
+	return func(ctx *pipeline.Context) error {
+		return p.VerifyService(ctx, unit, opts)
+	}
+}
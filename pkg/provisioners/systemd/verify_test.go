@@ -0,0 +1,60 @@
+package systemd
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/ctr2cloud/ctr2cloud/internal/test"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHealthCheckCommands(t *testing.T) {
+	require.Empty(t, HealthCheck{}.commands())
+	commands := HealthCheck{Command: "true", TCPPort: 8080, HTTPURL: "http://localhost:8080/health"}.commands()
+	require.Len(t, commands, 3)
+	require.Equal(t, "true", commands[0])
+	require.Contains(t, commands[1], ":8080[[:space:]]")
+	require.Contains(t, commands[2], "http://localhost:8080/health")
+}
+
+const testVerifyServiceInstanceName = "test-verify-service"
+
+func TestVerifyService(t *testing.T) {
+	executor, err := test.GetLXDExecutorFactory(t, testVerifyServiceInstanceName)()
+	ctx, r := test.DefaultPreamble(t, time.Minute)
+	r.NoError(err)
+	sProvisioner := Provisioner{CommandExecutor: executor}
+
+	healthyName := fmt.Sprintf("%s-healthy.service", testVerifyServiceInstanceName)
+	_, err = sProvisioner.EnsureUnit(ctx, UnitSpec{
+		Name:    healthyName,
+		Service: &ServiceSection{ExecStart: []string{"/bin/sleep 1000"}},
+	})
+	r.NoError(err)
+	_, err = sProvisioner.EnsureServiceState(ctx, healthyName, ServiceState{Active: ActiveStateStarted})
+	r.NoError(err)
+	err = sProvisioner.VerifyService(ctx, healthyName, VerifyOptions{
+		Timeout:     10 * time.Second,
+		HealthCheck: HealthCheck{Command: "pgrep -f 'sleep 1000'"},
+	})
+	r.NoError(err)
+
+	// the diagnostics of a crashing service end up in the error
+	failingName := fmt.Sprintf("%s-failing.service", testVerifyServiceInstanceName)
+	_, err = sProvisioner.EnsureUnit(ctx, UnitSpec{
+		Name:    failingName,
+		Service: &ServiceSection{ExecStart: []string{"/bin/sh -c 'echo ctr2cloud-marker; exit 3'"}},
+	})
+	r.NoError(err)
+	_, _ = sProvisioner.EnsureServiceState(ctx, failingName, ServiceState{Active: ActiveStateStarted})
+	err = sProvisioner.VerifyService(ctx, failingName, VerifyOptions{Timeout: 10 * time.Second})
+	r.True(errors.Is(err, ErrServiceUnhealthy))
+	r.Contains(err.Error(), "ctr2cloud-marker")
+
+	for _, name := range []string{healthyName, failingName} {
+		_, err = sProvisioner.EnsureUnitAbsent(ctx, name)
+		r.NoError(err)
+	}
+}